@@ -0,0 +1,68 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// The admin endpoints are under /<db id>/_admin/ and are enabled only if an
+// "admin" node is configured for the database. They always authenticate using
+// HTTP Basic Authentication (or client certificates), as they may not have a body.
+
+// Parses the admin authentication configuration.
+func parseAdmin(db *db) {
+	if db.Admin.Mode == "" {
+		db.Admin.Mode = authModeHttp
+	}
+	if strings.ToUpper(db.Admin.Mode) == authModeInline {
+		mllog.Fatalf("for db '%s', admin authentication can only be HTTP or CERT", db.Id)
+	}
+	parseAuth(db, db.Admin, "Admin endpoints")
+}
+
+// Registers an admin endpoint for the database; path is relative to /<db id>/_admin
+func registerAdmin(db *db, method string, path string, handler fiber.Handler) {
+	app.Add(method, fmt.Sprintf("/%s/_admin%s", db.Id, path),
+		accessLog(db.Id), recover.New(), authMiddleware(db, db.Admin), handler)
+}
+
+// Registers all the admin endpoints for a database, if so configured
+func registerAdminEndpoints(db *db) {
+	if db.Admin == nil {
+		return
+	}
+
+	registerAdmin(db, fiber.MethodGet, "/slowQueries", slowQueriesHandler(db))
+	registerAdmin(db, fiber.MethodGet, "/tasks", tasksHandler(db))
+	registerAdmin(db, fiber.MethodPost, "/tasks/:idx/run", runTaskHandler(db))
+	registerAdmin(db, fiber.MethodGet, "/backup", backupHandler(db))
+	registerAdmin(db, fiber.MethodGet, "/snapshot", snapshotHandler(db))
+	registerAdmin(db, fiber.MethodPut, "/snapshot", snapshotUploadHandler(db))
+	registerAdmin(db, fiber.MethodPost, "/vacuum", vacuumHandler(db))
+	if len(db.Migrations) > 0 {
+		registerAdmin(db, fiber.MethodGet, "/migrations", migrationsHandler(db))
+	}
+	if db.ChangeFeed {
+		registerAdmin(db, fiber.MethodGet, "/changes", changesHandler(db))
+	}
+}
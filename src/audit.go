@@ -0,0 +1,216 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const redactedValue = "***"
+
+var identifierRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// A single executed statement (or query, if so configured), as it's recorded
+// in the audit log
+type auditEntry struct {
+	Timestamp    string                   `json:"timestamp"`
+	DbId         string                   `json:"db"`
+	User         string                   `json:"user,omitempty"`
+	ClientIP     string                   `json:"clientIp"`
+	ReqIdx       int                      `json:"reqIdx"`
+	StatementId  string                   `json:"statementId,omitempty"`
+	Sql          string                   `json:"sql,omitempty"`
+	Values       map[string]interface{}   `json:"values,omitempty"`
+	ValuesBatch  []map[string]interface{} `json:"valuesBatch,omitempty"`
+	RowsAffected *int64                   `json:"rowsAffected,omitempty"`
+	Success      bool                     `json:"success"`
+	Error        string                   `json:"error,omitempty"`
+	Committed    bool                     `json:"committed"`
+}
+
+// Collects the audit entries of a request. They are written when the transaction
+// is finalized, so that it's possible to know if they were committed. All the
+// methods can be called on a nil trail, that does nothing (audit not enabled).
+type auditTrail struct {
+	cfg     *auditCfg
+	base    auditEntry
+	entries []auditEntry
+}
+
+// Parses the audit configuration, validates it and opens the destination.
+func parseAudit(db *db) {
+	audit := db.Audit
+	if (audit.ToFile == "") == (audit.ToTable == "") { // == is "NOT XOR"
+		mllog.Fatalf("for db '%s', one and only one of 'toFile' and 'toTable' must be specified for audit", db.Id)
+	}
+
+	audit.Redacted = make(map[string]bool)
+	for i := range audit.RedactFields {
+		audit.Redacted[audit.RedactFields[i]] = true
+	}
+
+	if audit.ToFile != "" {
+		path := expandHomeDir(audit.ToFile, "audit file")
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			mllog.Fatalf("for db '%s', in opening audit file: %s", db.Id, err.Error())
+		}
+		audit.File = f
+		mllog.StdOutf("  + Audit log enabled, to file %s", path)
+	} else {
+		if !identifierRegexp.MatchString(audit.ToTable) {
+			mllog.Fatalf("for db '%s', audit table name is not valid: %s", db.Id, audit.ToTable)
+		}
+		if db.ReadOnly {
+			mllog.Fatalf("for db '%s', cannot write the audit log to a table of a read only db", db.Id)
+		}
+		if _, err := db.DbConn.ExecContext(context.Background(), fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s (TS TEXT, USER TEXT, CLIENT_IP TEXT, REQ_IDX INTEGER, STATEMENT_ID TEXT, "+
+				"SQL TEXT, VALS TEXT, ROWS_AFFECTED INTEGER, SUCCESS INTEGER, ERROR TEXT, COMMITTED INTEGER)",
+			audit.ToTable)); err != nil {
+			mllog.Fatalf("for db '%s', in creating audit table: %s", db.Id, err.Error())
+		}
+		mllog.StdOutf("  + Audit log enabled, to table %s", audit.ToTable)
+	}
+
+	if audit.IncludeQueries {
+		mllog.StdOut("  + Audit log includes queries")
+	}
+}
+
+// Returns the user that authenticated the request, if any
+func requestUser(c *fiber.Ctx, body *request) string {
+	if user, ok := c.Locals("username").(string); ok {
+		return user
+	}
+	if body.Credentials != nil {
+		return body.Credentials.User
+	}
+	return ""
+}
+
+func newAuditTrail(db *db, c *fiber.Ctx, body *request) *auditTrail {
+	if db.Audit == nil {
+		return nil
+	}
+	return &auditTrail{
+		cfg: db.Audit,
+		base: auditEntry{
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+			DbId:      db.Id,
+			User:      requestUser(c, body),
+			ClientIP:  c.IP(),
+		},
+	}
+}
+
+func (a *auditTrail) redact(values map[string]interface{}) map[string]interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if a.cfg.Redacted[k] {
+			ret[k] = redactedValue
+		} else {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// Records the outcome of an item of the transaction; sql is the one sent by
+// the client, so for stored statements it's their ID prefixed by '#'.
+func (a *auditTrail) add(reqIdx int, sql string, isQuery bool, values map[string]interface{}, valuesBatch []map[string]interface{}, res *responseItem, err error) {
+	if a == nil || (isQuery && !a.cfg.IncludeQueries) {
+		return
+	}
+
+	entry := a.base
+	entry.ReqIdx = reqIdx
+	if strings.HasPrefix(sql, "#") {
+		entry.StatementId = sql[1:]
+	} else {
+		entry.Sql = sql
+	}
+	entry.Values = a.redact(values)
+	for i := range valuesBatch {
+		entry.ValuesBatch = append(entry.ValuesBatch, a.redact(valuesBatch[i]))
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Success = true
+		if res.RowsUpdated != nil {
+			entry.RowsAffected = res.RowsUpdated
+		} else if res.RowsUpdatedBatch != nil {
+			var sum int64
+			for i := range res.RowsUpdatedBatch {
+				sum += res.RowsUpdatedBatch[i]
+			}
+			entry.RowsAffected = &sum
+		}
+	}
+	a.entries = append(a.entries, entry)
+}
+
+// Writes the collected entries to the destination. Must be called after the
+// transaction is finalized, but still while holding the db mutex.
+func (a *auditTrail) flush(db *db, committed bool) {
+	if a == nil {
+		return
+	}
+	for i := range a.entries {
+		entry := a.entries[i]
+		entry.Committed = committed
+
+		if a.cfg.File != nil {
+			line, err := json.Marshal(entry)
+			if err == nil {
+				_, err = a.cfg.File.Write(append(line, '\n'))
+			}
+			if err != nil {
+				logError(logFields{"db": db.Id}, "in writing audit log for db '%s': %s", db.Id, err.Error())
+			}
+			continue
+		}
+
+		var vals interface{}
+		if entry.Values != nil {
+			bytes, _ := json.Marshal(entry.Values)
+			vals = string(bytes)
+		} else if entry.ValuesBatch != nil {
+			bytes, _ := json.Marshal(entry.ValuesBatch)
+			vals = string(bytes)
+		}
+		if _, err := db.DbConn.ExecContext(context.Background(),
+			fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", a.cfg.ToTable),
+			entry.Timestamp, entry.User, entry.ClientIP, entry.ReqIdx, entry.StatementId, entry.Sql,
+			vals, entry.RowsAffected, entry.Success, entry.Error, entry.Committed); err != nil {
+			logError(logFields{"db": db.Id}, "in writing audit log for db '%s': %s", db.Id, err.Error())
+		}
+	}
+}
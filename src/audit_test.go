@@ -0,0 +1,221 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+const auditFile = "../test/audit.jsonl"
+
+func TestAuditSetup(t *testing.T) {
+	os.Remove(auditFile)
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test1",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INT PRIMARY KEY, VAL TEXT NOT NULL)",
+				},
+				StoredStatement: []storedStatement{
+					{
+						Id:  "INS",
+						Sql: "INSERT INTO T1 VALUES (:ID, :VAL)",
+					},
+				},
+				Audit: &auditCfg{
+					ToFile:       auditFile,
+					RedactFields: []string{"VAL"},
+				},
+			}, {
+				Id:   "test2",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INT PRIMARY KEY, VAL TEXT NOT NULL)",
+				},
+				Auth: &authr{
+					Mode: "INLINE",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "pietro",
+							Password: "hey",
+						},
+					},
+				},
+				Audit: &auditCfg{
+					ToTable:        "AUDIT",
+					IncludeQueries: true,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestAuditToFile(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM T1",
+			},
+			{
+				Statement: "#INS",
+				Values: mkRaw(map[string]interface{}{
+					"ID":  1,
+					"VAL": "ONE",
+				}),
+			},
+			{
+				Statement: "INSERT INTO T1 VALUES (:ID, :VAL)",
+				ValuesBatch: []map[string]json.RawMessage{
+					mkRaw(map[string]interface{}{
+						"ID":  2,
+						"VAL": "TWO",
+					}),
+					mkRaw(map[string]interface{}{
+						"ID":  3,
+						"VAL": "THREE",
+					}),
+				},
+			},
+			{
+				Statement: "INSERT INTO T1 VALUES (1, 'ONE')",
+				NoFail:    true,
+			},
+		},
+	}
+
+	code, body, _ := call("test1", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Error(err)
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("expected 3 audit entries (no queries), found %d", len(entries))
+		return
+	}
+
+	if entries[0].StatementId != "INS" || entries[0].Sql != "" || entries[0].ReqIdx != 1 {
+		t.Error("stored statement not correctly audited")
+	}
+
+	if entries[0].Values["VAL"] != redactedValue || fmt.Sprint(entries[0].Values["ID"]) != "1" {
+		t.Error("values not correctly redacted")
+	}
+
+	if *entries[1].RowsAffected != 2 || len(entries[1].ValuesBatch) != 2 {
+		t.Error("batch not correctly audited")
+	}
+
+	if entries[2].Success || entries[2].Error == "" {
+		t.Error("failed statement not correctly audited")
+	}
+
+	for i := range entries {
+		if !entries[i].Committed {
+			t.Error("entries should be committed")
+		}
+	}
+}
+
+func TestAuditToTable(t *testing.T) {
+	req := request{
+		Credentials: &credentials{
+			User:     "pietro",
+			Password: "hey",
+		},
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (1, 'ONE')",
+			},
+			{
+				Statement: "INSERT INTO T1 VALUES (1, 'ONE')",
+			},
+		},
+	}
+
+	code, _, _ := call("test2", req, t)
+	if code != 500 {
+		t.Error("did succeed, but shouldn't have")
+		return
+	}
+
+	req.Transaction = []requestItem{
+		{
+			Query: "SELECT USER, SUCCESS, COMMITTED FROM AUDIT ORDER BY REQ_IDX",
+		},
+	}
+
+	code, body, res := call("test2", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	rs := res.Results[0].ResultSet
+	if len(rs) != 2 {
+		t.Errorf("expected 2 audit entries, found %d", len(rs))
+		return
+	}
+
+	if rs[0]["USER"] != "pietro" {
+		t.Error("user not correctly audited")
+	}
+
+	if fmt.Sprint(rs[0]["SUCCESS"]) != "1" || fmt.Sprint(rs[1]["SUCCESS"]) != "0" {
+		t.Error("outcome not correctly audited")
+	}
+
+	if fmt.Sprint(rs[0]["COMMITTED"]) != "0" {
+		t.Error("rolled back entries should not be committed")
+	}
+}
+
+func TestAuditTeardown(t *testing.T) {
+	Shutdown()
+	os.Remove(auditFile)
+}
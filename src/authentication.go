@@ -20,30 +20,35 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/basicauth"
 	mllog "github.com/proofrock/go-mylittlelogger"
 )
 
 const (
 	authModeInline = "INLINE"
 	authModeHttp   = "HTTP"
+	authModeCert   = "CERT"
 )
 
 // Checks auth. If auth is granted, returns nil, if not an error.
 // Version with explicit credentials, called by the authentication
 // middleware and by the "other" auth function, that accepts
 // a request.
-func applyAuthCreds(db *db, user, password string) error {
-	if db.Auth.ByQuery != "" {
+func applyAuthCreds(db *db, auth *authr, user, password string) error {
+	if auth.ByQuery != "" {
 		// Auth via query. Looks into the database for the credentials;
 		// needs a query that is correctly parametrized.
 		nameds := vals2nameds(map[string]interface{}{"user": user, "password": password})
-		row := db.DbConn.QueryRowContext(context.Background(), db.Auth.ByQuery, nameds...)
+		row := db.DbConn.QueryRowContext(context.Background(), auth.ByQuery, nameds...)
 		var foo interface{}
 		if err := row.Scan(&foo); err == sql.ErrNoRows {
 			return errors.New("wrong credentials")
@@ -54,7 +59,7 @@ func applyAuthCreds(db *db, user, password string) error {
 		}
 	} else {
 		passedSHA := sha256.Sum256([]byte(password))
-		expectedSHA, ok := db.Auth.HashedCreds[user]
+		expectedSHA, ok := auth.HashedCreds[user]
 		if !ok || !bytes.Equal(expectedSHA, passedSHA[:]) {
 			return errors.New("wrong credentials")
 		}
@@ -69,15 +74,100 @@ func applyAuth(db *db, req *request) error {
 	if req.Credentials == nil {
 		return errors.New("missing auth credentials")
 	}
-	return applyAuthCreds(db, req.Credentials.User, req.Credentials.Password)
+	return applyAuthCreds(db, db.Auth, req.Credentials.User, req.Credentials.Password)
+}
+
+// Checks auth. If auth is granted, returns the user, if not an error.
+// Version for client certificates (when authmode = CERT): the user is
+// the Common Name of the subject of the certificate presented by the
+// client, that was already verified against the CA during the handshake.
+func applyAuthCert(db *db, auth *authr, state *tls.ConnectionState) (string, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", errors.New("missing client certificate")
+	}
+	user := state.PeerCertificates[0].Subject.CommonName
+	if auth.ByQuery != "" {
+		nameds := vals2nameds(map[string]interface{}{"user": user})
+		row := db.DbConn.QueryRowContext(context.Background(), auth.ByQuery, nameds...)
+		var foo interface{}
+		if err := row.Scan(&foo); err == sql.ErrNoRows {
+			return user, errors.New("certificate not allowed")
+		} else if err != nil {
+			return user, fmt.Errorf("in checking certificate: %s", err.Error())
+		}
+	} else if !auth.AllowedCNs[user] {
+		return user, errors.New("certificate not allowed")
+	}
+	return user, nil
+}
+
+// Builds the middleware that enforces the authentication for the modes that
+// don't need the body of the request: HTTP (Basic Authentication) and CERT.
+// Returns nil for INLINE mode, that is checked by the handler itself.
+func authMiddleware(db *db, auth *authr) fiber.Handler {
+	unauthorized := func(c *fiber.Ctx, err error) error {
+		if auth.CustomErrorCode != nil {
+			return newWSError(-1, *auth.CustomErrorCode, err.Error())
+		}
+		return newWSError(-1, fiber.StatusUnauthorized, err.Error())
+	}
+
+	switch strings.ToUpper(auth.Mode) {
+	case authModeHttp:
+		return basicauth.New(basicauth.Config{
+			Authorizer: func(user, password string) bool {
+				if err := applyAuthCreds(db, auth, user, password); err != nil {
+					// When unauthenticated waits for 1s, and doesn't parallelize, to hinder brute force attacks
+					db.Mutex.Lock()
+					time.Sleep(time.Second)
+					db.Mutex.Unlock()
+					logError(logFields{"db": db.Id, "user": user}, "credentials not valid for user '%s'", user)
+					return false
+				}
+				return true
+			},
+			Unauthorized: func(c *fiber.Ctx) error {
+				if auth.CustomErrorCode != nil {
+					return c.Status(*auth.CustomErrorCode).SendString("Unauthorized")
+				}
+				return c.SendStatus(fiber.StatusUnauthorized)
+			},
+		})
+	case authModeCert:
+		return func(c *fiber.Ctx) error {
+			user, err := applyAuthCert(db, auth, c.Context().TLSConnectionState())
+			if err != nil {
+				// When unauthenticated waits for 1s, and doesn't parallelize, to hinder brute force attacks
+				db.Mutex.Lock()
+				time.Sleep(time.Second)
+				db.Mutex.Unlock()
+				fields := reqLogFields(c, db.Id)
+				fields["user"] = user
+				logError(fields, "client certificate not valid for user '%s'", user)
+				return unauthorized(c, err)
+			}
+			c.Locals("username", user)
+			return c.Next()
+		}
+	}
+	return nil
 }
 
 // Parses the authentication configurations. Builds a few structures,
-// should be pretty straightforward to read.
-func parseAuth(db *db) {
-	auth := *db.Auth
+// should be pretty straightforward to read. desc is used to describe
+// what is being authenticated, in the logs.
+func parseAuth(db *db, auth *authr, desc string) {
+	if strings.ToUpper(auth.Mode) == authModeCert {
+		parseCertAuth(db, auth, desc)
+		return
+	}
+
 	if strings.ToUpper(auth.Mode) != authModeInline && strings.ToUpper(auth.Mode) != authModeHttp {
-		mllog.Fatal("Auth Mode must be INLINE or HTTP")
+		mllog.Fatal("Auth Mode must be INLINE, HTTP or CERT")
+	}
+
+	if auth.ByClientCert != nil {
+		mllog.Fatal("'byClientCert' can only be specified with Auth Mode CERT")
 	}
 
 	if (auth.ByCredentials == nil) == (auth.ByQuery == "") { // == is "NOT XOR"
@@ -88,9 +178,9 @@ func parseAuth(db *db) {
 		if !strings.Contains(auth.ByQuery, ":user") || !strings.Contains(auth.ByQuery, ":password") {
 			mllog.Fatal("byQuery: sql must include :user and :password named parameters")
 		}
-		mllog.StdOut("  + Authentication enabled, with query")
+		mllog.StdOutf("  + %s enabled, with query", desc)
 	} else {
-		(*db).Auth.HashedCreds = make(map[string][]byte)
+		auth.HashedCreds = make(map[string][]byte)
 		for i := range auth.ByCredentials {
 			if auth.ByCredentials[i].User == "" {
 				mllog.Fatal("no user for credential")
@@ -111,9 +201,41 @@ func parseAuth(db *db) {
 				bytes32 := sha256.Sum256([]byte(auth.ByCredentials[i].Password))
 				b = bytes32[:]
 			}
-			(*db).Auth.HashedCreds[auth.ByCredentials[i].User] = b
+			auth.HashedCreds[auth.ByCredentials[i].User] = b
+		}
+		mllog.StdOutf("  + %s enabled, with %d credentials", desc, len(auth.HashedCreds))
+	}
+
+	if auth.CustomErrorCode != nil {
+		mllog.StdOutf("  + Custom code for Unauthorized: %d", *auth.CustomErrorCode)
+	}
+}
+
+// Parses the authentication configurations for the CERT mode, that maps the
+// subject of a client certificate (mutual TLS) to a user.
+func parseCertAuth(db *db, auth *authr, desc string) {
+	if auth.ByCredentials != nil {
+		mllog.Fatal("'byCredentials' cannot be specified with Auth Mode CERT")
+	}
+
+	if (auth.ByClientCert == nil) == (auth.ByQuery == "") { // == is "NOT XOR"
+		mllog.Fatal("one and only one of 'byQuery' and 'byClientCert' must be specified")
+	}
+
+	if auth.ByQuery != "" {
+		if !strings.Contains(auth.ByQuery, ":user") {
+			mllog.Fatal("byQuery: sql must include :user named parameter")
+		}
+		mllog.StdOutf("  + %s by client certificate enabled, with query", desc)
+	} else {
+		auth.AllowedCNs = make(map[string]bool)
+		for i := range auth.ByClientCert {
+			if auth.ByClientCert[i] == "" {
+				mllog.Fatal("empty subject for client certificate")
+			}
+			auth.AllowedCNs[auth.ByClientCert[i]] = true
 		}
-		mllog.StdOutf("  + Authentication enabled, with %d credentials", len((*db).Auth.HashedCreds))
+		mllog.StdOutf("  + %s by client certificate enabled, with %d subjects", desc, len(auth.AllowedCNs))
 	}
 
 	if auth.CustomErrorCode != nil {
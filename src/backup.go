@@ -0,0 +1,398 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"modernc.org/sqlite"
+)
+
+const (
+	bkpModeVacuum = "vacuum"
+	bkpModeOnline = "online"
+
+	defaultBkpPagesPerStep = 100
+
+	bkpCompressionZstd = "zstd"
+	bkpCompressionGzip = "gzip"
+
+	bkpExtZstd      = ".zst"
+	bkpExtGzip      = ".gz"
+	bkpExtEncrypted = ".enc"
+)
+
+var bkpCompressionExts = map[string]string{
+	bkpCompressionZstd: bkpExtZstd,
+	bkpCompressionGzip: bkpExtGzip,
+}
+
+// The suffix that's appended to the backup file name, depending on the post-processing
+// that's configured. Compression comes first, so it's e.g. ".zst.enc".
+func bkpSuffix(task *scheduledTask) string {
+	ret := bkpCompressionExts[task.BackupCompression]
+	if task.BackupEncryptionKey != "" {
+		ret += bkpExtEncrypted
+	}
+	return ret
+}
+
+// Takes a backup of the db using SQLite's online backup API, copying a few pages
+// at a time. Must be called while holding the db mutex, that is released between
+// the steps to let the requests be served. As the backup uses the same connection
+// that serves them, their writes are also applied to the backup, without the need
+// to restart it.
+func onlineBackup(db *db, fname string, pagesPerStep int) error {
+	var bkp *sqlite.Backup
+	if err := db.DbConn.Raw(func(driverConn interface{}) error {
+		conn, ok := driverConn.(interface {
+			NewBackup(dstUri string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("the driver doesn't support online backups")
+		}
+		var err error
+		bkp, err = conn.NewBackup(fname)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for more := true; more; {
+		if err := db.DbConn.Raw(func(interface{}) error {
+			var err error
+			more, err = bkp.Step(int32(pagesPerStep))
+			return err
+		}); err != nil {
+			bkp.Finish()
+			os.Remove(fname)
+			return err
+		}
+		if more {
+			db.Mutex.Unlock()
+			runtime.Gosched()
+			db.Mutex.Lock()
+		}
+	}
+
+	return bkp.Finish()
+}
+
+// Writes a backup of the db to a (non-existing) file, with VACUUM INTO. Must be
+// called while holding the db mutex.
+func vacuumInto(db *db, fname string) error {
+	_, err := db.DbConn.ExecContext(context.Background(), "VACUUM INTO ?", fname)
+	return err
+}
+
+// Compresses and/or encrypts a backup file, as configured in the task, in a single
+// pass and as a stream. Writes the result in a file with the proper suffix and
+// removes the original one. Returns the name of the final file.
+func postProcessBackup(task *scheduledTask, fname string) (string, error) {
+	dst := fname + bkpSuffix(task)
+	if dst == fname {
+		return fname, nil
+	}
+	if err := processFile(fname, dst, task.BackupCompression, task.BackupEncryptionKey); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	os.Remove(fname)
+	return dst, nil
+}
+
+// Copies src to dst, compressing it with the given compression (if any) and
+// then encrypting it with the key (if any).
+func processFile(src, dst, compression, key string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// The writers are closed in reverse order, to flush them down to the file
+	var w io.Writer = out
+	var closers []io.Closer
+	if key != "" {
+		ew, err := newEncryptingWriter(w, key)
+		if err != nil {
+			return err
+		}
+		w = ew
+		closers = append([]io.Closer{ew}, closers...)
+	}
+	switch compression {
+	case bkpCompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		w = zw
+		closers = append([]io.Closer{zw}, closers...)
+	case bkpCompressionGzip:
+		gw := gzip.NewWriter(w)
+		w = gw
+		closers = append([]io.Closer{gw}, closers...)
+	case "":
+	default:
+		return fmt.Errorf("unknown compression '%s'", compression)
+	}
+
+	if _, err := io.Copy(w, in); err != nil {
+		for _, c := range closers {
+			c.Close()
+		}
+		return err
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// Restores a backup (as produced by a scheduled task) to the given database path,
+// decrypting and decompressing it according to its extensions. If it's a directory,
+// it's restored from the WAL shipping files, see restoreWAL(). The database must
+// not be in use. The restored file is checked before replacing the existing one,
+// if any; the WAL and SHM files of the latter are deleted, as they'd be stale.
+func restoreBackup(cfg restoreCfg) error {
+	if dirExists(cfg.From) {
+		return restoreWAL(cfg)
+	}
+	if !fileExists(cfg.From) {
+		return errors.New("backup file does not exist")
+	}
+	if cfg.ToTime != nil {
+		return errors.New("restoring to a point in time needs a WAL shipping directory")
+	}
+
+	name := cfg.From
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if strings.HasSuffix(name, bkpExtEncrypted) {
+		if cfg.Key == "" {
+			return errors.New("backup is encrypted, but no key was specified")
+		}
+		if r, err = newDecryptingReader(in, cfg.Key); err != nil {
+			return fmt.Errorf("in decrypting backup: %s", err.Error())
+		}
+		name = strings.TrimSuffix(name, bkpExtEncrypted)
+	}
+
+	tmp := cfg.Into + ".restoring"
+	os.Remove(tmp)
+	if err := decompressTo(name, r, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return finalizeRestore(tmp, cfg.Into)
+}
+
+// Checks the restored db and moves it into place
+func finalizeRestore(tmp, into string) error {
+	if err := checkDbFile(tmp, "quick_check"); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("restored database is not valid: %s", err.Error())
+	}
+
+	os.Remove(into + "-wal")
+	os.Remove(into + "-shm")
+	return os.Rename(tmp, into)
+}
+
+// Writes the data to dst, decompressing them if the (original) name has the
+// extension of a compression.
+func decompressTo(name string, in io.Reader, dst string) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	r := in
+	switch filepath.Ext(name) {
+	case bkpExtZstd:
+		zr, err := zstd.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bkpExtGzip:
+		gr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		return fmt.Errorf("in restoring backup: %s", err.Error())
+	}
+	return out.Close()
+}
+
+func checkDbFile(path, check string) error {
+	db, err := sql.Open("sqlite", path+"?_pragma=query_only(true)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var res string
+	if err := db.QueryRowContext(context.Background(), "PRAGMA "+check).Scan(&res); err != nil {
+		return err
+	}
+	if res != "ok" {
+		return errors.New(res)
+	}
+	return nil
+}
+
+// A temporary file that is deleted when closed, i.e. when it's been sent
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// Admin endpoint that takes a backup of the db and streams it back. If a task
+// takes backups, the first one of them is used, only for its backup: the file
+// is written, post-processed, rotated and uploaded as configured for the task,
+// and the run is recorded in the history. Otherwise, see snapshotHandler().
+func backupHandler(db *db) fiber.Handler {
+	snapshot := snapshotHandler(db)
+	return func(c *fiber.Ctx) error {
+		idx := 0
+		for idx < len(db.Tasks) && db.Tasks[idx].Backup == nil {
+			idx++
+		}
+		if idx == len(db.Tasks) {
+			return snapshot(c)
+		}
+
+		run := db.Tasks[idx].Backup(taskTriggerManual)
+		if !run.Success {
+			return newWSError(-1, fiber.StatusInternalServerError, "In taking backup with task %d: %s", idx, run.Error)
+		}
+
+		f, err := os.Open(run.BackupFile)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		if bkpSuffix(&db.ScheduledTasks[idx]) == "" {
+			c.Set(fiber.HeaderContentType, "application/vnd.sqlite3")
+		} else {
+			c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+		}
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(run.BackupFile)))
+		// the stream is closed by fasthttp, after sending it
+		return c.SendStream(f, int(stat.Size()))
+	}
+}
+
+// Admin endpoint that takes a plain backup of the db (with VACUUM INTO) and streams
+// it back, e.g. to upload it again as a snapshot. The file is written to the temp
+// dir, and deleted after being sent; the run is recorded in the history as not
+// belonging to a task.
+func snapshotHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tmp, err := os.CreateTemp("", "ws4sqlite-bkp-*.db")
+		if err != nil {
+			return err
+		}
+		fname := tmp.Name()
+		// VACUUM INTO wants a non-existing file
+		tmp.Close()
+		os.Remove(fname)
+
+		start := time.Now()
+		db.Mutex.Lock()
+		err = vacuumInto(db, fname)
+		run := taskRun{
+			Timestamp:  start.Format(time.RFC3339Nano),
+			TaskIdx:    -1,
+			Trigger:    taskTriggerManual,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Steps:      []string{"backup"},
+			Success:    err == nil,
+		}
+		if err != nil {
+			run.Error = err.Error()
+		}
+		recordTaskRun(db, run)
+		db.Mutex.Unlock()
+		if err != nil {
+			os.Remove(fname)
+			return newWSError(-1, fiber.StatusInternalServerError, "In taking backup: %s", err.Error())
+		}
+
+		f, err := os.Open(fname)
+		if err != nil {
+			os.Remove(fname)
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			tempFile{f}.Close()
+			return err
+		}
+
+		c.Set(fiber.HeaderContentType, "application/vnd.sqlite3")
+		c.Set(fiber.HeaderContentDisposition,
+			fmt.Sprintf("attachment; filename=\"%s_%s.db\"", db.Id, time.Now().Format(bkpTimeFormat)))
+		// the stream is closed (and the file deleted) by fasthttp, after sending it
+		return c.SendStream(tempFile{f}, int(stat.Size()))
+	}
+}
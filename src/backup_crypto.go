@@ -0,0 +1,212 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/proofrock/crypgo"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encryption of the backups, as a stream, so that they're never loaded in memory.
+// It uses the same primitives of crypgo (a key derived from the password with
+// scrypt, and XChaCha20-Poly1305) on chunks of the data. The file is:
+//
+// - a header: magic string, format version, scrypt salt and nonce prefix;
+//
+// - the chunks, each one a flag (1 for the last one), the length of the
+// encrypted data and the encrypted data. The nonce is the prefix plus the
+// index of the chunk, and the header and the flag are authenticated with the
+// data, so that chunks can't be reordered, removed or truncated.
+//
+// The backups encrypted with crypgo by previous versions can still be restored.
+
+const (
+	bkpEncMagic      = "WS4SQLITE-ENC"
+	bkpEncFormat     = 1
+	bkpEncSaltSize   = 16
+	bkpEncPrefixSize = chacha20poly1305.NonceSizeX - 8
+	bkpEncChunkSize  = 1 << 20
+
+	bkpEncHeaderSize = len(bkpEncMagic) + 1 + bkpEncSaltSize + bkpEncPrefixSize
+)
+
+func bkpEncAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+func bkpEncNonce(prefix []byte, idx uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), idx)
+}
+
+type encryptingWriter struct {
+	out    io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	idx    uint64
+}
+
+// Returns a writer that encrypts the data written to it, writing them to out.
+// Must be closed to write the last chunk; out is not closed.
+func newEncryptingWriter(out io.Writer, password string) (io.WriteCloser, error) {
+	header := make([]byte, bkpEncHeaderSize)
+	copy(header, bkpEncMagic)
+	header[len(bkpEncMagic)] = bkpEncFormat
+	if _, err := rand.Read(header[len(bkpEncMagic)+1:]); err != nil {
+		return nil, err
+	}
+	aead, err := bkpEncAEAD(password, header[len(bkpEncMagic)+1:len(bkpEncMagic)+1+bkpEncSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{out: out, aead: aead, header: header, buf: make([]byte, 0, bkpEncChunkSize)}, nil
+}
+
+func (w *encryptingWriter) flush(last bool) error {
+	flag := byte(0)
+	if last {
+		flag = 1
+	}
+	sealed := w.aead.Seal(nil, bkpEncNonce(w.header[len(w.header)-bkpEncPrefixSize:], w.idx), w.buf, append(w.header, flag))
+	frame := binary.BigEndian.AppendUint32([]byte{flag}, uint32(len(sealed)))
+	if _, err := w.out.Write(append(frame, sealed...)); err != nil {
+		return err
+	}
+	w.idx++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == bkpEncChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):bkpEncChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) Close() error {
+	return w.flush(true)
+}
+
+type decryptingReader struct {
+	in     io.Reader
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	idx    uint64
+	done   bool
+}
+
+var errBkpEncTruncated = errors.New("the encrypted backup is truncated")
+
+// Returns a reader of the data decrypted from in. Recognizes the backups
+// encrypted with crypgo, that are decrypted in memory.
+func newDecryptingReader(in io.Reader, password string) (io.Reader, error) {
+	br := bufio.NewReader(in)
+	if magic, _ := br.Peek(len(bkpEncMagic)); string(magic) != bkpEncMagic {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := crypgo.DecryptBytes(password, string(data))
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(plain), nil
+	}
+
+	header := make([]byte, bkpEncHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errBkpEncTruncated
+	}
+	if header[len(bkpEncMagic)] != bkpEncFormat {
+		return nil, errors.New("unknown format of the encrypted backup")
+	}
+	aead, err := bkpEncAEAD(password, header[len(bkpEncMagic)+1:len(bkpEncMagic)+1+bkpEncSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{in: br, aead: aead, header: header}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Reads and decrypts the next chunk
+func (r *decryptingReader) next() error {
+	frame := make([]byte, 5)
+	if _, err := io.ReadFull(r.in, frame); err != nil {
+		return errBkpEncTruncated
+	}
+	flag, size := frame[0], binary.BigEndian.Uint32(frame[1:])
+	if flag > 1 || size > bkpEncChunkSize+uint32(r.aead.Overhead()) {
+		return errors.New("the encrypted backup is corrupted")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.in, sealed); err != nil {
+		return errBkpEncTruncated
+	}
+	plain, err := r.aead.Open(sealed[:0], bkpEncNonce(r.header[len(r.header)-bkpEncPrefixSize:], r.idx), sealed, append(r.header, flag))
+	if err != nil {
+		return errors.New("cannot decrypt the backup: wrong key, or corrupted file")
+	}
+	r.idx++
+	r.buf = plain
+	if flag == 1 {
+		r.done = true
+		if n, _ := r.in.Read(make([]byte, 1)); n > 0 {
+			return errors.New("the encrypted backup has trailing data")
+		}
+	}
+	return nil
+}
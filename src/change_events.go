@@ -0,0 +1,444 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Change data capture, served as Server-Sent Events on GET /<db id>/changes.
+//
+// The driver doesn't expose SQLite's update and commit hooks, so the changes
+// are captured by TEMP triggers on the tables, that only live in the connection
+// used by ws4sqlite. They write in a TEMP table, that is part of the transaction:
+// its rows are read just before the commit, and the events are published only
+// if the commit succeeds. Rolled back statements and transactions don't emit
+// anything.
+//
+// The triggers are (re)created at startup and after the requests, tasks, changes
+// from the primary and snapshots that may have changed the schema; so a table
+// created in a request is tracked starting from the next. Tables WITHOUT ROWID,
+// the internal ones and those of the audit log and of the task history are not
+// tracked.
+
+const (
+	defaultChangeEventsBufferSize = 1000
+	changeEventsSubscriberQueue   = 256
+	changeEventsPingInterval      = 15 * time.Second
+
+	changeEventsTable         = "_ws4sqlite_change_events"
+	changeEventsTriggerPrefix = "_ws4sqlite_ce_"
+)
+
+var changeEventsOps = []string{"INSERT", "UPDATE", "DELETE"}
+
+type changeEvent struct {
+	Id    int64  `json:"-"`
+	Table string `json:"table"`
+	Op    string `json:"op"`
+	RowId int64  `json:"rowid"`
+}
+
+// Keeps the last events, to resume the subscriptions, and dispatches the new
+// ones to the subscribers.
+type changeBroker struct {
+	mutex         sync.Mutex
+	lastId        int64
+	buffer        *ringBuffer[changeEvent]
+	subscribers   map[chan changeEvent]bool
+	tables        map[string]bool // nil means all
+	schemaVersion int64
+	stop          chan struct{}
+}
+
+// Checks the configuration, creates the TEMP table and the broker.
+func parseChangeEvents(db *db) {
+	cfg := db.ChangeEvents
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', change events are meaningless for a read only db", db.Id)
+	}
+	if cfg.BufferSize < 0 {
+		mllog.Fatalf("for db '%s', change events buffer size cannot be negative", db.Id)
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = defaultChangeEventsBufferSize
+	}
+
+	broker := &changeBroker{
+		// So that the IDs keep increasing across restarts, and a client
+		// doesn't resume from a wrong point
+		lastId:        time.Now().UnixMicro(),
+		buffer:        newRingBuffer[changeEvent](cfg.BufferSize),
+		subscribers:   make(map[chan changeEvent]bool),
+		schemaVersion: -1,
+		stop:          make(chan struct{}),
+	}
+	if len(cfg.Tables) > 0 {
+		broker.tables = make(map[string]bool)
+		for i := range cfg.Tables {
+			if !identifierRegexp.MatchString(cfg.Tables[i]) {
+				mllog.Fatalf("for db '%s', change events table name is not valid: %s", db.Id, cfg.Tables[i])
+			}
+			broker.tables[cfg.Tables[i]] = true
+		}
+	}
+
+	if _, err := db.DbConn.ExecContext(context.Background(), "CREATE TEMP TABLE IF NOT EXISTS "+changeEventsTable+
+		" (TBL TEXT, OP TEXT, RID INTEGER)"); err != nil {
+		mllog.Fatalf("for db '%s', in creating change events table: %s", db.Id, err.Error())
+	}
+	db.ChangeBroker = broker
+	if err := syncChangeTriggers(context.Background(), db); err != nil {
+		mllog.Fatalf("for db '%s', in creating change events triggers: %s", db.Id, err.Error())
+	}
+
+	mllog.StdOutf("  + Serving change events at /%s/changes", db.Id)
+}
+
+// Tells if a SQL may change the schema. It may give false positives, that only
+// cost a check of the schema version.
+var schemaChangeRegexp = regexp.MustCompile(`(?i)\b(CREATE|ALTER|DROP)\b`)
+
+func mayChangeSchema(sqll string) bool {
+	return schemaChangeRegexp.MatchString(sqll)
+}
+
+// Recreates the triggers after a change of the schema, logging the errors. Must be
+// called while holding the db mutex, outside of a transaction.
+func schemaChanged(db *db) {
+	if err := syncChangeTriggers(context.Background(), db); err != nil {
+		logError(logFields{"db": db.Id}, "in recreating change events triggers for db '%s': %s", db.Id, err.Error())
+	}
+}
+
+// Tells if the table is written by ws4sqlite itself, besides the internal ones:
+// they're not tracked, as they're written outside of the requests.
+func isOwnTable(db *db, table string) bool {
+	return (db.Audit != nil && db.Audit.ToTable != "" && strings.EqualFold(table, db.Audit.ToTable)) ||
+		(db.TaskHistoryTable != "" && strings.EqualFold(table, db.TaskHistoryTable))
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// If the schema changed, recreates the triggers on the tables. Must be called
+// while holding the db mutex, outside of a transaction. See schemaChanged().
+func syncChangeTriggers(ctx context.Context, db *db) error {
+	broker := db.ChangeBroker
+	if broker == nil {
+		return nil
+	}
+
+	var version int64
+	if err := db.DbConn.QueryRowContext(ctx, "PRAGMA main.schema_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == broker.schemaVersion {
+		return nil
+	}
+
+	tx, err := db.DbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var triggers, tables []string
+	if err := queryStrings(ctx, tx, &triggers, "SELECT name FROM temp.sqlite_master WHERE type = 'trigger' AND name LIKE ? ESCAPE '\\'",
+		strings.ReplaceAll(changeEventsTriggerPrefix, "_", "\\_")+"%"); err != nil {
+		return err
+	}
+	if err := queryStrings(ctx, tx, &tables, "SELECT name FROM pragma_table_list WHERE schema = 'main' AND type = 'table' AND wr = 0 "+
+		"AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name NOT LIKE '\\_ws4sqlite\\_%' ESCAPE '\\'"); err != nil {
+		return err
+	}
+
+	for i := range triggers {
+		if _, err := tx.ExecContext(ctx, "DROP TRIGGER temp."+quoteIdentifier(triggers[i])); err != nil {
+			return err
+		}
+	}
+	for i := range tables {
+		if broker.tables != nil && !broker.tables[tables[i]] {
+			continue
+		}
+		if isOwnTable(db, tables[i]) {
+			continue
+		}
+		for _, op := range changeEventsOps {
+			row := "NEW"
+			if op == "DELETE" {
+				row = "OLD"
+			}
+			sqll := fmt.Sprintf("CREATE TEMP TRIGGER %s AFTER %s ON main.%s BEGIN INSERT INTO %s VALUES ('%s', '%s', %s.rowid); END",
+				quoteIdentifier(changeEventsTriggerPrefix+tables[i]+"_"+op), op, quoteIdentifier(tables[i]),
+				changeEventsTable, strings.ReplaceAll(tables[i], "'", "''"), op, row)
+			if _, err := tx.ExecContext(ctx, sqll); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	broker.schemaVersion = version
+	return nil
+}
+
+func queryStrings(ctx context.Context, tx *sql.Tx, ret *[]string, query string, args ...interface{}) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		*ret = append(*ret, s)
+	}
+	return rows.Err()
+}
+
+// Reads and clears the changes captured in the transaction, to publish them
+// after the commit.
+func collectChangeEvents(ctx context.Context, tx *sql.Tx, db *db) ([]changeEvent, error) {
+	if db.ChangeBroker == nil {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT TBL, OP, RID FROM temp."+changeEventsTable+" ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []changeEvent
+	for rows.Next() {
+		var ev changeEvent
+		if err := rows.Scan(&ev.Table, &ev.Op, &ev.RowId); err != nil {
+			return nil, err
+		}
+		ret = append(ret, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) > 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM temp."+changeEventsTable); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Publishes the changes done outside of a request (e.g. by scheduled tasks or
+// by replication), that are already committed. Must be called while holding the
+// db mutex.
+func flushChangeEvents(db *db) {
+	if db.ChangeBroker == nil {
+		return
+	}
+	tx, err := db.DbConn.BeginTx(context.Background(), nil)
+	if err != nil {
+		logError(logFields{"db": db.Id}, "in publishing change events for db '%s': %s", db.Id, err.Error())
+		return
+	}
+	events, err := collectChangeEvents(context.Background(), tx, db)
+	if err != nil {
+		tx.Rollback()
+		logError(logFields{"db": db.Id}, "in publishing change events for db '%s': %s", db.Id, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError(logFields{"db": db.Id}, "in publishing change events for db '%s': %s", db.Id, err.Error())
+		return
+	}
+	publishChanges(db, events)
+}
+
+// Publishes the committed changes to the subscribers and to the webhooks
+func publishChanges(db *db, events []changeEvent) {
+	db.ChangeBroker.publish(events)
+	fireChangeWebhooks(db, events)
+}
+
+// Assigns the IDs to committed events, and sends them to the subscribers. A
+// subscriber that doesn't keep up is disconnected; it can resume with the
+// Last-Event-ID.
+func (b *changeBroker) publish(events []changeEvent) {
+	if b == nil || len(events) == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := range events {
+		b.lastId++
+		events[i].Id = b.lastId
+		b.buffer.add(events[i])
+		for ch := range b.subscribers {
+			select {
+			case ch <- events[i]:
+			default:
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Registers a subscriber, returning the events after lastEventId that are
+// still in the buffer. gap is true if some of them were lost.
+func (b *changeBroker) subscribe(lastEventId int64, resume bool) (ch chan changeEvent, backlog []changeEvent, gap bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if resume {
+		buffered := b.buffer.list()
+		oldest := b.lastId + 1
+		if len(buffered) > 0 {
+			oldest = buffered[0].Id
+		}
+		gap = lastEventId < oldest-1 || lastEventId > b.lastId
+		for i := range buffered {
+			if buffered[i].Id > lastEventId {
+				backlog = append(backlog, buffered[i])
+			}
+		}
+	}
+
+	ch = make(chan changeEvent, changeEventsSubscriberQueue)
+	b.subscribers[ch] = true
+	return ch, backlog, gap
+}
+
+func (b *changeBroker) unsubscribe(ch chan changeEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func writeChangeEvent(w *bufio.Writer, ev changeEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.Id, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The SSE endpoint. Sends the events committed after the subscription or, if
+// the Last-Event-ID header (or lastEventId parameter) is given, after that
+// event. If some of these are not available anymore, sends a "reset" event
+// first, so that the client knows that it must reload its data.
+func changeEventsHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lastEventIdStr := c.Get("Last-Event-ID", c.Query("lastEventId"))
+		var lastEventId int64
+		if lastEventIdStr != "" {
+			var err error
+			if lastEventId, err = strconv.ParseInt(lastEventIdStr, 10, 64); err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, "Last-Event-ID is not valid: %s", lastEventIdStr)
+			}
+		}
+
+		broker := db.ChangeBroker
+		ch, backlog, gap := broker.subscribe(lastEventId, lastEventIdStr != "")
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer broker.unsubscribe(ch)
+
+			// A comment, so that the headers are sent right away
+			if _, err := w.WriteString(": subscribed\n\n"); err != nil {
+				return
+			}
+			if gap {
+				if _, err := w.WriteString("event: reset\ndata: {}\n\n"); err != nil {
+					return
+				}
+			}
+			for i := range backlog {
+				if err := writeChangeEvent(w, backlog[i]); err != nil {
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			ping := time.NewTicker(changeEventsPingInterval)
+			defer ping.Stop()
+			for {
+				select {
+				case <-broker.stop:
+					return
+				case ev, ok := <-ch:
+					if !ok {
+						// Too slow, disconnected by the broker
+						return
+					}
+					if err := writeChangeEvent(w, ev); err != nil {
+						return
+					}
+				case <-ping.C:
+					if _, err := w.WriteString(": ping\n\n"); err != nil {
+						return
+					}
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		})
+
+		return nil
+	}
+}
+
+// Registers the SSE endpoint, with the same authentication of the main one
+func registerChangeEvents(db *db) {
+	if db.ChangeBroker == nil {
+		return
+	}
+
+	handlers := append(endpointHandlers(db, "GET"), changeEventsHandler(db))
+	app.Get(fmt.Sprintf("/%s/changes", db.Id), handlers...)
+}
@@ -0,0 +1,245 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseMessage struct {
+	Id    string
+	Event string
+	Data  string
+}
+
+var ceCreds = &credentials{User: "myUser", Password: "myPassword"}
+
+// Subscribes to the change events, and returns the messages as they arrive
+func subscribeChanges(t *testing.T, lastEventId string) (func(), <-chan sseMessage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost:12321/test/changes", nil)
+	req.SetBasicAuth(ceCreds.User, ceCreds.Password)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wrong response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	ch := make(chan sseMessage, 100)
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		var msg sseMessage
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if msg.Data != "" {
+					ch <- msg
+				}
+				msg = sseMessage{}
+			case strings.HasPrefix(line, "id: "):
+				msg.Id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				msg.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				msg.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return cancel, ch
+}
+
+func nextChange(t *testing.T, ch <-chan sseMessage) (sseMessage, changeEvent) {
+	select {
+	case msg := <-ch:
+		var ev changeEvent
+		if msg.Event == "" {
+			if err := json.Unmarshal([]byte(msg.Data), &ev); err != nil {
+				t.Error(err)
+			}
+		}
+		return msg, ev
+	case <-time.After(2 * time.Second):
+		t.Error("no event received")
+		return sseMessage{}, changeEvent{}
+	}
+}
+
+func noMoreChanges(t *testing.T, ch <-chan sseMessage) {
+	select {
+	case msg := <-ch:
+		t.Errorf("unexpected event: %v", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func execChanges(t *testing.T, expectedCode int, items ...requestItem) {
+	code, body, _ := call("test", request{Credentials: ceCreds, Transaction: items}, t)
+	if code != expectedCode {
+		t.Errorf("expected %d, got %d: %s", expectedCode, code, body)
+	}
+}
+
+func TestChangeEventsSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+					"CREATE TABLE T2 (ID TEXT PRIMARY KEY, VAL TEXT) WITHOUT ROWID",
+				},
+				Auth: &authr{
+					Mode: "INLINE",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     ceCreds.User,
+							Password: ceCreds.Password,
+						},
+					},
+				},
+				// written outside of the requests, not tracked
+				Audit: &auditCfg{
+					ToTable: "AUDIT_LOG",
+				},
+				ChangeEvents: &changeEventsCfg{
+					BufferSize: 3,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestChangeEventsAuth(t *testing.T) {
+	res, err := http.Get("http://localhost:12321/test/changes")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401, got %d", res.StatusCode)
+	}
+}
+
+var ceFirstId string
+
+func TestChangeEventsStream(t *testing.T) {
+	cancel, ch := subscribeChanges(t, "")
+	defer cancel()
+
+	execChanges(t, 200,
+		requestItem{Statement: "INSERT INTO T1 VALUES (1, 'ONE')"},
+		requestItem{Statement: "INSERT INTO T1 VALUES (1, 'DUPE')", NoFail: true},
+		requestItem{Statement: "INSERT INTO T2 VALUES ('A', 'NOT TRACKED')"},
+		requestItem{Query: "UPDATE T1 SET VAL = 'UNO' WHERE ID = 1 RETURNING *"},
+	)
+
+	msg, ev := nextChange(t, ch)
+	if ev.Table != "T1" || ev.Op != "INSERT" || ev.RowId != 1 || msg.Id == "" {
+		t.Errorf("wrong event: %v", msg)
+	}
+	ceFirstId = msg.Id
+	msg, ev = nextChange(t, ch)
+	if ev.Table != "T1" || ev.Op != "UPDATE" || ev.RowId != 1 || msg.Id <= ceFirstId {
+		t.Errorf("wrong event: %v", msg)
+	}
+
+	// a failed transaction doesn't emit events
+	execChanges(t, 500,
+		requestItem{Statement: "DELETE FROM T1"},
+		requestItem{Statement: "INSERT INTO NOPE VALUES (1)"},
+	)
+	noMoreChanges(t, ch)
+
+	// new tables are tracked from the following request
+	execChanges(t, 200, requestItem{Statement: "CREATE TABLE T3 (VAL TEXT)"})
+	execChanges(t, 200, requestItem{Statement: "INSERT INTO T3 VALUES ('X')"})
+	msg, ev = nextChange(t, ch)
+	if ev.Table != "T3" || ev.Op != "INSERT" || ev.RowId != 1 {
+		t.Errorf("wrong event: %v", msg)
+	}
+	noMoreChanges(t, ch)
+}
+
+func TestChangeEventsResume(t *testing.T) {
+	cancel, ch := subscribeChanges(t, ceFirstId)
+	if msg, ev := nextChange(t, ch); ev.Op != "UPDATE" {
+		t.Errorf("wrong event: %v", msg)
+	}
+	if msg, ev := nextChange(t, ch); ev.Table != "T3" {
+		t.Errorf("wrong event: %v", msg)
+	}
+	noMoreChanges(t, ch)
+	cancel()
+
+	// the buffer keeps the last 3 events: the first one is lost
+	execChanges(t, 200, requestItem{Statement: "DELETE FROM T1 WHERE ID = 1"})
+
+	cancel, ch = subscribeChanges(t, ceFirstId)
+	defer cancel()
+	for _, op := range []string{"UPDATE", "INSERT", "DELETE"} {
+		if msg, ev := nextChange(t, ch); ev.Op != op {
+			t.Errorf("wrong event: %v", msg)
+		}
+	}
+	noMoreChanges(t, ch)
+
+	cancel2, ch := subscribeChanges(t, "1")
+	defer cancel2()
+	if msg, _ := nextChange(t, ch); msg.Event != "reset" {
+		t.Errorf("expected a reset, got: %v", msg)
+	}
+	for i := 0; i < 3; i++ {
+		nextChange(t, ch)
+	}
+	noMoreChanges(t, ch)
+
+	res, _ := http.DefaultClient.Do(func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:12321/test/changes", nil)
+		req.SetBasicAuth(ceCreds.User, ceCreds.Password)
+		req.Header.Set("Last-Event-ID", "nope")
+		return req
+	}())
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400, got %d", res.StatusCode)
+	}
+	res.Body.Close()
+}
+
+func TestChangeEventsTeardown(t *testing.T) {
+	Shutdown()
+}
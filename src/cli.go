@@ -21,11 +21,15 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	mllog "github.com/proofrock/go-mylittlelogger"
 	"gopkg.in/yaml.v2"
 )
 
+// Alternative to --restore-key, so that it doesn't show in the process list
+const restoreKeyEnv = "WS4SQLITE_RESTORE_KEY"
+
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -57,7 +61,16 @@ func parseCLI() config {
 
 	bindHost := fs.String("bind-host", "0.0.0.0", "The host to bind")
 	port := fs.Int("port", 12321, "Port for the web service")
+	tlsCert := fs.String("tls-cert", "", "Certificate file (PEM) to serve HTTPS")
+	tlsKey := fs.String("tls-key", "", "Key file (PEM) to serve HTTPS")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA file (PEM) to verify client certificates (mutual TLS)")
 	version := fs.Bool("version", false, "Display the version number")
+	logFormat := fs.String("log-format", logFormatText, "Format of the logs: 'text' or 'json'")
+	restoreFrom := fs.String("restore", "", "Restores a backup file into --restore-into, then exits")
+	restoreInto := fs.String("restore-into", "", "The database file to restore a backup into")
+	restoreKey := fs.String("restore-key", "", "The key to decrypt the backup (or use env var "+restoreKeyEnv+")")
+	restoreToTime := fs.String("restore-to-time", "", "When restoring from a WAL shipping dir, the time to restore to (RFC3339)")
+	migrateOnly := fs.Bool("migrate-only", false, "Applies the pending migrations of the databases, then exits")
 
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		mllog.Fatalf("parsing commandline arguments: %s", err.Error())
@@ -70,6 +83,34 @@ func parseCLI() config {
 
 	var ret config
 
+	// restoring is a separate command, the rest of the commandline is ignored
+	if *restoreFrom != "" {
+		if *restoreInto == "" {
+			mllog.Fatal("--restore requires --restore-into")
+		}
+		rc := restoreCfg{
+			From: expandHomeDir(*restoreFrom, "backup file"),
+			Into: expandHomeDir(*restoreInto, "database file to restore into"),
+			Key:  *restoreKey,
+		}
+		if rc.Key == "" {
+			rc.Key = os.Getenv(restoreKeyEnv)
+		}
+		if *restoreToTime != "" {
+			toTime, err := time.Parse(time.RFC3339, *restoreToTime)
+			if err != nil {
+				mllog.Fatalf("invalid time to restore to: %s", err.Error())
+			}
+			rc.ToTime = &toTime
+		}
+		ret.Restore = &rc
+		return ret
+	}
+
+	if *restoreInto != "" || *restoreKey != "" || *restoreToTime != "" {
+		mllog.Fatal("--restore-into, --restore-key and --restore-to-time require --restore")
+	}
+
 	// Fail fast
 	if len(dbFiles)+len(memDb) == 0 && *serveDir == "" {
 		mllog.Fatal("no database and no dir to serve specified")
@@ -157,9 +198,39 @@ func parseCLI() config {
 		ret.ServeDir = &sd
 	}
 
+	if (*tlsCert == "") != (*tlsKey == "") {
+		mllog.Fatal("both --tls-cert and --tls-key must be specified for HTTPS")
+	}
+
+	if *tlsClientCA != "" && *tlsCert == "" {
+		mllog.Fatal("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if *tlsCert != "" {
+		var tc tlsCfg
+		tc.CertFile = expandHomeDir(*tlsCert, "tls certificate")
+		tc.KeyFile = expandHomeDir(*tlsKey, "tls key")
+		if !fileExists(tc.CertFile) || !fileExists(tc.KeyFile) {
+			mllog.Fatal("tls certificate or key file does not exist")
+		}
+		if *tlsClientCA != "" {
+			tc.ClientCAFile = expandHomeDir(*tlsClientCA, "tls client CA")
+			if !fileExists(tc.ClientCAFile) {
+				mllog.Fatal("tls client CA file does not exist")
+			}
+		}
+		ret.TLS = &tc
+	}
+
+	if *logFormat != logFormatText && *logFormat != logFormatJSON {
+		mllog.Fatalf("log format must be '%s' or '%s'", logFormatText, logFormatJSON)
+	}
+
 	// embed the cli parameters in the config
 	ret.Bindhost = *bindHost
 	ret.Port = *port
+	ret.LogFormat = *logFormat
+	ret.MigrateOnly = *migrateOnly
 
 	return ret
 }
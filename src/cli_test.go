@@ -64,6 +64,41 @@ func TestCliServeInvalidDir2(t *testing.T) {
 	assert(t, err != "", "succeeded, but shouldn't have ", err)
 }
 
+func TestCliTLSCertWithoutKey(t *testing.T) {
+	_, err := cliTest("--mem-db", "mem1", "--tls-cert", "../test/mem1.yaml")
+	assert(t, err != "", "succeeded, but shouldn't have ", err)
+}
+
+func TestCliTLSClientCAWithoutCert(t *testing.T) {
+	_, err := cliTest("--mem-db", "mem1", "--tls-client-ca", "../test/mem1.yaml")
+	assert(t, err != "", "succeeded, but shouldn't have ", err)
+}
+
+func TestCliTLS(t *testing.T) {
+	cfg, err := cliTest("--mem-db", "mem1", "--tls-cert", "../test/mem1.yaml", "--tls-key", "../test/test1.yaml")
+	assert(t, err == "", "did not succeed ", err)
+	assert(t, cfg.TLS != nil, "tls should be configured")
+	assert(t, cfg.TLS.ClientCAFile == "", "client CA should not be configured")
+}
+
+func TestCliRestoreWithoutInto(t *testing.T) {
+	_, err := cliTest("--restore", "../test/bkp.db.zst")
+	assert(t, err != "", "succeeded, but shouldn't have ", err)
+}
+
+func TestCliRestoreIntoWithoutRestore(t *testing.T) {
+	_, err := cliTest("--mem-db", "mem1", "--restore-into", "../test/test.db")
+	assert(t, err != "", "succeeded, but shouldn't have ", err)
+}
+
+func TestCliRestore(t *testing.T) {
+	cfg, err := cliTest("--restore", "../test/bkp.db.zst", "--restore-into", "../test/test.db", "--restore-key", "hey")
+	assert(t, err == "", "did not succeed ", err)
+	assert(t, cfg.Restore != nil, "restore should be configured")
+	assert(t, cfg.Restore.Key == "hey", "restore key not set")
+	assert(t, len(cfg.Databases) == 0, "no db should be configured")
+}
+
 func TestCliMem(t *testing.T) {
 	cfg, err := cliTest("--mem-db", "mem1")
 	assert(t, err == "", "did not succeed ", err)
@@ -184,3 +219,9 @@ func TestConfigs(t *testing.T) {
 
 	assert(t, cfg.ServeDir != nil, "a dir to serve should be configured")
 }
+
+func TestCliMigrateOnly(t *testing.T) {
+	cfg, err := cliTest("--mem-db", "test", "--migrate-only")
+	assert(t, err == "", "didn't succeed, but should have ", err)
+	assert(t, cfg.MigrateOnly, "migrate only is not set")
+}
@@ -0,0 +1,68 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// fasthttp doesn't notify when the client disconnects during the execution of a
+// handler. Where possible (see connClosed()), the connection is checked every
+// connCheckInterval, peeking at it so that nothing is consumed, and the context
+// is canceled if it was closed; elsewhere, only the timeouts apply.
+
+const connCheckInterval = 250 * time.Millisecond
+
+// Returns a context that is canceled when the client closes the connection,
+// and the function to stop watching it, to be called at the end of the request.
+// The first check is after connCheckInterval, so that the quick requests don't
+// pay for it.
+func watchConn(ctx context.Context, conn net.Conn) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var mutex sync.Mutex
+	var timer *time.Timer
+	stopped := false
+
+	var check func()
+	check = func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stopped {
+			return
+		}
+		if connClosed(conn) {
+			cancel()
+			return
+		}
+		timer = time.AfterFunc(connCheckInterval, check)
+	}
+
+	mutex.Lock()
+	timer = time.AfterFunc(connCheckInterval, check)
+	mutex.Unlock()
+
+	return ctx, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+		timer.Stop()
+		cancel()
+	}
+}
@@ -0,0 +1,172 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Result sets can be exported as CSV or TSV, instead of JSON, if the client
+// asks for them with the Accept header. The delimiter, whether to write the
+// header row and how to represent NULLs can be configured for the db ("csv")
+// and overridden in the query string of the request (delimiter, header and
+// null).
+//
+// The columnar formats (Arrow IPC and Parquet) are not supported yet: a
+// request that accepts only them fails with 406.
+
+const (
+	mimeCSV    = "text/csv"
+	mimeTSV    = "text/tab-separated-values"
+	mimeNDJSON = "application/x-ndjson"
+
+	mimeArrowStream = "application/vnd.apache.arrow.stream"
+	mimeArrowFile   = "application/vnd.apache.arrow.file"
+	mimeParquet     = "application/vnd.apache.parquet"
+
+	headerTruncated = "X-Ws4sqlite-Truncated"
+)
+
+type csvOptions struct {
+	delimiter rune
+	header    bool
+	null      string
+}
+
+func parseDelimiter(delimiter string) (rune, error) {
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size == 0 || size != len(delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("delimiter must be a single character, not a quote or a newline: '%s'", delimiter)
+	}
+	return r, nil
+}
+
+func parseCsv(db *db) {
+	if db.Csv.Delimiter != "" {
+		if _, err := parseDelimiter(db.Csv.Delimiter); err != nil {
+			mllog.Fatalf("for db '%s', csv %s", db.Id, err.Error())
+		}
+	}
+}
+
+// Computes the options for the format, from the config of the db and, if
+// fromQuery, from the query string of the request
+func csvOptionsFor(c *fiber.Ctx, db *db, format string, fromQuery bool) (csvOptions, error) {
+	ret := csvOptions{delimiter: ',', header: true}
+	if format == mimeTSV {
+		ret.delimiter = '\t'
+	}
+	if db.Csv != nil {
+		if db.Csv.Delimiter != "" && format == mimeCSV {
+			ret.delimiter, _ = parseDelimiter(db.Csv.Delimiter) // already checked
+		}
+		ret.header = !db.Csv.NoHeader
+		ret.null = db.Csv.Null
+	}
+	if !fromQuery {
+		return ret, nil
+	}
+
+	var err error
+	if delimiter := c.Query("delimiter"); delimiter != "" {
+		if ret.delimiter, err = parseDelimiter(delimiter); err != nil {
+			return ret, err
+		}
+	}
+	if header := c.Query("header"); header != "" {
+		if ret.header, err = strconv.ParseBool(header); err != nil {
+			return ret, errors.New("header must be true or false")
+		}
+	}
+	if args := c.Context().QueryArgs(); args.Has("null") {
+		ret.null = string(args.Peek("null"))
+	}
+	return ret, nil
+}
+
+func csvValue(val interface{}, null string) string {
+	switch v := val.(type) {
+	case nil:
+		return null
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(val)
+}
+
+// To be called when none of the supported formats is accepted: if a columnar
+// one is, returns an error that says it's not supported
+func columnarNotAcceptable(c *fiber.Ctx) error {
+	if format := c.Accepts(mimeArrowStream, mimeArrowFile, mimeParquet); format != "" {
+		return newWSError(-1, fiber.StatusNotAcceptable, "%s is not supported yet", format)
+	}
+	return nil
+}
+
+// Writes the rows, whose values are in the same order of the columns
+func writeCSV(out io.Writer, columns []string, rows [][]interface{}, opts csvOptions) error {
+	w := csv.NewWriter(out)
+	w.Comma = opts.delimiter
+	if opts.header {
+		if err := w.Write(columns); err != nil {
+			return err
+		}
+	}
+	record := make([]string, len(columns))
+	for i := range rows {
+		for j := range rows[i] {
+			record[j] = csvValue(rows[i][j], opts.null)
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Sends the result set of a query item as CSV or TSV
+func sendCSV(c *fiber.Ctx, item *responseItem, format string, opts csvOptions) error {
+	if !item.Success {
+		return newWSError(0, fiber.StatusInternalServerError, item.Error)
+	}
+	rows := make([][]interface{}, len(item.ResultSet))
+	for i := range item.ResultSet {
+		rows[i] = make([]interface{}, len(item.columns))
+		for j := range item.columns {
+			rows[i][j] = item.ResultSet[i][item.columns[j]]
+		}
+	}
+	if item.Truncated {
+		c.Set(headerTruncated, "true")
+	}
+	c.Set(fiber.HeaderContentType, format)
+	return writeCSV(c, item.columns, rows, opts)
+}
@@ -0,0 +1,154 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestExportSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT, NUM REAL)",
+					"INSERT INTO T1 VALUES (1, 'ONE', 1.5), (2, 'TWO;2', NULL)",
+				},
+			},
+			{
+				Id:   "configured",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+					"INSERT INTO T1 VALUES (1, NULL)",
+				},
+				Csv: &csvCfg{
+					Delimiter: ";",
+					NoHeader:  true,
+					Null:      "NULL",
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func callExport(t *testing.T, path, accept string, req request) (int, string, string) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Error(err)
+	}
+	post := fiber.Post("http://localhost:12321"+path).
+		Body(data).
+		Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON).
+		Set(fiber.HeaderAccept, accept)
+	resp := fiber.AcquireResponse()
+	defer fiber.ReleaseResponse(resp)
+	post.SetResponse(resp)
+	code, body, errs := post.String()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	return code, body, string(resp.Header.ContentType())
+}
+
+func selectAll() request {
+	return request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM T1 ORDER BY ID",
+			},
+		},
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	code, body, ct := callExport(t, "/test", "text/csv", selectAll())
+	if code != 200 || ct != mimeCSV || body != "ID,VAL,NUM\n1,ONE,1.5\n2,TWO;2,\n" {
+		t.Errorf("wrong CSV: %d %s %s", code, ct, body)
+	}
+
+	code, body, _ = callExport(t, "/test?delimiter=;&header=false&null=%5CN", "text/csv", selectAll())
+	if code != 200 || body != "1;ONE;1.5\n2;\"TWO;2\";\\N\n" {
+		t.Errorf("wrong CSV with options: %d %s", code, body)
+	}
+
+	code, body, ct = callExport(t, "/test", "text/tab-separated-values", selectAll())
+	if code != 200 || ct != mimeTSV || body != "ID\tVAL\tNUM\n1\tONE\t1.5\n2\tTWO;2\t\n" {
+		t.Errorf("wrong TSV: %d %s %s", code, ct, body)
+	}
+
+	code, body, _ = callExport(t, "/configured", "text/csv", selectAll())
+	if code != 200 || body != "1;NULL\n" {
+		t.Errorf("wrong configured CSV: %d %s", code, body)
+	}
+
+	// JSON is still the default
+	code, body, ct = callExport(t, "/test", "text/html, */*", selectAll())
+	if code != 200 || ct != fiber.MIMEApplicationJSON {
+		t.Errorf("expected JSON: %d %s %s", code, ct, body)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT 1",
+			}, {
+				Query: "SELECT 2",
+			},
+		},
+	}
+	if code, body, _ := callExport(t, "/test", "text/csv", req); code != 400 {
+		t.Errorf("expected 400 for two queries: %d %s", code, body)
+	}
+	if code, body, _ := callExport(t, "/test?delimiter=ab", "text/csv", selectAll()); code != 400 {
+		t.Errorf("expected 400 for a wrong delimiter: %d %s", code, body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query:  "SELECT * FROM NOPE",
+				NoFail: true,
+			},
+		},
+	}
+	if code, body, _ := callExport(t, "/test", "text/csv", req); code != 500 {
+		t.Errorf("expected 500 for a failed query: %d %s", code, body)
+	}
+
+	if code, body, _ := callExport(t, "/test", "application/vnd.apache.arrow.stream", selectAll()); code != 406 || !strings.Contains(body, "not supported") {
+		t.Errorf("expected 406 for arrow: %d %s", code, body)
+	}
+}
+
+func TestExportTeardown(t *testing.T) {
+	Shutdown()
+}
@@ -0,0 +1,513 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Bulk import of rows in a table, on POST /<db id>/import/<table>, if an
+// "import" node is configured. The body is CSV, TSV (with the same options of
+// the export: delimiter, header and null) or NDJSON. It's first received in a
+// temp file, so that a slow client doesn't hold the db; then each row is
+// inserted as soon as it's read, with a prepared statement, in a single
+// transaction. The audit and task history tables can't be imported into. The fields are mapped to the columns with the same name, or as
+// specified with ?map=field:column,...; for CSV without a header row, the
+// columns are given with ?columns=col1,col2,...
+//
+// ?onConflict= can be abort (the default), ignore, replace or upsert (that
+// updates the row in conflict, on the columns given in ?conflictColumns=, by
+// default the primary key). ?onError= can be rollback (the default), that
+// fails the whole import at the first error, or skip, that reports the error
+// for the line and goes on, up to ?maxErrors= errors.
+
+const (
+	defaultImportMaxErrors = 100
+	importLogChunk         = 1000 // rows logged together in the change feed
+)
+
+var importConflicts = map[string]string{
+	"abort":   "INSERT INTO",
+	"ignore":  "INSERT OR IGNORE INTO",
+	"replace": "INSERT OR REPLACE INTO",
+	"upsert":  "INSERT INTO",
+}
+
+type importLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importResponse struct {
+	Read    int               `json:"read"`
+	Written int64             `json:"written"`
+	Failed  int               `json:"failed"`
+	Errors  []importLineError `json:"errors"`
+}
+
+// A row read from the body; values are in the order of the columns
+type importRow struct {
+	line    int
+	columns []string
+	values  []interface{}
+}
+
+// The options of the request
+type importOptions struct {
+	table       string
+	columns     map[string]bool // of the table
+	pk          []string
+	mapping     map[string]string
+	onConflict  string
+	conflictCol []string
+	skipErrors  bool
+	maxErrors   int
+}
+
+func parseImport(db *db) {
+	if db.ReadOnly || db.ReplicaOf != nil {
+		mllog.Fatalf("for db '%s', import cannot be enabled on a read only db or on a replica", db.Id)
+	}
+	for i := range db.Import.Tables {
+		if !identifierRegexp.MatchString(db.Import.Tables[i]) {
+			mllog.Fatalf("for db '%s', import table name is not valid: %s", db.Id, db.Import.Tables[i])
+		}
+	}
+	mllog.StdOutf("  + Importing CSV and NDJSON at /%s/import/<table>", db.Id)
+}
+
+func parseImportOptions(c *fiber.Ctx, cols []schemaColumn) (*importOptions, error) {
+	ret := &importOptions{
+		table:      c.Params("table"),
+		columns:    make(map[string]bool),
+		mapping:    make(map[string]string),
+		onConflict: strings.ToLower(c.Query("onConflict", "abort")),
+		maxErrors:  c.QueryInt("maxErrors", defaultImportMaxErrors),
+	}
+	pk := make(map[int]string)
+	for i := range cols {
+		ret.columns[cols[i].Name] = true
+		if cols[i].PrimaryKey > 0 {
+			pk[cols[i].PrimaryKey] = cols[i].Name
+		}
+	}
+	for i := 1; i <= len(pk); i++ {
+		ret.pk = append(ret.pk, pk[i])
+	}
+
+	if _, ok := importConflicts[ret.onConflict]; !ok {
+		return nil, errors.New("onConflict must be one of abort, ignore, replace or upsert")
+	}
+	if ret.onConflict == "upsert" {
+		ret.conflictCol = ret.pk
+		if cc := c.Query("conflictColumns"); cc != "" {
+			ret.conflictCol = strings.Split(cc, ",")
+		}
+		if len(ret.conflictCol) == 0 {
+			return nil, errors.New("conflictColumns must be specified, as the table has no primary key")
+		}
+		for _, col := range ret.conflictCol {
+			if !ret.columns[col] {
+				return nil, fmt.Errorf("column '%s' not found", col)
+			}
+		}
+	}
+
+	switch c.Query("onError", "rollback") {
+	case "rollback":
+	case "skip":
+		ret.skipErrors = true
+	default:
+		return nil, errors.New("onError must be rollback or skip")
+	}
+	if ret.maxErrors < 1 {
+		return nil, errors.New("maxErrors must be positive")
+	}
+
+	if m := c.Query("map"); m != "" {
+		for _, pair := range strings.Split(m, ",") {
+			field, col, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, fmt.Errorf("map must be like field:column,...: %s", pair)
+			}
+			ret.mapping[field] = col
+		}
+	}
+	return ret, nil
+}
+
+// Maps the fields to the columns of the table
+func (o *importOptions) mapFields(fields []string) ([]string, error) {
+	ret := make([]string, len(fields))
+	seen := make(map[string]bool)
+	for i, field := range fields {
+		col := field
+		if mapped, ok := o.mapping[field]; ok {
+			col = mapped
+		}
+		if !o.columns[col] {
+			return nil, fmt.Errorf("column '%s' not found in table '%s'", col, o.table)
+		}
+		if seen[col] {
+			return nil, fmt.Errorf("column '%s' is specified twice", col)
+		}
+		seen[col] = true
+		ret[i] = col
+	}
+	return ret, nil
+}
+
+// The INSERT statement for the columns
+func (o *importOptions) statement(columns []string) string {
+	var cols, params []string
+	for i := range columns {
+		cols = append(cols, quoteIdentifier(columns[i]))
+		params = append(params, fmt.Sprint(":c", i))
+	}
+	ret := fmt.Sprintf("%s %s (%s) VALUES (%s)", importConflicts[o.onConflict], quoteIdentifier(o.table), strings.Join(cols, ", "), strings.Join(params, ", "))
+	if o.onConflict == "upsert" {
+		var sets []string
+		for _, col := range columns {
+			if !contains(o.conflictCol, col) {
+				sets = append(sets, fmt.Sprintf("%s = excluded.%s", quoteIdentifier(col), quoteIdentifier(col)))
+			}
+		}
+		var conflict []string
+		for _, col := range o.conflictCol {
+			conflict = append(conflict, quoteIdentifier(col))
+		}
+		if len(sets) == 0 {
+			ret += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(conflict, ", "))
+		} else {
+			ret += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflict, ", "), strings.Join(sets, ", "))
+		}
+	}
+	return ret
+}
+
+// Reads CSV or TSV rows, calling f for each of them; a non-nil error from f
+// stops the reading.
+func readCSVRows(body io.Reader, opts csvOptions, o *importOptions, columnsParam string, f func(row *importRow, err error) error) error {
+	r := csv.NewReader(body)
+	r.Comma = opts.delimiter
+	r.ReuseRecord = true
+
+	var columns []string
+	var err error
+	if columnsParam != "" {
+		if columns, err = o.mapFields(strings.Split(columnsParam, ",")); err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, err.Error())
+		}
+	}
+	if opts.header {
+		fields, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, "in reading the header: %s", err.Error())
+		}
+		if columns == nil {
+			if columns, err = o.mapFields(fields); err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+		}
+	} else if columns == nil {
+		return newWSError(-1, fiber.StatusBadRequest, "without a header row, the columns must be specified")
+	}
+	r.FieldsPerRecord = len(columns)
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return newWSError(-1, fiber.StatusBadRequest, "in reading the body: %s", err.Error())
+			}
+			if pe.Err != csv.ErrFieldCount {
+				// Can't go on after a malformed record
+				return f(&importRow{line: pe.StartLine}, err)
+			}
+			if err := f(&importRow{line: pe.StartLine}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		values := make([]interface{}, len(record))
+		for i := range record {
+			if record[i] != opts.null {
+				values[i] = record[i]
+			}
+		}
+		if err := f(&importRow{line: line, columns: columns, values: values}, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads NDJSON rows, calling f for each of them; a non-nil error from f stops
+// the reading.
+func readNDJSONRows(body io.Reader, o *importOptions, f func(row *importRow, err error) error) error {
+	s := bufio.NewScanner(body)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		text := bytes.TrimSpace(s.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(text, &obj); err != nil {
+			if err := f(&importRow{line: line}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		vals, err := raw2vals(obj)
+		if err != nil {
+			if err := f(&importRow{line: line}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		fields := make([]string, 0, len(vals))
+		for field := range vals {
+			fields = append(fields, field)
+		}
+		// So that the same fields give the same statement, whatever their order
+		sort.Strings(fields)
+		columns, err := o.mapFields(fields)
+		if err != nil {
+			if err := f(&importRow{line: line}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		values := make([]interface{}, len(fields))
+		for i := range fields {
+			values[i] = vals[fields[i]]
+		}
+		if err := f(&importRow{line: line, columns: columns, values: values}, nil); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return f(&importRow{line: line + 1}, err)
+	}
+	return nil
+}
+
+// Writes the rows, preparing a statement for each set of columns and
+// recording them in the change feed, if any, in chunks.
+type importWriter struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	db      *db
+	opts    *importOptions
+	stmts   map[string]*sql.Stmt
+	order   []string                            // of the statements, as they're prepared
+	written map[string]int64                    // rows, by statement
+	pending map[string][]map[string]interface{} // for the change feed, by statement
+}
+
+func (w *importWriter) write(row *importRow) (int64, error) {
+	sqll := w.opts.statement(row.columns)
+	stmt, ok := w.stmts[sqll]
+	if !ok {
+		var err error
+		if stmt, err = w.tx.PrepareContext(w.ctx, sqll); err != nil {
+			return 0, err
+		}
+		w.stmts[sqll] = stmt
+		w.order = append(w.order, sqll)
+	}
+	values := make(map[string]interface{}, len(row.values))
+	for i := range row.values {
+		values[fmt.Sprint("c", i)] = row.values[i]
+	}
+	res, err := stmt.ExecContext(w.ctx, vals2nameds(values)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	w.written[sqll] += n
+	if w.db.ChangeFeed {
+		w.pending[sqll] = append(w.pending[sqll], values)
+		if len(w.pending[sqll]) >= importLogChunk {
+			if err := w.flush(sqll); err != nil {
+				return 0, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *importWriter) flush(sqll string) error {
+	if len(w.pending[sqll]) == 0 {
+		return nil
+	}
+	err := logChange(w.ctx, w.tx, sqll, nil, w.pending[sqll])
+	delete(w.pending, sqll)
+	return err
+}
+
+// Records the statements in the audit trail, with the rows they wrote; not their
+// values, that can be a lot. err is the one that aborted the import, if any.
+func (w *importWriter) audit(audit *auditTrail, err error) {
+	for i, sqll := range w.order {
+		n := w.written[sqll]
+		audit.add(i, sqll, false, nil, nil, &responseItem{RowsUpdated: &n}, nil)
+	}
+	if err != nil {
+		audit.add(len(w.order), "", false, nil, nil, nil, err)
+	}
+}
+
+func (w *importWriter) close() error {
+	for sqll := range w.pending {
+		if err := w.flush(sqll); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range w.stmts {
+		stmt.Close()
+	}
+	return nil
+}
+
+func importHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		table := c.Params("table")
+		if len(db.Import.Tables) > 0 && !contains(db.Import.Tables, table) {
+			return newWSError(-1, fiber.StatusNotFound, "table '%s' not found", table)
+		}
+
+		mimeType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+		switch mimeType {
+		case mimeCSV, mimeTSV, mimeNDJSON:
+		case "application/ndjson":
+			mimeType = mimeNDJSON
+		default:
+			return newWSError(-1, fiber.StatusUnsupportedMediaType, "content type must be %s, %s or %s", mimeCSV, mimeTSV, mimeNDJSON)
+		}
+		csvOpts, err := csvOptionsFor(c, db, mimeType, true)
+		if err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, err.Error())
+		}
+
+		fname, err := uploadToTemp(c, db)
+		if wsErr, ok := err.(wsError); ok {
+			return wsErr
+		} else if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, "In receiving the body: %s", err.Error())
+		}
+		defer os.Remove(fname)
+		body, err := os.Open(fname)
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+		defer body.Close()
+
+		return withTransaction(c, db, func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (status int, resp interface{}, err error) {
+			cols, err := readColumns(ctx, db.DbConn, table)
+			if err != nil {
+				return 0, nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+			}
+			if len(cols) == 0 || strings.HasPrefix(table, "_ws4sqlite_") || strings.HasPrefix(table, "sqlite_") || isOwnTable(db, table) {
+				return 0, nil, newWSError(-1, fiber.StatusNotFound, "table '%s' not found", table)
+			}
+			opts, err := parseImportOptions(c, cols)
+			if err != nil {
+				return 0, nil, newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+
+			w := &importWriter{ctx: ctx, tx: tx, db: db, opts: opts, stmts: make(map[string]*sql.Stmt),
+				written: make(map[string]int64), pending: make(map[string][]map[string]interface{})}
+			defer w.close()
+			defer func() { w.audit(audit, err) }()
+
+			ret := importResponse{Errors: []importLineError{}}
+			handleRow := func(row *importRow, err error) error {
+				ret.Read++
+				if err == nil {
+					var n int64
+					if n, err = w.write(row); err == nil {
+						ret.Written += n
+						return nil
+					}
+					if wsErr, ok := err.(wsError); ok {
+						return wsErr // not about the row
+					}
+				}
+				ret.Failed++
+				if !opts.skipErrors {
+					return newWSError(-1, fiber.StatusBadRequest, "at line %d: %s", row.line, err.Error())
+				}
+				ret.Errors = append(ret.Errors, importLineError{row.line, err.Error()})
+				if ret.Failed >= opts.maxErrors {
+					return newWSError(-1, fiber.StatusBadRequest, "too many errors (%d), the last at line %d: %s", ret.Failed, row.line, err.Error())
+				}
+				return nil
+			}
+
+			if mimeType == mimeNDJSON {
+				err = readNDJSONRows(body, opts, handleRow)
+			} else {
+				err = readCSVRows(body, csvOpts, opts, c.Query("columns"), handleRow)
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			if err := w.close(); err != nil {
+				return 0, nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+			}
+			return fiber.StatusOK, ret, nil
+		})
+	}
+}
+
+// Registers the import endpoint, if so configured
+func registerImport(db *db) {
+	if db.Import == nil {
+		return
+	}
+
+	handlers := append(endpointHandlers(db, "POST"), importHandler(db))
+	app.Post(fmt.Sprintf("/%s/import/:table", db.Id), handlers...)
+}
@@ -0,0 +1,287 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestImportSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT NOT NULL, NUM REAL)",
+					"CREATE TABLE T2 (ID INTEGER PRIMARY KEY)",
+				},
+				Import: &importCfg{
+					Tables: []string{"T1"},
+				},
+				Audit: &auditCfg{
+					ToTable: "AUDIT_LOG",
+				},
+				Limits: &limitsCfg{
+					MaxUploadBytes: 1 << 20,
+				},
+			},
+			{
+				Id:   "all",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY)",
+				},
+				Import: &importCfg{},
+				Audit: &auditCfg{
+					ToTable: "AUDIT_LOG",
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func callImport(t *testing.T, path, contentType, body string) (int, importResponse, string) {
+	post := fiber.Post("http://localhost:12321"+path).
+		Body([]byte(body)).
+		Set(fiber.HeaderContentType, contentType)
+	code, resBody, errs := post.String()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	var res importResponse
+	if code == 200 {
+		if err := json.Unmarshal([]byte(resBody), &res); err != nil {
+			t.Error(err)
+		}
+	}
+	return code, res, resBody
+}
+
+func countT1(t *testing.T) int {
+	code, body, _ := callExport(t, "/test", "application/json", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(*) AS C FROM T1",
+			},
+		},
+	})
+	var res response
+	if err := json.Unmarshal([]byte(body), &res); code != 200 || err != nil {
+		t.Errorf("cannot count: %d %s", code, body)
+		return -1
+	}
+	return int(res.Results[0].ResultSet[0]["C"].(float64))
+}
+
+func TestImportCSV(t *testing.T) {
+	code, res, body := callImport(t, "/test/import/T1", "text/csv", "ID,VAL,NUM\n1,ONE,1.5\n2,TWO,\n")
+	if code != 200 || res.Read != 2 || res.Written != 2 || res.Failed != 0 {
+		t.Errorf("wrong CSV import: %d %s", code, body)
+	}
+
+	code, res, body = callImport(t, "/test/import/T1?header=false&columns=ID,VAL&delimiter=;", "text/csv", "3;THREE\n")
+	if code != 200 || res.Written != 1 {
+		t.Errorf("wrong CSV import without header: %d %s", code, body)
+	}
+
+	code, res, body = callImport(t, "/test/import/T1?map=K:ID,V:VAL", "text/tab-separated-values", "K\tV\n4\tFOUR\n")
+	if code != 200 || res.Written != 1 {
+		t.Errorf("wrong mapped TSV import: %d %s", code, body)
+	}
+
+	if n := countT1(t); n != 4 {
+		t.Errorf("expected 4 rows, got %d", n)
+	}
+}
+
+func TestImportNDJSON(t *testing.T) {
+	code, res, body := callImport(t, "/test/import/T1", "application/x-ndjson", "{\"ID\":5,\"VAL\":\"FIVE\"}\n\n{\"ID\":6,\"VAL\":\"SIX\",\"NUM\":6}\n")
+	if code != 200 || res.Read != 2 || res.Written != 2 {
+		t.Errorf("wrong NDJSON import: %d %s", code, body)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	// rollback by default
+	code, _, body := callImport(t, "/test/import/T1", "text/csv", "ID,VAL\n7,SEVEN\n1,DUP\n")
+	if code != 400 || !strings.Contains(body, "t line 3") {
+		t.Errorf("expected 400 at line 3: %d %s", code, body)
+	}
+	if n := countT1(t); n != 6 {
+		t.Errorf("import not rolled back, %d rows", n)
+	}
+
+	code, res, body := callImport(t, "/test/import/T1?onError=skip", "text/csv", "ID,VAL\n7,SEVEN\n1,DUP\n8\n")
+	if code != 200 || res.Read != 3 || res.Written != 1 || res.Failed != 2 || len(res.Errors) != 2 || res.Errors[0].Line != 3 || res.Errors[1].Line != 4 {
+		t.Errorf("wrong skipped errors: %d %s", code, body)
+	}
+
+	code, _, body = callImport(t, "/test/import/T1?onError=skip&maxErrors=1", "text/csv", "ID,VAL\n1,DUP\n9,NINE\n")
+	if code != 400 || !strings.Contains(body, "oo many errors") {
+		t.Errorf("expected too many errors: %d %s", code, body)
+	}
+
+	code, res, body = callImport(t, "/test/import/T1?onConflict=ignore", "text/csv", "ID,VAL\n1,DUP\n")
+	if code != 200 || res.Written != 0 {
+		t.Errorf("wrong ignore: %d %s", code, body)
+	}
+
+	code, res, body = callImport(t, "/test/import/T1?onConflict=upsert", "application/x-ndjson", "{\"ID\":1,\"VAL\":\"UPDATED\"}\n")
+	if code != 200 || res.Written != 1 {
+		t.Errorf("wrong upsert: %d %s", code, body)
+	}
+	code, body, _ = callExport(t, "/test", "text/csv", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT VAL, NUM FROM T1 WHERE ID = 1",
+			},
+		},
+	})
+	if code != 200 || body != "VAL,NUM\nUPDATED,1.5\n" {
+		t.Errorf("row not upserted: %d %s", code, body)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for path, expected := range map[string]int{
+		"/test/import/T2":                   404, // not allowed
+		"/test/import/NOPE":                 404,
+		"/test/import/T1?onConflict=wrong":  400,
+		"/test/import/T1?map=ID:NOPE":       400,
+		"/test/import/T1?header=false":      400,
+		"/test/import/T1?delimiter=ab":      400,
+		"/test/import/T1?onError=sometimes": 400,
+	} {
+		if code, _, body := callImport(t, path, "text/csv", "ID\n10\n"); code != expected {
+			t.Errorf("for %s expected %d, got %d: %s", path, expected, code, body)
+		}
+	}
+
+	// the audit log can't be forged
+	if code, _, body := callImport(t, "/all/import/AUDIT_LOG", "text/csv", "ID\n10\n"); code != 404 {
+		t.Errorf("expected 404, got %d: %s", code, body)
+	}
+	if code, _, body := callImport(t, "/all/import/T1", "text/csv", "ID\n10\n"); code != 200 {
+		t.Errorf("did not succeed (%d): %s", code, body)
+	}
+
+	if code, _, body := callImport(t, "/test/import/T1", "application/json", "{}"); code != 415 {
+		t.Errorf("expected 415, got %d: %s", code, body)
+	}
+}
+
+func TestImportAudit(t *testing.T) {
+	// the fields in a different order give the same statement
+	code, res, body := callImport(t, "/test/import/T1", "application/x-ndjson", "{\"VAL\":\"A\",\"ID\":20}\n{\"ID\":21,\"VAL\":\"B\"}\n")
+	if code != 200 || res.Written != 2 {
+		t.Errorf("did not succeed (%d): %s", code, body)
+		return
+	}
+
+	code, body, _ = callExport(t, "/test", "application/json", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT SQL, ROWS_AFFECTED, COMMITTED FROM AUDIT_LOG WHERE SQL LIKE '%\"VAL\"%' ORDER BY rowid DESC",
+			},
+		},
+	})
+	var ret response
+	if err := json.Unmarshal([]byte(body), &ret); code != 200 || err != nil {
+		t.Errorf("cannot read the audit log: %d %s", code, body)
+		return
+	}
+	rs := ret.Results[0].ResultSet
+	if len(rs) == 0 || !strings.HasPrefix(rs[0]["SQL"].(string), "INSERT") || rs[0]["ROWS_AFFECTED"] != 2.0 || rs[0]["COMMITTED"] != 1.0 {
+		t.Errorf("import not audited: %v", rs)
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	if code, _, body := callImport(t, "/test/import/T1", "text/csv", "ID,VAL\n"+strings.Repeat("1,X\n", 1<<19)); code != 413 {
+		t.Errorf("expected 413, got %d: %s", code, body)
+	}
+
+	// the other endpoints keep the default limit
+	code, _, _ := callExport(t, "/test", "application/json", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT '" + strings.Repeat("X", fiber.DefaultBodyLimit) + "'",
+			},
+		},
+	})
+	if code != 413 {
+		t.Errorf("expected 413, got %d", code)
+	}
+}
+
+func TestImportSlowBody(t *testing.T) {
+	head := "ID,VAL\n" + strings.Repeat("X", 64<<10) + "\n"
+	tail := "100,A\n"
+
+	r, w := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:12321/test/import/T1?onError=skip", r)
+	req.ContentLength = int64(len(head) + len(tail))
+	req.Header.Set(fiber.HeaderContentType, "text/csv")
+	done := make(chan error)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			if res.StatusCode != 200 {
+				err = fmt.Errorf("import failed with %d", res.StatusCode)
+			}
+			res.Body.Close()
+		}
+		done <- err
+	}()
+
+	w.Write([]byte(head))
+	time.Sleep(200 * time.Millisecond)
+
+	// while the body is being received, the db is not held
+	counted := make(chan int)
+	go func() { counted <- countT1(t) }()
+	select {
+	case <-counted:
+	case <-time.After(time.Second):
+		t.Error("the db is held by the import")
+		defer func() { <-counted }()
+	}
+
+	w.Write([]byte(tail))
+	w.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportTeardown(t *testing.T) {
+	Shutdown()
+}
@@ -0,0 +1,150 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// If true, the runtime logs are emitted as JSON records (one per line), else
+// they're delegated to mylittlelogger as free-form strings. The startup messages
+// are always plain text.
+var logJSON = false
+
+// Serializes the writes of JSON records, so that lines don't get mixed
+var logJSONMutex sync.Mutex
+
+// Structured fields attached to a log record. In text mode they're ignored,
+// the message is expected to be meaningful in itself.
+type logFields map[string]interface{}
+
+var logLevelNames = map[int]string{
+	mllog.DEBUG: "debug",
+	mllog.INFO:  "info",
+	mllog.WARN:  "warn",
+	mllog.ERROR: "error",
+}
+
+func logRecord(level int, fields logFields, format string, elements ...interface{}) {
+	if mllog.Level < level {
+		return
+	}
+
+	msg := fmt.Sprintf(format, elements...)
+
+	if !logJSON {
+		switch level {
+		case mllog.ERROR:
+			mllog.Error(msg)
+		case mllog.WARN:
+			mllog.Warn(msg)
+		case mllog.INFO:
+			mllog.Info(msg)
+		default:
+			mllog.Debug(msg)
+		}
+		return
+	}
+
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["time"] = time.Now().Format(time.RFC3339Nano)
+	record["level"] = logLevelNames[level]
+	record["msg"] = msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": "error", "msg": err.Error()})
+	}
+
+	logJSONMutex.Lock()
+	defer logJSONMutex.Unlock()
+	os.Stdout.Write(append(line, '\n'))
+}
+
+func logError(fields logFields, format string, elements ...interface{}) {
+	logRecord(mllog.ERROR, fields, format, elements...)
+}
+
+func logWarn(fields logFields, format string, elements ...interface{}) {
+	logRecord(mllog.WARN, fields, format, elements...)
+}
+
+func logInfo(fields logFields, format string, elements ...interface{}) {
+	logRecord(mllog.INFO, fields, format, elements...)
+}
+
+// Fields that identify a request, for the logs emitted while serving it
+func reqLogFields(c *fiber.Ctx, dbId string) logFields {
+	return logFields{"db": dbId, "requestId": c.Locals("requestId")}
+}
+
+// Middleware that assigns an ID to the request (taking it from the X-Request-ID
+// header, if present) and logs the outcome of the call when it ends. It must be
+// the first handler of the chain, and catches the errors (and panics) of the
+// following ones to know the actual status code.
+func accessLog(dbId string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		reqId := c.Get(fiber.HeaderXRequestID)
+		if reqId == "" {
+			reqId = utils.UUIDv4()
+		}
+		c.Locals("requestId", reqId)
+		c.Set(fiber.HeaderXRequestID, reqId)
+
+		fields := reqLogFields(c, dbId)
+
+		if err := c.Next(); err != nil {
+			if wse, ok := err.(wsError); ok && wse.RequestIdx >= 0 {
+				fields["reqIdx"] = wse.RequestIdx
+			}
+			fields["error"] = err.Error()
+			if err := errHandler(c, err); err != nil {
+				c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		duration := time.Since(start)
+		fields["method"] = c.Method()
+		fields["path"] = c.Path()
+		fields["clientIp"] = c.IP()
+		fields["status"] = status
+		fields["durationMs"] = float64(duration.Microseconds()) / 1000
+
+		logInfo(fields, "%s %s %s -> %d in %s (request %s)", c.IP(), c.Method(), c.Path(), status, duration, reqId)
+
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Executes the function capturing the lines it writes to stdout, with logs enabled
+func captureLogs(t *testing.T, f func()) []map[string]interface{} {
+	origStdout, origLevel := os.Stdout, mllog.Level
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, mllog.Level = w, mllog.INFO
+	f()
+	os.Stdout, mllog.Level = origStdout, origLevel
+	w.Close()
+
+	var ret []map[string]interface{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Errorf("not a JSON record: %s", scanner.Text())
+			continue
+		}
+		ret = append(ret, record)
+	}
+	return ret
+}
+
+func callWithReqId(reqId string, t *testing.T) (int, string) {
+	client := &fiber.Client{}
+	post := client.Post("http://localhost:12321/test").
+		Body([]byte(`{"transaction":[{"query":"SELECT 1"},{"query":"SELECT * FROM NOPE"}]}`)).
+		Set("Content-Type", "application/json")
+	if reqId != "" {
+		post = post.Set(fiber.HeaderXRequestID, reqId)
+	}
+	resp := fiber.AcquireResponse()
+	defer fiber.ReleaseResponse(resp)
+	post.SetResponse(resp)
+	code, _, errs := post.Bytes()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	return code, string(resp.Header.Peek(fiber.HeaderXRequestID))
+}
+
+func TestLogJSONSetup(t *testing.T) {
+	cfg := config{
+		Bindhost:  "0.0.0.0",
+		Port:      12321,
+		LogFormat: logFormatJSON,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestLogJSONAccessLog(t *testing.T) {
+	var code int
+	var reqId string
+	records := captureLogs(t, func() {
+		code, reqId = callWithReqId("myRequest", t)
+	})
+
+	if code != 500 {
+		t.Errorf("did not fail with 500: %d", code)
+	}
+
+	if reqId != "myRequest" {
+		t.Errorf("request ID not echoed: %s", reqId)
+	}
+
+	if len(records) != 1 {
+		t.Errorf("expected 1 log record, found %d", len(records))
+		return
+	}
+
+	rec := records[0]
+	if rec["level"] != "info" || rec["db"] != "test" || rec["requestId"] != "myRequest" {
+		t.Errorf("wrong fields in access log: %v", rec)
+	}
+
+	if rec["status"] != float64(500) || rec["reqIdx"] != float64(1) {
+		t.Errorf("wrong status or reqIdx in access log: %v", rec)
+	}
+
+	if _, ok := rec["durationMs"]; !ok {
+		t.Error("duration not present in access log")
+	}
+}
+
+func TestLogJSONGeneratedReqId(t *testing.T) {
+	_, reqId := callWithReqId("", t)
+
+	if len(reqId) != 36 || strings.Count(reqId, "-") != 4 {
+		t.Errorf("request ID not generated: %s", reqId)
+	}
+}
+
+func TestLogJSONTeardown(t *testing.T) {
+	Shutdown()
+	logJSON = false
+}
@@ -0,0 +1,239 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Migrations are versioned steps that evolve the schema of a db, specified in
+// the config ("migrations") or as files in a dir ("migrationsDir"), named like
+// "<version>_<description>.sql". At startup, the ones not yet applied are
+// performed in order of version, each in its own transaction, and recorded in
+// a table. A migration that was applied can't be changed (it's verified with a
+// checksum) and one with a version lower than an applied one can't be added.
+
+const migrationsTable = "_ws4sqlite_migrations"
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.*)\.sql$`)
+
+type migrationStatus struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Checksum    string `json:"checksum"`
+	Applied     bool   `json:"applied"`
+	AppliedAt   string `json:"appliedAt,omitempty"`
+}
+
+type migrationsResponse struct {
+	Migrations []migrationStatus `json:"migrations"`
+}
+
+func (m *migration) checksum() string {
+	hash := sha256.Sum256([]byte(strings.Join(m.Statements, "\n;\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Loads the migrations from the dir, if configured, and checks them.
+func parseMigrations(db *db) {
+	if db.MigrationsDir != "" {
+		if len(db.Migrations) > 0 {
+			mllog.Fatalf("for db '%s', only one of migrations and migrationsDir can be specified", db.Id)
+		}
+		dir := expandHomeDir(db.MigrationsDir, "migrations dir")
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			mllog.Fatalf("for db '%s', in reading migrations dir: %s", db.Id, err.Error())
+		}
+		for i := range files {
+			if files[i].IsDir() || filepath.Ext(files[i].Name()) != ".sql" {
+				continue
+			}
+			parts := migrationFileRegexp.FindStringSubmatch(files[i].Name())
+			if parts == nil {
+				mllog.Fatalf("for db '%s', migration file name must be <version>_<description>.sql: %s", db.Id, files[i].Name())
+			}
+			version, _ := strconv.Atoi(parts[1])
+			sqll, err := os.ReadFile(filepath.Join(dir, files[i].Name()))
+			if err != nil {
+				mllog.Fatalf("for db '%s', in reading migration file: %s", db.Id, err.Error())
+			}
+			db.Migrations = append(db.Migrations, migration{
+				Version:     version,
+				Description: parts[2],
+				Statements:  []string{string(sqll)},
+			})
+		}
+	}
+
+	sort.SliceStable(db.Migrations, func(i, j int) bool {
+		return db.Migrations[i].Version < db.Migrations[j].Version
+	})
+	for i := range db.Migrations {
+		if db.Migrations[i].Version <= 0 {
+			mllog.Fatalf("for db '%s', migration versions must be positive", db.Id)
+		}
+		if i > 0 && db.Migrations[i].Version == db.Migrations[i-1].Version {
+			mllog.Fatalf("for db '%s', migration version %d is specified twice", db.Id, db.Migrations[i].Version)
+		}
+		if len(db.Migrations[i].Statements) == 0 {
+			mllog.Fatalf("for db '%s', migration %d has no statements", db.Id, db.Migrations[i].Version)
+		}
+	}
+}
+
+type appliedMigration struct {
+	Checksum  string
+	AppliedAt string
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, int, error) {
+	ret := make(map[int]appliedMigration)
+	var exists int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?", migrationsTable).Scan(&exists); err != nil {
+		return nil, 0, err
+	}
+	if exists == 0 {
+		return ret, 0, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT VERSION, CHECKSUM, APPLIED_AT FROM "+migrationsTable)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	maxVersion := 0
+	for rows.Next() {
+		var version int
+		var am appliedMigration
+		if err := rows.Scan(&version, &am.Checksum, &am.AppliedAt); err != nil {
+			return nil, 0, err
+		}
+		ret[version] = am
+		if version > maxVersion {
+			maxVersion = version
+		}
+	}
+	return ret, maxVersion, rows.Err()
+}
+
+// Applies the pending migrations, each in a transaction. Fails fatally if one
+// of them fails, leaving the db at the previous version.
+func performMigrations(db *db) {
+	ctx := context.Background()
+	applied, maxVersion, err := appliedMigrations(ctx, db.DbConn)
+	if err != nil {
+		mllog.Fatalf("for db '%s', in reading the applied migrations: %s", db.Id, err.Error())
+	}
+
+	var pending []*migration
+	for i := range db.Migrations {
+		m := &db.Migrations[i]
+		if am, ok := applied[m.Version]; ok {
+			if am.Checksum != m.checksum() {
+				mllog.Fatalf("for db '%s', migration %d was modified after being applied", db.Id, m.Version)
+			}
+			continue
+		}
+		if m.Version < maxVersion {
+			mllog.Fatalf("for db '%s', migration %d is older than the last applied one (%d)", db.Id, m.Version, maxVersion)
+		}
+		pending = append(pending, m)
+	}
+
+	if len(pending) == 0 {
+		if len(db.Migrations) > 0 {
+			mllog.StdOutf("  + Migrations up to date, at version %d", maxVersion)
+		}
+		return
+	}
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', there are pending migrations but the db is read only", db.Id)
+	}
+
+	if _, err := db.DbConn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationsTable+
+		" (VERSION INTEGER PRIMARY KEY, DESCRIPTION TEXT, CHECKSUM TEXT NOT NULL, APPLIED_AT TEXT NOT NULL)"); err != nil {
+		mllog.Fatalf("for db '%s', in creating migrations table: %s", db.Id, err.Error())
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(ctx, db, m); err != nil {
+			mllog.Fatalf("for db '%s', in applying migration %d: %s", db.Id, m.Version, err.Error())
+		}
+		mllog.StdOutf("  + Applied migration %d %s", m.Version, m.Description)
+	}
+}
+
+func applyMigration(ctx context.Context, db *db, m *migration) error {
+	tx, err := db.DbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range m.Statements {
+		if _, err := tx.ExecContext(ctx, m.Statements[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO "+migrationsTable+" VALUES (?, ?, ?, ?)",
+		m.Version, m.Description, m.checksum(), time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Admin endpoint that lists the migrations, and whether they are applied.
+func migrationsHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db.Mutex.Lock()
+		applied, _, err := appliedMigrations(context.Background(), db.DbConn)
+		db.Mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		ret := migrationsResponse{Migrations: []migrationStatus{}}
+		for i := range db.Migrations {
+			m := &db.Migrations[i]
+			status := migrationStatus{
+				Version:     m.Version,
+				Description: m.Description,
+				Checksum:    m.checksum(),
+			}
+			if am, ok := applied[m.Version]; ok {
+				status.Applied = true
+				status.AppliedAt = am.AppliedAt
+			}
+			ret.Migrations = append(ret.Migrations, status)
+		}
+		return c.JSON(ret)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const (
+	migrationsDb  = "../test/migrations.db"
+	migrationsDir = "../test/migrations"
+)
+
+func cleanMigrationFiles() {
+	os.Remove(migrationsDb)
+	os.RemoveAll(migrationsDir)
+}
+
+func writeMigration(t *testing.T, name, sqll string) {
+	if err := os.WriteFile(filepath.Join(migrationsDir, name), []byte(sqll), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Runs the migrations on the db file, returning the fatal error if any
+func migrateDbFile(t *testing.T) string {
+	dbObj, err := sql.Open("sqlite", migrationsDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbObj.Close()
+	conn, err := dbObj.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	orig := mllog.WhenFatal
+	defer func() { mllog.WhenFatal = orig }()
+	mllog.WhenFatal = func(msg string) { panic(msg) }
+
+	var mutex sync.Mutex
+	database := db{Id: "migrations", DbConn: conn, Mutex: &mutex, MigrationsDir: migrationsDir}
+
+	ret := ""
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ret = r.(string)
+			}
+		}()
+		parseMigrations(&database)
+		performMigrations(&database)
+	}()
+	return ret
+}
+
+func queryInt(t *testing.T, query string) int {
+	dbObj, err := sql.Open("sqlite", migrationsDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbObj.Close()
+	var ret int
+	if err := dbObj.QueryRow(query).Scan(&ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestMigrationsDir(t *testing.T) {
+	cleanMigrationFiles()
+	defer cleanMigrationFiles()
+	os.MkdirAll(migrationsDir, 0755)
+
+	writeMigration(t, "1_init.sql", "CREATE TABLE T1 (ID INTEGER PRIMARY KEY);\nINSERT INTO T1 VALUES (1);")
+	writeMigration(t, "2_add_val.sql", "ALTER TABLE T1 ADD COLUMN VAL TEXT")
+	writeMigration(t, "README.md", "not a migration")
+
+	if err := migrateDbFile(t); err != "" {
+		t.Fatal(err)
+	}
+	if n := queryInt(t, "SELECT COUNT(1) FROM "+migrationsTable); n != 2 {
+		t.Errorf("expected 2 applied migrations, got %d", n)
+	}
+	if n := queryInt(t, "SELECT COUNT(1) FROM pragma_table_info('T1') WHERE name = 'VAL'"); n != 1 {
+		t.Error("migration 2 was not applied")
+	}
+
+	// idempotent
+	if err := migrateDbFile(t); err != "" {
+		t.Fatal(err)
+	}
+
+	// a failing migration is rolled back, and the previous ones are kept
+	writeMigration(t, "3_bad.sql", "CREATE TABLE T2 (ID INTEGER);\nINSERT INTO NOPE VALUES (1);")
+	if err := migrateDbFile(t); err == "" {
+		t.Error("did succeed, but shouldn't have")
+	}
+	if n := queryInt(t, "SELECT COUNT(1) FROM sqlite_master WHERE name = 'T2'"); n != 0 {
+		t.Error("failed migration was not rolled back")
+	}
+	if n := queryInt(t, "SELECT MAX(VERSION) FROM "+migrationsTable); n != 2 {
+		t.Errorf("expected version 2, got %d", n)
+	}
+	os.Remove(filepath.Join(migrationsDir, "3_bad.sql"))
+
+	// applied migrations cannot change
+	writeMigration(t, "2_add_val.sql", "ALTER TABLE T1 ADD COLUMN OTHER TEXT")
+	if err := migrateDbFile(t); !strings.Contains(err, "modified after being applied") {
+		t.Errorf("wrong error: %s", err)
+	}
+	writeMigration(t, "2_add_val.sql", "ALTER TABLE T1 ADD COLUMN VAL TEXT")
+
+	// nor can older ones be added
+	writeMigration(t, "10_add_other.sql", "ALTER TABLE T1 ADD COLUMN OTHER TEXT")
+	if err := migrateDbFile(t); err != "" {
+		t.Fatal(err)
+	}
+	writeMigration(t, "0005_too_late.sql", "SELECT 1")
+	if err := migrateDbFile(t); !strings.Contains(err, "older than the last applied one") {
+		t.Errorf("wrong error: %s", err)
+	}
+	os.Remove(filepath.Join(migrationsDir, "0005_too_late.sql"))
+
+	writeMigration(t, "11-wrong-name.sql", "SELECT 1")
+	if err := migrateDbFile(t); !strings.Contains(err, "must be <version>_<description>.sql") {
+		t.Errorf("wrong error: %s", err)
+	}
+}
+
+func TestMigrateOnly(t *testing.T) {
+	cleanMigrationFiles()
+	defer cleanMigrationFiles()
+	defer Shutdown()
+
+	cfg := config{
+		Bindhost:    "0.0.0.0",
+		Port:        12321,
+		MigrateOnly: true,
+		Databases: []db{
+			{
+				Id:   "migrations",
+				Path: migrationsDb,
+				Migrations: []migration{
+					{
+						Version:    1,
+						Statements: []string{"CREATE TABLE T1 (ID INTEGER)"},
+					},
+				},
+			},
+		},
+	}
+	// returns without serving
+	launch(cfg, true)
+
+	if n := queryInt(t, "SELECT COUNT(1) FROM "+migrationsTable); n != 1 {
+		t.Errorf("expected 1 applied migration, got %d", n)
+	}
+}
+
+func TestMigrationsStatus(t *testing.T) {
+	defer Shutdown()
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER)",
+				},
+				Migrations: []migration{
+					{
+						Version:     2,
+						Description: "add val",
+						Statements: []string{
+							"ALTER TABLE T1 ADD COLUMN VAL TEXT",
+							"INSERT INTO T1 VALUES (1, 'ONE')",
+						},
+					}, {
+						Version:     1,
+						Description: "add index",
+						Statements:  []string{"CREATE INDEX IDX1 ON T1 (ID)"},
+					},
+				},
+				Admin: &authr{
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "admin",
+							Password: "secret",
+						},
+					},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT VAL FROM T1",
+			},
+		},
+	}
+	code, body, res := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	if len(res.Results[0].ResultSet) != 1 || res.Results[0].ResultSet[0]["VAL"] != "ONE" {
+		t.Errorf("migrations not applied: %s", body)
+	}
+
+	code, raw := callAdmin("GET", "/test/_admin/migrations", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("status endpoint failed: %s", raw)
+		return
+	}
+	var status migrationsResponse
+	if err := json.Unmarshal(raw, &status); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(status.Migrations) != 2 || status.Migrations[0].Version != 1 || status.Migrations[1].Description != "add val" {
+		t.Errorf("wrong status: %s", raw)
+		return
+	}
+	for i := range status.Migrations {
+		if !status.Migrations[i].Applied || status.Migrations[i].AppliedAt == "" {
+			t.Errorf("migration not applied: %s", raw)
+		}
+	}
+}
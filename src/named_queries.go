@@ -0,0 +1,246 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// The stored statements with exposeAsGet are served on
+// GET /<db id>/q/<statement id>?param=value, for the clients that can only
+// issue GETs. The parameters are taken from the query string, and converted
+// to the declared type if any. The result set is returned as JSON (an array
+// of objects), CSV, TSV or NDJSON, depending on the Accept header, with an ETag
+// to validate the cached copies. The statement is executed in a transaction
+// that is always rolled back, so it can't modify the db.
+
+// Result set that keeps the order of the columns, needed for CSV
+type namedQueryResult struct {
+	columns   []string
+	rows      [][]interface{}
+	truncated bool
+}
+
+func (r *namedQueryResult) row(i int) map[string]interface{} {
+	ret := make(map[string]interface{}, len(r.columns))
+	for j := range r.columns {
+		ret[r.columns[j]] = r.rows[i][j]
+	}
+	return ret
+}
+
+func parseExposeAsGet(db *db) {
+	count := 0
+	for i := range db.StoredStatement {
+		ss := &db.StoredStatement[i]
+		if !ss.ExposeAsGet {
+			continue
+		}
+		if ss.CacheMaxAgeSec < 0 {
+			mllog.Fatalf("for db '%s', cacheMaxAgeSec of stored statement '%s' cannot be negative", db.Id, ss.Id)
+		}
+		count++
+	}
+	if count > 0 {
+		mllog.StdOutf("  + Serving %d stored statements at /%s/q/<id>", count, db.Id)
+	}
+}
+
+// Converts the values in the query string to the declared types; the
+// undeclared ones, and the ones that can't be converted, are left as strings
+// (and the validation will report them).
+func queryValues(c *fiber.Ctx, ss *storedStatement) map[string]interface{} {
+	ret := make(map[string]interface{})
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		name, str := string(key), string(value)
+		ret[name] = str
+		if p := ss.param(name); p != nil {
+			switch p.Type {
+			case "integer", "number":
+				if num, err := strconv.ParseFloat(str, 64); err == nil {
+					ret[name] = num
+				}
+			case "boolean":
+				if b, err := strconv.ParseBool(str); err == nil {
+					ret[name] = b
+				}
+			}
+		}
+	})
+	return ret
+}
+
+func runNamedQuery(ctx context.Context, tx *sql.Tx, sqll string, values map[string]interface{}, limits *limitsCfg) (*namedQueryResult, error) {
+	rows, err := tx.QueryContext(ctx, sqll, vals2nameds(values)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := &namedQueryResult{rows: [][]interface{}{}}
+	ret.columns, _ = rows.Columns() // I can ignore the error, rows aren't closed
+	for rows.Next() {
+		if limits != nil && limits.MaxResultRows > 0 && len(ret.rows) == limits.MaxResultRows {
+			if !limits.Truncate {
+				return nil, fmt.Errorf("the result set exceeds the maximum number of rows (%d)", limits.MaxResultRows)
+			}
+			ret.truncated = true
+			break
+		}
+		values := make([]interface{}, len(ret.columns))
+		scans := make([]interface{}, len(ret.columns))
+		for i := range values {
+			scans[i] = &values[i]
+		}
+		if err := rows.Scan(scans...); err != nil {
+			return nil, err
+		}
+		ret.rows = append(ret.rows, values)
+	}
+	return ret, rows.Err()
+}
+
+// Serializes the result in the given format
+func formatResult(res *namedQueryResult, format string, opts csvOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case mimeCSV, mimeTSV:
+		err := writeCSV(&buf, res.columns, res.rows, opts)
+		return buf.Bytes(), err
+	case mimeNDJSON:
+		enc := json.NewEncoder(&buf)
+		for i := range res.rows {
+			if err := enc.Encode(res.row(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	list := make([]map[string]interface{}, len(res.rows))
+	for i := range res.rows {
+		list[i] = res.row(i)
+	}
+	return json.Marshal(list)
+}
+
+func namedQueryHandler(db *db) fiber.Handler {
+	statements := make(map[string]*storedStatement)
+	for i := range db.StoredStatement {
+		if db.StoredStatement[i].ExposeAsGet {
+			statements[db.StoredStatement[i].Id] = &db.StoredStatement[i]
+		}
+	}
+
+	return func(c *fiber.Ctx) error {
+		ss, ok := statements[c.Params("statement")]
+		if !ok {
+			return newWSError(-1, fiber.StatusNotFound, "stored statement '%s' not found", c.Params("statement"))
+		}
+
+		format := c.Accepts(fiber.MIMEApplicationJSON, mimeCSV, mimeTSV, mimeNDJSON, "application/ndjson")
+		switch format {
+		case "":
+			if err := columnarNotAcceptable(c); err != nil {
+				return err
+			}
+			return newWSError(-1, fiber.StatusNotAcceptable, "can only produce %s, %s, %s or %s", fiber.MIMEApplicationJSON, mimeCSV, mimeTSV, mimeNDJSON)
+		case "application/ndjson":
+			format = mimeNDJSON
+		}
+		opts, err := csvOptionsFor(c, db, format, false) // the query string has the parameters
+		if err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, err.Error())
+		}
+
+		values := queryValues(c, ss)
+		if len(ss.Params) > 0 {
+			if err := validateParams(ss, values); err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		res, err := func() (*namedQueryResult, error) {
+			db.Mutex.Lock()
+			defer db.Mutex.Unlock()
+
+			tx, err := db.DbConn.BeginTx(c.Context(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true})
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback() // always, it must not write
+
+			timeout := itemTimeout(db.MaxQueryTimeMs)
+			ctx, cancel := itemContext(c.Context(), timeout)
+			defer cancel()
+			res, err := runNamedQuery(ctx, tx, ss.Sql, values, db.Limits)
+			return res, checkTimeout(ctx, timeout, err)
+		}()
+		if _, ok := err.(timeoutError); ok {
+			return newWSError(-1, fiber.StatusGatewayTimeout, capitalize(err.Error()))
+		} else if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+
+		body, err := formatResult(res, format, opts)
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+		if db.Limits != nil && db.Limits.MaxResponseBytes > 0 && len(body) > db.Limits.MaxResponseBytes {
+			return newWSError(-1, fiber.StatusInternalServerError, "the response exceeds the maximum size (%d bytes)", db.Limits.MaxResponseBytes)
+		}
+
+		hash := sha256.Sum256(body)
+		etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(hash[:16]))
+		c.Set(fiber.HeaderETag, etag)
+		c.Set(fiber.HeaderVary, fiber.HeaderAccept)
+		if ss.CacheMaxAgeSec > 0 {
+			c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", ss.CacheMaxAgeSec))
+		} else {
+			c.Set(fiber.HeaderCacheControl, "no-cache")
+		}
+		if res.truncated {
+			c.Set(headerTruncated, "true")
+		}
+		if c.Get(fiber.HeaderIfNoneMatch) == etag {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		c.Set(fiber.HeaderContentType, format)
+		return c.Send(body)
+	}
+}
+
+// Registers the endpoint, if there are stored statements to serve
+func registerNamedQueries(db *db) {
+	for i := range db.StoredStatement {
+		if db.StoredStatement[i].ExposeAsGet {
+			handlers := append(endpointHandlers(db, "GET"), namedQueryHandler(db))
+			app.Get(fmt.Sprintf("/%s/q/:statement", db.Id), handlers...)
+			return
+		}
+	}
+}
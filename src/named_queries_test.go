@@ -0,0 +1,161 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestNamedQueriesSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+					"INSERT INTO T1 VALUES (1, 'ONE'), (2, 'TWO, \"2\"'), (3, NULL)",
+				},
+				Auth: &authr{
+					Mode: "INLINE",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "myUser",
+							Password: "myPassword",
+						},
+					},
+				},
+				StoredStatement: []storedStatement{
+					{
+						Id:          "BY_MIN_ID",
+						Sql:         "SELECT ID, VAL FROM T1 WHERE ID >= :min ORDER BY ID",
+						ExposeAsGet: true,
+						Params: []storedStatementParam{
+							{
+								Name:     "min",
+								Type:     "integer",
+								Required: true,
+							},
+						},
+						CacheMaxAgeSec: 60,
+					}, {
+						Id:          "DEL",
+						Sql:         "DELETE FROM T1 RETURNING ID",
+						ExposeAsGet: true,
+					}, {
+						Id:  "HIDDEN",
+						Sql: "SELECT 1",
+					},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func getNamedQuery(t *testing.T, path, accept, etag string) (int, string, *fiber.Response) {
+	agent := fiber.Get("http://localhost:12321"+path).BasicAuth("myUser", "myPassword")
+	if accept != "" {
+		agent.Set(fiber.HeaderAccept, accept)
+	}
+	if etag != "" {
+		agent.Set(fiber.HeaderIfNoneMatch, etag)
+	}
+	resp := fiber.AcquireResponse()
+	agent.SetResponse(resp)
+	code, body, errs := agent.String()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	return code, body, resp
+}
+
+func TestNamedQueries(t *testing.T) {
+	code, body, resp := getNamedQuery(t, "/test/q/BY_MIN_ID?min=2", "", "")
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &rows); err != nil || len(rows) != 2 || rows[0]["ID"] != 2.0 {
+		t.Errorf("wrong result: %s", body)
+	}
+	etag := string(resp.Header.Peek(fiber.HeaderETag))
+	if etag == "" || string(resp.Header.Peek(fiber.HeaderCacheControl)) != "private, max-age=60" {
+		t.Errorf("caching headers not set: %s", resp.Header.String())
+	}
+	fiber.ReleaseResponse(resp)
+
+	if code, _, _ = getNamedQuery(t, "/test/q/BY_MIN_ID?min=2", "", etag); code != 304 {
+		t.Errorf("expected 304, got %d", code)
+	}
+
+	code, body, _ = getNamedQuery(t, "/test/q/BY_MIN_ID?min=1", "text/csv", etag)
+	if code != 200 || body != "ID,VAL\n1,ONE\n2,\"TWO, \"\"2\"\"\"\n3,\n" {
+		t.Errorf("wrong CSV: %d %s", code, body)
+	}
+
+	code, body, _ = getNamedQuery(t, "/test/q/BY_MIN_ID?min=3", "application/x-ndjson", "")
+	if code != 200 || body != "{\"ID\":3,\"VAL\":null}\n" {
+		t.Errorf("wrong NDJSON: %d %s", code, body)
+	}
+
+	for path, err := range map[string]string{
+		"/test/q/BY_MIN_ID":         "parameter 'min' is required",
+		"/test/q/BY_MIN_ID?min=abc": "parameter 'min' must be an integer",
+		"/test/q/BY_MIN_ID?other=1": "parameter 'other' is not accepted",
+	} {
+		if code, body, _ = getNamedQuery(t, path, "", ""); code != 400 || !strings.Contains(body, err) {
+			t.Errorf("expected 400 with '%s', got %d: %s", err, code, body)
+		}
+	}
+
+	if code, _, _ = getNamedQuery(t, "/test/q/HIDDEN", "", ""); code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code, _, _ = getNamedQuery(t, "/test/q/BY_MIN_ID?min=1", "application/xml", ""); code != 406 {
+		t.Errorf("expected 406, got %d", code)
+	}
+
+	// doesn't write
+	if code, body, _ = getNamedQuery(t, "/test/q/DEL", "", ""); code != 200 {
+		t.Errorf("did not succeed: %s", body)
+	}
+	if code, body, _ = getNamedQuery(t, "/test/q/BY_MIN_ID?min=1", "", ""); code != 200 || strings.Count(body, "ID") != 3 {
+		t.Errorf("rows were deleted: %s", body)
+	}
+}
+
+func TestNamedQueriesUnauthorized(t *testing.T) {
+	code, _ := callAdmin("GET", "/test/q/BY_MIN_ID?min=1", "myUser", "wrong", t)
+	if code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+}
+
+func TestNamedQueriesTeardown(t *testing.T) {
+	Shutdown()
+}
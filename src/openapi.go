@@ -0,0 +1,321 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// An OpenAPI 3 document describing the POST endpoint of a db (and the stored
+// statements exposed as GET), served on GET /<db id>/openapi.json if an
+// "openApi" node is configured. If so
+// specified, each stored statement is described too, with the named parameters
+// found in its SQL; the annotations of the stored statements (description,
+// type of the parameters, example) are used to enrich it. The document is built
+// at startup, as the stored statements don't change.
+
+const openAPIVersion = "3.0.3"
+
+type jsonObject = map[string]interface{}
+
+// Schema of a parameter, with its constraints if declared
+func paramSchema(p *storedStatementParam) jsonObject {
+	ret := jsonObject{}
+	if p.Type != "" {
+		ret["type"] = p.Type
+	}
+	if p.Description != "" {
+		ret["description"] = p.Description
+	}
+	minKey, maxKey := "minimum", "maximum"
+	if p.Type == "string" {
+		minKey, maxKey = "minLength", "maxLength"
+	}
+	if p.Min != nil {
+		ret[minKey] = *p.Min
+	}
+	if p.Max != nil {
+		ret[maxKey] = *p.Max
+	}
+	if p.Pattern != "" {
+		ret["pattern"] = p.Pattern
+	}
+	if len(p.Enum) > 0 {
+		ret["enum"] = p.Enum
+	}
+	if p.Default != nil {
+		ret["default"] = p.Default
+	}
+	return ret
+}
+
+// Schema of a request item that calls a stored statement. If the parameters
+// are declared, only those are accepted.
+func storedStatementSchema(ss *storedStatement, includeSql bool) jsonObject {
+	values := jsonObject{"type": "object"}
+	props := jsonObject{}
+	if len(ss.Params) > 0 {
+		var required []string
+		for i := range ss.Params {
+			props[ss.Params[i].Name] = paramSchema(&ss.Params[i])
+			if ss.Params[i].Required && ss.Params[i].Default == nil {
+				required = append(required, ss.Params[i].Name)
+			}
+		}
+		values["additionalProperties"] = false
+		if len(required) > 0 {
+			values["required"] = required
+		}
+	} else {
+		for _, name := range sqlParams(ss.Sql) {
+			props[name] = jsonObject{}
+		}
+	}
+	values["properties"] = props
+	ref := []string{"#" + ss.Id}
+
+	ret := jsonObject{
+		"type":        "object",
+		"description": ss.Description,
+		"properties": jsonObject{
+			"query":       jsonObject{"type": "string", "enum": ref},
+			"statement":   jsonObject{"type": "string", "enum": ref},
+			"noFail":      jsonObject{"type": "boolean"},
+			"values":      values,
+			"valuesBatch": jsonObject{"type": "array", "items": values},
+		},
+	}
+	if includeSql {
+		ret["x-sql"] = ss.Sql
+	}
+	if ss.Description == "" {
+		ret["description"] = fmt.Sprintf("Stored statement %s", ss.Id)
+	}
+	if ss.Example != nil {
+		ret["example"] = jsonObject{"statement": ref[0], "values": ss.Example}
+	}
+	return ret
+}
+
+// Builds the document
+func buildOpenAPI(db *db) jsonObject {
+	cfg := db.OpenAPI
+
+	title := cfg.Title
+	if title == "" {
+		title = fmt.Sprintf("ws4sqlite - %s", db.Id)
+	}
+	version := cfg.Version
+	if version == "" {
+		version = "1.0.0"
+	}
+
+	crypto := jsonObject{
+		"type": "object",
+		"properties": jsonObject{
+			"password":         jsonObject{"type": "string"},
+			"fields":           jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+			"compressionLevel": jsonObject{"type": "integer"},
+		},
+	}
+	genericItem := jsonObject{
+		"type":        "object",
+		"description": "A query (returning a result set) or a statement; SQL, or the id of a stored statement prefixed by #",
+		"properties": jsonObject{
+			"query":       jsonObject{"type": "string"},
+			"statement":   jsonObject{"type": "string"},
+			"noFail":      jsonObject{"type": "boolean"},
+			"values":      jsonObject{"type": "object"},
+			"valuesBatch": jsonObject{"type": "array", "items": jsonObject{"type": "object"}},
+			"encoder":     jsonObject{"$ref": "#/components/schemas/Crypto"},
+			"decoder":     jsonObject{"$ref": "#/components/schemas/Crypto"},
+		},
+	}
+
+	schemas := jsonObject{
+		"Crypto":      crypto,
+		"RequestItem": genericItem,
+		"ResponseItem": jsonObject{
+			"type": "object",
+			"properties": jsonObject{
+				"success":          jsonObject{"type": "boolean"},
+				"rowsUpdated":      jsonObject{"type": "integer"},
+				"rowsUpdatedBatch": jsonObject{"type": "array", "items": jsonObject{"type": "integer"}},
+				"resultSet":        jsonObject{"type": "array", "items": jsonObject{"type": "object"}},
+				"error":            jsonObject{"type": "string"},
+				"truncated":        jsonObject{"type": "boolean"},
+			},
+		},
+		"Response": jsonObject{
+			"type": "object",
+			"properties": jsonObject{
+				"results": jsonObject{"type": "array", "items": jsonObject{"$ref": "#/components/schemas/ResponseItem"}},
+			},
+		},
+		"Error": jsonObject{
+			"type": "object",
+			"properties": jsonObject{
+				"reqIdx": jsonObject{"type": "integer"},
+				"error":  jsonObject{"type": "string"},
+			},
+		},
+	}
+
+	// The items can be the stored statements, and SQL if allowed
+	var items []interface{}
+	if cfg.StoredStatements {
+		for i := range db.StoredStatement {
+			name := "StoredStatement_" + db.StoredStatement[i].Id
+			schemas[name] = storedStatementSchema(&db.StoredStatement[i], cfg.IncludeSql)
+			items = append(items, jsonObject{"$ref": "#/components/schemas/" + name})
+		}
+	}
+	if !db.UseOnlyStoredStatements || len(items) == 0 {
+		items = append(items, jsonObject{"$ref": "#/components/schemas/RequestItem"})
+	}
+	requestProps := jsonObject{
+		"timeoutMs":   jsonObject{"type": "integer"},
+		"transaction": jsonObject{"type": "array", "items": jsonObject{"oneOf": items}},
+	}
+	schemas["Request"] = jsonObject{
+		"type":       "object",
+		"required":   []string{"transaction"},
+		"properties": requestProps,
+	}
+
+	errorResponse := func(desc string) jsonObject {
+		return jsonObject{
+			"description": desc,
+			"content":     jsonObject{"application/json": jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Error"}}},
+		}
+	}
+	post := jsonObject{
+		"summary":     "Executes a transaction",
+		"operationId": "transaction",
+		"requestBody": jsonObject{
+			"required": true,
+			"content":  jsonObject{"application/json": jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Request"}}},
+		},
+		"responses": jsonObject{
+			"200": jsonObject{
+				"description": "The results of the items of the transaction",
+				"content":     jsonObject{"application/json": jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Response"}}},
+			},
+			"400": errorResponse("The request is not valid"),
+			"500": errorResponse("An item failed, and the transaction was rolled back"),
+			"504": errorResponse("An item exceeded its timeout"),
+		},
+	}
+
+	components := jsonObject{"schemas": schemas}
+	if db.Auth != nil {
+		post["responses"].(jsonObject)["401"] = jsonObject{"description": "Not authorized"}
+		switch strings.ToUpper(db.Auth.Mode) {
+		case authModeInline:
+			requestProps["credentials"] = jsonObject{
+				"type": "object",
+				"properties": jsonObject{
+					"user":     jsonObject{"type": "string"},
+					"password": jsonObject{"type": "string"},
+				},
+			}
+			schemas["Request"].(jsonObject)["required"] = []string{"credentials", "transaction"}
+		case authModeHttp:
+			components["securitySchemes"] = jsonObject{"basicAuth": jsonObject{"type": "http", "scheme": "basic"}}
+			post["security"] = []interface{}{jsonObject{"basicAuth": []string{}}}
+		case authModeCert:
+			post["description"] = "Requires a client certificate"
+		}
+	}
+
+	paths := jsonObject{"/" + db.Id: jsonObject{"post": post}}
+
+	// The stored statements exposed as GET
+	for i := range db.StoredStatement {
+		ss := &db.StoredStatement[i]
+		if !ss.ExposeAsGet {
+			continue
+		}
+		params := []interface{}{}
+		for _, name := range sqlParams(ss.Sql) {
+			param := jsonObject{"name": name, "in": "query", "schema": jsonObject{}}
+			if p := ss.param(name); p != nil {
+				param["schema"] = paramSchema(p)
+				param["required"] = p.Required && p.Default == nil
+			}
+			params = append(params, param)
+		}
+		rows := jsonObject{"type": "array", "items": jsonObject{"type": "object"}}
+		get := jsonObject{
+			"summary":     fmt.Sprintf("Executes stored statement %s", ss.Id),
+			"description": ss.Description,
+			"operationId": "q_" + ss.Id,
+			"parameters":  params,
+			"responses": jsonObject{
+				"200": jsonObject{
+					"description": "The result set",
+					"content": jsonObject{
+						"application/json": jsonObject{"schema": rows},
+						mimeCSV:            jsonObject{"schema": jsonObject{"type": "string"}},
+						mimeNDJSON:         jsonObject{"schema": jsonObject{"type": "string"}},
+					},
+				},
+				"304": jsonObject{"description": "Not modified"},
+				"400": errorResponse("The parameters are not valid"),
+			},
+		}
+		if sec, ok := post["security"]; ok {
+			get["security"] = sec
+		}
+		paths[fmt.Sprintf("/%s/q/%s", db.Id, ss.Id)] = jsonObject{"get": get}
+	}
+
+	return jsonObject{
+		"openapi":    openAPIVersion,
+		"info":       jsonObject{"title": title, "version": version},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// Builds the document once, as it doesn't change
+func parseOpenAPI(db *db) {
+	doc, err := json.Marshal(buildOpenAPI(db))
+	if err != nil {
+		mllog.Fatalf("for db '%s', in building the OpenAPI document: %s", db.Id, err.Error())
+	}
+	db.OpenAPI.document = doc
+	mllog.StdOutf("  + Serving the OpenAPI document at /%s/openapi.json", db.Id)
+}
+
+// Registers the endpoint of the document, if so configured
+func registerOpenAPI(db *db) {
+	if db.OpenAPI == nil {
+		return
+	}
+
+	handlers := append(endpointHandlers(db, "GET"), func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(db.OpenAPI.document)
+	})
+	app.Get(fmt.Sprintf("/%s/openapi.json", db.Id), handlers...)
+}
@@ -0,0 +1,146 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSqlParams(t *testing.T) {
+	params := sqlParams("SELECT * FROM T WHERE A = :a AND B = @b_2 AND C = $c AND D = ':no' -- :nope\n AND E = :a /* @no */ AND F = [:x]")
+	if !reflect.DeepEqual(params, []string{"a", "b_2", "c"}) {
+		t.Errorf("wrong params: %v", params)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	defer Shutdown()
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+				},
+				Auth: &authr{
+					Mode: "HTTP",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "myUser",
+							Password: "myPassword",
+						},
+					},
+				},
+				UseOnlyStoredStatements: true,
+				StoredStatement: []storedStatement{
+					{
+						Id:          "INS",
+						Sql:         "INSERT INTO T1 VALUES (:id, :val)",
+						Description: "Inserts a value",
+						Params: []storedStatementParam{
+							{
+								Name:        "id",
+								Type:        "integer",
+								Description: "The id",
+							}, {
+								Name: "val",
+							},
+						},
+						Example: map[string]interface{}{
+							"id":  1,
+							"val": map[interface{}]interface{}{"nested": "yes"},
+						},
+					}, {
+						Id:  "SEL",
+						Sql: "SELECT * FROM T1",
+					},
+				},
+				OpenAPI: &openAPICfg{
+					Title:            "My API",
+					StoredStatements: true,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+
+	code, raw := callAdmin("GET", "/test/openapi.json", "myUser", "myPassword", t)
+	if code != 200 {
+		t.Errorf("openapi endpoint failed: %s", raw)
+		return
+	}
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Title string `json:"title"`
+		} `json:"info"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas         map[string]map[string]interface{} `json:"schemas"`
+			SecuritySchemes map[string]interface{}            `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Error(err)
+		return
+	}
+	if doc.OpenAPI != openAPIVersion || doc.Info.Title != "My API" || doc.Paths["/test"]["post"] == nil {
+		t.Errorf("wrong document: %s", raw)
+		return
+	}
+	if doc.Components.SecuritySchemes["basicAuth"] == nil {
+		t.Errorf("security scheme not found: %s", raw)
+	}
+	if _, ok := doc.Components.Schemas["StoredStatement_SEL"]; !ok {
+		t.Errorf("stored statement not found: %s", raw)
+	}
+
+	ins := doc.Components.Schemas["StoredStatement_INS"]
+	if ins == nil || ins["description"] != "Inserts a value" {
+		t.Errorf("wrong stored statement: %v", ins)
+		return
+	}
+	if _, ok := ins["x-sql"]; ok {
+		t.Errorf("the SQL is disclosed: %v", ins)
+	}
+	if sch := storedStatementSchema(&storedStatement{Id: "X", Sql: "SELECT 1"}, true); sch["x-sql"] != "SELECT 1" {
+		t.Errorf("the SQL is not included: %v", sch)
+	}
+	values := ins["properties"].(map[string]interface{})["values"].(map[string]interface{})["properties"].(map[string]interface{})
+	if len(values) != 2 || values["id"].(map[string]interface{})["type"] != "integer" {
+		t.Errorf("wrong params: %v", values)
+	}
+	example := ins["example"].(map[string]interface{})["values"].(map[string]interface{})
+	if example["val"].(map[string]interface{})["nested"] != "yes" {
+		t.Errorf("wrong example: %v", example)
+	}
+
+	// only stored statements, so the generic item is not allowed
+	items := doc.Components.Schemas["Request"]["properties"].(map[string]interface{})["transaction"].(map[string]interface{})["items"].(map[string]interface{})["oneOf"].([]interface{})
+	if len(items) != 2 {
+		t.Errorf("wrong items: %v", items)
+	}
+}
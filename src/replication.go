@@ -0,0 +1,556 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Statement-based replication. A primary with "changeFeed" enabled records each
+// statement that modifies the db (with its values) in a changelog table, in the
+// same transaction, and serves it with an admin endpoint. Every minute, the
+// changelog is pruned of the changes beyond "changeFeedRetention" (by default,
+// all but the last 100000).
+//
+// A replica ("replicaOf") starts from a snapshot of the primary, then polls the
+// changes after it, applies them in order and rejects the write requests. If it
+// falls behind the pruned changes, it starts again from a new snapshot.
+//
+// Being statement-based, non-deterministic SQL (e.g. RANDOM() or the current
+// time) gives different results on the replicas. The statements of the scheduled
+// tasks and of the migrations are not recorded: they must be configured on the
+// replicas too, or these must be bootstrapped again.
+
+const (
+	changelogTable      = "_ws4sqlite_changelog"
+	replicaStateTable   = "_ws4sqlite_replica"
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+
+	defaultReplicaPollIntervalMs = 1000
+	replicaSnapshotTimeout       = 10 * time.Minute
+
+	defaultChangeFeedMaxChanges = 100000
+
+	replicaStateDDL = "CREATE TABLE IF NOT EXISTS " + replicaStateTable + " (ID INTEGER PRIMARY KEY CHECK (ID = 1), SEQ INTEGER NOT NULL)"
+	// The last change ever recorded, also if pruned
+	lastChangeSeqSql = "SELECT seq FROM sqlite_sequence WHERE name = '" + changelogTable + "'"
+)
+
+type change struct {
+	Seq         int64                    `json:"seq"`
+	Timestamp   string                   `json:"timestamp"`
+	Sql         string                   `json:"sql"`
+	Values      map[string]interface{}   `json:"values,omitempty"`
+	ValuesBatch []map[string]interface{} `json:"valuesBatch,omitempty"`
+}
+
+type changesResponse struct {
+	Changes []change `json:"changes"`
+}
+
+// Checks the configuration of the change feed, and creates the changelog table.
+func parseChangeFeed(db *db) {
+	if db.Admin == nil {
+		mllog.Fatalf("for db '%s', the change feed needs the admin endpoints to be configured", db.Id)
+	}
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', the change feed is meaningless for a read only db", db.Id)
+	}
+	if db.ReplicaOf != nil {
+		mllog.Fatalf("for db '%s', a replica cannot serve a change feed", db.Id)
+	}
+	if _, err := db.DbConn.ExecContext(context.Background(), "CREATE TABLE IF NOT EXISTS "+changelogTable+
+		" (SEQ INTEGER PRIMARY KEY AUTOINCREMENT, TS TEXT, SQL TEXT, VALS TEXT, VALS_BATCH TEXT)"); err != nil {
+		mllog.Fatalf("for db '%s', in creating changelog table: %s", db.Id, err.Error())
+	}
+	mllog.StdOut("  + Serving a change feed for replicas")
+
+	if db.ChangeFeedRetention == nil {
+		db.ChangeFeedRetention = &retentionCfg{MaxChanges: defaultChangeFeedMaxChanges}
+	}
+	ret := db.ChangeFeedRetention
+	if ret.MaxChanges < 0 || ret.MaxAgeSec < 0 {
+		mllog.Fatalf("for db '%s', the retention of the change feed cannot be negative", db.Id)
+	}
+	if ret.MaxChanges == 0 && ret.MaxAgeSec == 0 {
+		return
+	}
+	if _, err := scheduler.AddFunc("@every 1m", func() {
+		if err := pruneChangelog(db); err != nil {
+			logError(logFields{"db": db.Id}, "in pruning the changelog of db '%s': %s", db.Id, err.Error())
+		}
+	}); err != nil {
+		mllog.Fatal(err.Error())
+	}
+	haySchedules = true
+	if ret.MaxChanges > 0 {
+		mllog.StdOutf("    - Keeping the last %d changes", ret.MaxChanges)
+	}
+	if ret.MaxAgeSec > 0 {
+		mllog.StdOutf("    - Keeping the changes of the last %d seconds", ret.MaxAgeSec)
+	}
+}
+
+// Deletes the changes beyond the retention
+func pruneChangelog(db *db) error {
+	ret := db.ChangeFeedRetention
+
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+
+	var upTo int64
+	if ret.MaxChanges > 0 {
+		if err := db.DbConn.QueryRowContext(context.Background(),
+			"SELECT IFNULL(MAX(SEQ), 0) FROM "+changelogTable).Scan(&upTo); err != nil {
+			return err
+		}
+		upTo -= int64(ret.MaxChanges)
+	}
+	if ret.MaxAgeSec > 0 {
+		// The changes are recorded in order of time, so the ones to delete are
+		// those before the first recent enough
+		limit := time.Now().Add(-time.Duration(ret.MaxAgeSec) * time.Second)
+		rows, err := db.DbConn.QueryContext(context.Background(),
+			"SELECT SEQ, TS FROM "+changelogTable+" WHERE SEQ > ? ORDER BY SEQ", upTo)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var seq int64
+			var ts string
+			if err := rows.Scan(&seq, &ts); err != nil {
+				rows.Close()
+				return err
+			}
+			if t, err := time.Parse(time.RFC3339Nano, ts); err == nil && t.After(limit) {
+				break
+			}
+			upTo = seq
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	if upTo <= 0 {
+		return nil
+	}
+
+	res, err := db.DbConn.ExecContext(context.Background(), "DELETE FROM "+changelogTable+" WHERE SEQ <= ?", upTo)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		shipWAL(db)
+	}
+	return nil
+}
+
+// Returns the sequence number of the last pruned change, 0 if none was pruned.
+// The replicas that need a change up to it must start from a new snapshot.
+func lastPrunedSeq(db *db) (int64, error) {
+	var oldest sql.NullInt64
+	if err := db.DbConn.QueryRowContext(context.Background(), "SELECT MIN(SEQ) FROM "+changelogTable).Scan(&oldest); err != nil {
+		return 0, err
+	}
+	if oldest.Valid {
+		return oldest.Int64 - 1, nil
+	}
+	// All pruned, or none recorded yet
+	return scanLastChangeSeq(db.DbConn.QueryRowContext(context.Background(), lastChangeSeqSql))
+}
+
+func scanLastChangeSeq(row *sql.Row) (int64, error) {
+	var seq int64
+	err := row.Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Returns the number of changes done by the connection so far, to know if
+// a query modified the db
+func totalChanges(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var ret int64
+	err := tx.QueryRowContext(ctx, "SELECT total_changes()").Scan(&ret)
+	return ret, err
+}
+
+func replicaWriteError(db *db) error {
+	return fmt.Errorf("this db is a read replica of %s, writes must be sent to the primary", db.ReplicaOf.Url)
+}
+
+// For the dbs that need to know if a query modified the db (primaries with a
+// change feed, and replicas), returns the number of changes so far; -1 otherwise.
+func changesBeforeQuery(db *db, ctx context.Context, tx *sql.Tx) (int64, error) {
+	if !db.ChangeFeed && db.ReplicaOf == nil {
+		return -1, nil
+	}
+	return totalChanges(ctx, tx)
+}
+
+// Called after a successful query. If it modified the db (e.g. with RETURNING),
+// on a primary it's recorded in the changelog, while on a replica it's an error.
+func afterQuery(db *db, ctx context.Context, tx *sql.Tx, before int64, sqll string, values map[string]interface{}) error {
+	if before < 0 {
+		return nil
+	}
+	after, err := totalChanges(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if after == before {
+		return nil
+	}
+	if db.ReplicaOf != nil {
+		return replicaWriteError(db)
+	}
+	return logChange(ctx, tx, sqll, values, nil)
+}
+
+// Records a statement in the changelog, in the same transaction
+func logChange(ctx context.Context, tx *sql.Tx, sqll string, values map[string]interface{}, valuesBatch []map[string]interface{}) error {
+	var vals, valsBatch interface{}
+	if len(values) > 0 {
+		bytes, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		vals = string(bytes)
+	}
+	if len(valuesBatch) > 0 {
+		bytes, err := json.Marshal(valuesBatch)
+		if err != nil {
+			return err
+		}
+		valsBatch = string(bytes)
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO "+changelogTable+" (TS, SQL, VALS, VALS_BATCH) VALUES (?, ?, ?, ?)",
+		time.Now().Format(time.RFC3339Nano), sqll, vals, valsBatch)
+	if err != nil {
+		return fmt.Errorf("in recording change: %s", err.Error())
+	}
+	return nil
+}
+
+// Admin endpoint that returns the changes after the given sequence number
+// ("after" parameter), in order; at most "limit" of them. If some of them were
+// pruned, it fails with 410 Gone.
+func changesHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		after := c.QueryInt("after", 0)
+		limit := c.QueryInt("limit", defaultChangesLimit)
+		if limit < 1 || limit > maxChangesLimit {
+			return newWSError(-1, fiber.StatusBadRequest, "Limit must be between 1 and %d", maxChangesLimit)
+		}
+
+		db.Mutex.Lock()
+		defer db.Mutex.Unlock()
+
+		if pruned, err := lastPrunedSeq(db); err != nil {
+			return err
+		} else if int64(after) < pruned {
+			return newWSError(-1, fiber.StatusGone, "The changes up to %d were pruned, a new snapshot is needed", pruned)
+		}
+
+		rows, err := db.DbConn.QueryContext(context.Background(),
+			"SELECT SEQ, TS, SQL, VALS, VALS_BATCH FROM "+changelogTable+" WHERE SEQ > ? ORDER BY SEQ LIMIT ?", after, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		ret := changesResponse{Changes: []change{}}
+		for rows.Next() {
+			var ch change
+			var vals, valsBatch sql.NullString
+			if err := rows.Scan(&ch.Seq, &ch.Timestamp, &ch.Sql, &vals, &valsBatch); err != nil {
+				return err
+			}
+			if vals.Valid {
+				if err := json.Unmarshal([]byte(vals.String), &ch.Values); err != nil {
+					return err
+				}
+			}
+			if valsBatch.Valid {
+				if err := json.Unmarshal([]byte(valsBatch.String), &ch.ValuesBatch); err != nil {
+					return err
+				}
+			}
+			ret.Changes = append(ret.Changes, ch)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return c.JSON(ret)
+	}
+}
+
+// Checks the configuration of the replica and prepares the table that tracks the
+// applied changes. Polling is started later, with replicate().
+func parseReplica(db *db) {
+	cfg := db.ReplicaOf
+	u, err := url.Parse(strings.TrimSuffix(cfg.Url, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		mllog.Fatalf("for db '%s', the URL of the primary is not valid: %s", db.Id, cfg.Url)
+	}
+	cfg.Url = u.String()
+	if cfg.PollIntervalMs < 0 {
+		mllog.Fatalf("for db '%s', the poll interval cannot be negative", db.Id)
+	}
+	if cfg.PollIntervalMs == 0 {
+		cfg.PollIntervalMs = defaultReplicaPollIntervalMs
+	}
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', a replica cannot be read only, it must apply the changes", db.Id)
+	}
+	if _, err := db.DbConn.ExecContext(context.Background(), replicaStateDDL); err != nil {
+		mllog.Fatalf("for db '%s', in creating replica table: %s", db.Id, err.Error())
+	}
+
+	cfg.Stop = make(chan struct{})
+
+	mllog.StdOutf("  + Replica of %s", cfg.Url)
+}
+
+// Polls the primary for changes, until stopped
+func replicate(db *db) {
+	cfg := db.ReplicaOf
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		select {
+		case <-cfg.Stop:
+			return
+		case <-time.After(time.Duration(cfg.PollIntervalMs) * time.Millisecond):
+		}
+
+		// fetches and applies the changes until there are no more
+		for {
+			n, err := pullChanges(db, client)
+			if err != nil {
+				logError(logFields{"db": db.Id}, "in replicating db '%s' from %s: %s", db.Id, cfg.Url, err.Error())
+				break
+			}
+			if n < defaultChangesLimit {
+				break
+			}
+		}
+	}
+}
+
+// Returns the sequence number of the last applied change, -1 if the replica
+// was never bootstrapped
+func replicaSeq(db *db) (int64, error) {
+	var seq int64
+	err := db.DbConn.QueryRowContext(context.Background(), "SELECT SEQ FROM "+replicaStateTable+" WHERE ID = 1").Scan(&seq)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return seq, err
+}
+
+// Downloads a snapshot of the primary and copies it over the replica. The
+// snapshot includes the changelog, from which the sequence number of the last
+// change is taken; it's then prepared for the replica before restoring it, so
+// that the new content and the sequence number are swapped in atomically.
+func bootstrapReplica(db *db) error {
+	cfg := db.ReplicaOf
+
+	req, err := http.NewRequest(http.MethodGet, cfg.Url+"/_admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Password)
+	}
+	res, err := (&http.Client{Timeout: replicaSnapshotTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned status %d for the snapshot", res.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp("", "ws4sqlite-replica-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, res.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	seq, err := prepareReplicaSnapshot(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("in preparing the snapshot: %s", err.Error())
+	}
+	if err := checkDbFile(tmp.Name(), "integrity_check"); err != nil {
+		return fmt.Errorf("the snapshot is not a valid database: %s", err.Error())
+	}
+
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+
+	if err := restoreInto(db, tmp.Name()); err != nil {
+		return fmt.Errorf("in restoring the snapshot: %s", err.Error())
+	}
+	restored(db)
+
+	logInfo(logFields{"db": db.Id}, "replica '%s' bootstrapped from a snapshot of %s, at change %d", db.Id, cfg.Url, seq)
+	return nil
+}
+
+// Replaces the changelog in the snapshot file with the state of the replica,
+// returning the sequence number of the last change.
+func prepareReplicaSnapshot(fname string) (int64, error) {
+	snap, err := sql.Open("sqlite", fname)
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Close()
+
+	tx, err := snap.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	seq, err := scanLastChangeSeq(tx.QueryRow(lastChangeSeqSql))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DROP TABLE IF EXISTS " + changelogTable); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(replicaStateDDL); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO "+replicaStateTable+" (ID, SEQ) VALUES (1, ?)", seq); err != nil {
+		return 0, err
+	}
+	return seq, tx.Commit()
+}
+
+// Fetches a page of changes and applies them in a transaction, along with the
+// sequence number of the last one. Returns the number of applied changes. If
+// the replica was never bootstrapped, or the changes it needs were pruned, it
+// bootstraps it instead.
+func pullChanges(db *db, client *http.Client) (int, error) {
+	cfg := db.ReplicaOf
+
+	db.Mutex.Lock()
+	seq, err := replicaSeq(db)
+	db.Mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if seq < 0 {
+		return 0, bootstrapReplica(db)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/_admin/changes?after=%d&limit=%d", cfg.Url, seq, defaultChangesLimit), nil)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Password)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusGone {
+		logWarn(logFields{"db": db.Id}, "replica '%s' is behind the changes kept by %s, bootstrapping it again", db.Id, cfg.Url)
+		return 0, bootstrapReplica(db)
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary returned status %d", res.StatusCode)
+	}
+	var changes changesResponse
+	if err := json.NewDecoder(res.Body).Decode(&changes); err != nil {
+		return 0, err
+	}
+	if len(changes.Changes) == 0 {
+		return 0, nil
+	}
+
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+
+	tx, err := db.DbConn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for i := range changes.Changes {
+		ch := changes.Changes[i]
+		if ch.Seq <= seq {
+			return 0, fmt.Errorf("change %d received out of order", ch.Seq)
+		}
+		if len(ch.ValuesBatch) > 0 {
+			_, err = processForExecBatch(context.Background(), tx, ch.Sql, ch.ValuesBatch)
+		} else {
+			_, err = processForExec(context.Background(), tx, ch.Sql, ch.Values)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("in applying change %d: %s", ch.Seq, err.Error())
+		}
+		seq = ch.Seq
+	}
+
+	if _, err := tx.Exec("INSERT OR REPLACE INTO "+replicaStateTable+" (ID, SEQ) VALUES (1, ?)", seq); err != nil {
+		return 0, err
+	}
+	events, err := collectChangeEvents(context.Background(), tx, db)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	shipWAL(db)
+	publishChanges(db, events)
+	for i := range changes.Changes {
+		if mayChangeSchema(changes.Changes[i].Sql) {
+			schemaChanged(db)
+			break
+		}
+	}
+	return len(changes.Changes), nil
+}
@@ -0,0 +1,314 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReplicaSetup(t *testing.T) {
+	initStatements := []string{
+		"CREATE TABLE T1 (ID INT PRIMARY KEY, VAL TEXT NOT NULL)",
+	}
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "primary",
+				Path:           ":memory:",
+				InitStatements: initStatements,
+				StoredStatement: []storedStatement{
+					{
+						Id:  "INS",
+						Sql: "INSERT INTO T1 VALUES (:ID, :VAL)",
+					},
+				},
+				ChangeFeed: true,
+				ChangeFeedRetention: &retentionCfg{
+					MaxChanges: 2,
+				},
+				Admin: &authr{
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "admin",
+							Password: "secret",
+						},
+					},
+				},
+			},
+			{
+				// no schema: it's bootstrapped from a snapshot of the primary
+				Id:   "replica",
+				Path: ":memory:",
+				ReplicaOf: &replicaCfg{
+					Url:            "http://localhost:12321/primary/",
+					User:           "admin",
+					Password:       "secret",
+					PollIntervalMs: 100,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestReplicaFollowsPrimary(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (1, 'ONE')",
+			},
+			{
+				Statement: "#INS",
+				Values: mkRaw(map[string]interface{}{
+					"ID":  2,
+					"VAL": "TWO",
+				}),
+			},
+			{
+				Statement: "INSERT INTO T1 VALUES (:ID, :VAL)",
+				ValuesBatch: []map[string]json.RawMessage{
+					mkRaw(map[string]interface{}{
+						"ID":  3,
+						"VAL": "THREE",
+					}),
+					mkRaw(map[string]interface{}{
+						"ID":  4,
+						"VAL": "FOUR",
+					}),
+				},
+			},
+			{
+				// not recorded, as it fails
+				NoFail:    true,
+				Statement: "INSERT INTO T1 VALUES (1, 'DUPE')",
+			},
+			{
+				Query: "UPDATE T1 SET VAL = 'UNO' WHERE ID = 1 RETURNING *",
+			},
+			{
+				Query: "SELECT * FROM T1",
+			},
+		},
+	}
+	code, body, _ := call("primary", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	// a failed transaction is not recorded
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (5, 'FIVE')",
+			},
+			{
+				Statement: "INSERT INTO NOPE VALUES (1)",
+			},
+		},
+	}
+	code, _, _ = call("primary", req, t)
+	if code != 500 {
+		t.Error("did succeed, but shouldn't have")
+	}
+
+	code, raw := callAdmin("GET", "/primary/_admin/changes?after=1", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("changes endpoint failed: %s", raw)
+		return
+	}
+	var changes changesResponse
+	if err := json.Unmarshal(raw, &changes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(changes.Changes) != 3 || changes.Changes[0].Seq != 2 || changes.Changes[0].Sql != "INSERT INTO T1 VALUES (:ID, :VAL)" {
+		t.Errorf("wrong changes: %s", raw)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM T1 ORDER BY ID",
+			},
+		},
+	}
+	code, body, res := call("replica", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	rs := res.Results[0].ResultSet
+	if len(rs) != 4 {
+		t.Errorf("expected 4 replicated rows, found %d", len(rs))
+		return
+	}
+	if rs[0]["VAL"] != "UNO" || rs[3]["VAL"] != "FOUR" {
+		t.Errorf("wrong replicated rows: %v", rs)
+	}
+}
+
+func TestReplicaRejectsWrites(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (10, 'TEN')",
+			},
+		},
+	}
+	code, _, _ := call("replica", req, t)
+	if code != 403 {
+		t.Errorf("expected 403, got %d", code)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "DELETE FROM T1 RETURNING *",
+			},
+		},
+	}
+	code, _, _ = call("replica", req, t)
+	if code != 403 {
+		t.Errorf("expected 403, got %d", code)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(1) AS C FROM T1",
+			},
+		},
+	}
+	code, body, res := call("replica", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	if res.Results[0].ResultSet[0]["C"] != 4.0 {
+		t.Errorf("the replica was modified: %v", res.Results[0].ResultSet)
+	}
+}
+
+func TestReplicaBootstrap(t *testing.T) {
+	primary := dbs["primary"]
+	if err := pruneChangelog(&primary); err != nil {
+		t.Error(err)
+		return
+	}
+
+	code, raw := callAdmin("GET", "/primary/_admin/changes?after=1", "admin", "secret", t)
+	if code != 410 {
+		t.Errorf("expected 410, got %d: %s", code, raw)
+	}
+	code, raw = callAdmin("GET", "/primary/_admin/changes?after=2", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("changes endpoint failed: %s", raw)
+		return
+	}
+	var changes changesResponse
+	if err := json.Unmarshal(raw, &changes); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(changes.Changes) != 2 || changes.Changes[0].Seq != 3 {
+		t.Errorf("wrong changes: %s", raw)
+	}
+
+	// the replica now needs a pruned change, so it takes a new snapshot
+	replica := dbs["replica"]
+	replica.Mutex.Lock()
+	_, err := replica.DbConn.ExecContext(context.Background(), "UPDATE "+replicaStateTable+" SET SEQ = 1")
+	replica.Mutex.Unlock()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (5, 'FIVE')",
+			},
+		},
+	}
+	code, body, _ := call("primary", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	time.Sleep(time.Second)
+
+	replica.Mutex.Lock()
+	seq, err := replicaSeq(&replica)
+	replica.Mutex.Unlock()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if seq != 5 {
+		t.Errorf("expected the replica at change 5, found %d", seq)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(1) AS C FROM T1",
+			},
+			{
+				Query: "SELECT COUNT(1) AS C FROM sqlite_master WHERE name = '" + changelogTable + "'",
+			},
+		},
+	}
+	code, body, res := call("replica", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	if res.Results[0].ResultSet[0]["C"] != 5.0 {
+		t.Errorf("wrong replicated rows: %v", res.Results[0].ResultSet)
+	}
+	if res.Results[1].ResultSet[0]["C"] != 0.0 {
+		t.Error("the changelog of the primary was kept in the replica")
+	}
+}
+
+func TestReplicaChangesAuth(t *testing.T) {
+	code, _ := callAdmin("GET", "/primary/_admin/changes", "admin", "wrong", t)
+	if code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+
+	code, _ = callAdmin("GET", "/primary/_admin/changes?limit=0", "admin", "secret", t)
+	if code != 400 {
+		t.Errorf("expected 400, got %d", code)
+	}
+}
+
+func TestReplicaTeardown(t *testing.T) {
+	Shutdown()
+}
@@ -0,0 +1,603 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// CRUD resources for the tables, under /<db id>/tables/<table>[/<pk>], if a
+// "rest" node is configured:
+//
+//   - GET lists the rows, with filters (?col=op.value, op being one of eq, neq,
+//     gt, gte, lt, lte, like, in - with comma separated values - and is - with
+//     null or notnull), column selection (?select=col1,col2), sorting
+//     (?order=col1.desc,col2) and pagination (?limit=&offset=); or returns
+//     the row with that primary key;
+//   - POST inserts the row (or the array of rows) in the body;
+//   - PATCH updates the row with that primary key, or the ones that match the
+//     filters, with the values in the body;
+//   - DELETE deletes the row with that primary key, or the ones that match the
+//     filters.
+//
+// Composite primary keys are given comma separated, in the order of the key;
+// tables without one use the rowid. The written rows are returned. Tables are
+// taken from the schema at startup; views can only be read.
+
+const (
+	restOpRead   = "read"
+	restOpCreate = "create"
+	restOpUpdate = "update"
+	restOpDelete = "delete"
+
+	defaultRestLimit    = 100
+	defaultRestMaxLimit = 1000
+)
+
+var restOps = []string{restOpRead, restOpCreate, restOpUpdate, restOpDelete}
+
+var restFilterOps = map[string]string{
+	"eq":   "=",
+	"neq":  "<>",
+	"gt":   ">",
+	"gte":  ">=",
+	"lt":   "<",
+	"lte":  "<=",
+	"like": "LIKE",
+}
+
+var restReservedParams = map[string]bool{"select": true, "order": true, "limit": true, "offset": true}
+
+type restTable struct {
+	name    string
+	pk      []string // "rowid" if the table has no primary key
+	columns map[string]bool
+	ops     map[string]bool
+}
+
+// What's returned for the written rows; rowid is explicitly added if it's the key
+func (t *restTable) returning() string {
+	if len(t.pk) == 1 && t.pk[0] == "rowid" {
+		return "rowid, *"
+	}
+	return "*"
+}
+
+func (t *restTable) hasColumn(col string) bool {
+	return t.columns[col] || (len(t.pk) == 1 && t.pk[0] == "rowid" && col == "rowid")
+}
+
+// Reads the schema and builds the resources for the configured tables (or for
+// all of them), with the allowed operations.
+func parseRest(db *db) {
+	cfg := db.Rest
+	if cfg.DefaultLimit < 0 || cfg.MaxLimit < 0 {
+		mllog.Fatalf("for db '%s', rest limits cannot be negative", db.Id)
+	}
+	if cfg.MaxLimit == 0 {
+		cfg.MaxLimit = defaultRestMaxLimit
+	}
+	if cfg.DefaultLimit == 0 {
+		cfg.DefaultLimit = defaultRestLimit
+		if cfg.DefaultLimit > cfg.MaxLimit {
+			cfg.DefaultLimit = cfg.MaxLimit
+		}
+	}
+	if cfg.DefaultLimit > cfg.MaxLimit {
+		mllog.Fatalf("for db '%s', rest default limit cannot exceed the max limit", db.Id)
+	}
+	if db.UseOnlyStoredStatements && len(cfg.Tables) == 0 {
+		mllog.Fatalf("for db '%s', using only stored statements, the rest tables must be listed explicitly", db.Id)
+	}
+
+	// The audit log and the task history are not exposed, not to be tampered with
+	schema, err := readSchema(context.Background(), db.DbConn, func(table string) bool { return !isOwnTable(db, table) })
+	if err != nil {
+		mllog.Fatalf("for db '%s', in reading the schema for rest: %s", db.Id, err.Error())
+	}
+	available := make(map[string]*restTable)
+	for _, tbl := range schema.Tables {
+		rt := &restTable{name: tbl.Name, columns: make(map[string]bool), ops: make(map[string]bool)}
+		pk := make(map[int]string)
+		for _, col := range tbl.Columns {
+			rt.columns[col.Name] = true
+			if col.PrimaryKey > 0 {
+				pk[col.PrimaryKey] = col.Name
+			}
+		}
+		for i := 1; i <= len(pk); i++ {
+			rt.pk = append(rt.pk, pk[i])
+		}
+		if len(rt.pk) == 0 {
+			rt.pk = []string{"rowid"}
+		}
+		for _, op := range restOps {
+			rt.ops[op] = true
+		}
+		available[tbl.Name] = rt
+	}
+	for _, view := range schema.Views {
+		rt := &restTable{name: view.Name, columns: make(map[string]bool), ops: map[string]bool{restOpRead: true}}
+		for _, col := range view.Columns {
+			rt.columns[col.Name] = true
+		}
+		available[view.Name] = rt
+	}
+
+	db.RestTables = make(map[string]*restTable)
+	if len(cfg.Tables) == 0 {
+		db.RestTables = available
+	}
+	for i := range cfg.Tables {
+		tc := cfg.Tables[i]
+		rt, ok := available[tc.Name]
+		if !ok {
+			mllog.Fatalf("for db '%s', rest table '%s' does not exist", db.Id, tc.Name)
+		}
+		if len(tc.Operations) > 0 {
+			ops := make(map[string]bool)
+			for _, op := range tc.Operations {
+				op = strings.ToLower(op)
+				if !contains(restOps, op) {
+					mllog.Fatalf("for db '%s', rest operation must be one of %s", db.Id, strings.Join(restOps, ", "))
+				}
+				if !rt.ops[op] {
+					mllog.Fatalf("for db '%s', rest operation '%s' is not possible on view '%s'", db.Id, op, tc.Name)
+				}
+				ops[op] = true
+			}
+			rt.ops = ops
+		}
+		db.RestTables[tc.Name] = rt
+	}
+
+	// Only reads on a read only db or on a replica
+	if db.ReadOnly || db.ReplicaOf != nil {
+		for _, rt := range db.RestTables {
+			rt.ops = map[string]bool{restOpRead: rt.ops[restOpRead]}
+		}
+	}
+
+	mllog.StdOutf("  + Serving %d tables as REST resources at /%s/tables", len(db.RestTables), db.Id)
+}
+
+// Runs f in a transaction, with the same machinery of handler(): serialized,
+// with the change events published and the WAL shipped after the commit, the
+// changes recorded for the replicas and the audit trail (that f fills) written
+// when the transaction is finalized. f returns the status and the body (if any)
+// of the response, that is sent only if the commit succeeds.
+func withTransaction(c *fiber.Ctx, db *db, f func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (int, interface{}, error)) error {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+
+	var ctx context.Context = c.Context()
+
+	tx, err := db.DbConn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: db.ReadOnly})
+	if err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+
+	audit := newAuditTrail(db, c, &request{})
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+		audit.flush(db, committed)
+		shipWAL(db)
+	}()
+
+	status, body, err := f(ctx, tx, audit)
+	if err != nil {
+		return err
+	}
+
+	events, err := collectChangeEvents(ctx, tx, db)
+	if err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, "in collecting change events: %s", err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	committed = true
+	publishChanges(db, events)
+
+	if body == nil {
+		return c.SendStatus(status)
+	}
+	return c.Status(status).JSON(body)
+}
+
+// Accumulates the named parameters of a statement, with the column they refer
+// to (if any), so that the audit log can redact them
+type restParams struct {
+	values  map[string]interface{}
+	columns map[string]string
+}
+
+func newRestParams() *restParams {
+	return &restParams{values: make(map[string]interface{}), columns: make(map[string]string)}
+}
+
+func (p *restParams) add(col string, val interface{}) string {
+	name := fmt.Sprint("p", len(p.values))
+	p.values[name] = val
+	p.columns[name] = col
+	return ":" + name
+}
+
+// The values as recorded in the audit log, with the ones of the redacted columns hidden
+func (p *restParams) audited(audit *auditTrail) map[string]interface{} {
+	if audit == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(p.values))
+	for name, val := range p.values {
+		if audit.cfg.Redacted[p.columns[name]] {
+			ret[name] = redactedValue
+		} else {
+			ret[name] = val
+		}
+	}
+	return ret
+}
+
+// Builds the WHERE clause for the primary key, or for the filters
+func restWhere(c *fiber.Ctx, table *restTable, params *restParams) (string, error) {
+	var conds []string
+
+	if pkStr := c.Params("pk"); pkStr != "" {
+		pkVals := strings.Split(pkStr, ",")
+		if len(pkVals) != len(table.pk) {
+			return "", fmt.Errorf("the primary key has %d columns", len(table.pk))
+		}
+		for i := range table.pk {
+			conds = append(conds, quoteIdentifier(table.pk[i])+" = "+params.add(table.pk[i], pkVals[i]))
+		}
+		return " WHERE " + strings.Join(conds, " AND "), nil
+	}
+
+	var err error
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		col := string(key)
+		if err != nil || restReservedParams[col] {
+			return
+		}
+		if !table.hasColumn(col) {
+			err = fmt.Errorf("column '%s' not found", col)
+			return
+		}
+		op, val, _ := strings.Cut(string(value), ".")
+		switch {
+		case restFilterOps[op] != "":
+			conds = append(conds, quoteIdentifier(col)+" "+restFilterOps[op]+" "+params.add(col, val))
+		case op == "in":
+			var placeholders []string
+			for _, v := range strings.Split(val, ",") {
+				placeholders = append(placeholders, params.add(col, v))
+			}
+			conds = append(conds, quoteIdentifier(col)+" IN ("+strings.Join(placeholders, ", ")+")")
+		case op == "is" && val == "null":
+			conds = append(conds, quoteIdentifier(col)+" IS NULL")
+		case op == "is" && val == "notnull":
+			conds = append(conds, quoteIdentifier(col)+" IS NOT NULL")
+		default:
+			err = fmt.Errorf("filter for column '%s' is not valid: %s", col, value)
+		}
+	})
+	if err != nil || len(conds) == 0 {
+		return "", err
+	}
+	return " WHERE " + strings.Join(conds, " AND "), nil
+}
+
+func restSelect(c *fiber.Ctx, table *restTable) (string, error) {
+	sel := c.Query("select")
+	if sel == "" {
+		return table.returning(), nil
+	}
+	var cols []string
+	for _, col := range strings.Split(sel, ",") {
+		if !table.hasColumn(col) {
+			return "", fmt.Errorf("column '%s' not found", col)
+		}
+		cols = append(cols, quoteIdentifier(col))
+	}
+	return strings.Join(cols, ", "), nil
+}
+
+func restOrderAndPage(c *fiber.Ctx, db *db, table *restTable, params *restParams) (string, error) {
+	ret := ""
+	if order := c.Query("order"); order != "" {
+		var terms []string
+		for _, term := range strings.Split(order, ",") {
+			col, dir, _ := strings.Cut(term, ".")
+			if !table.hasColumn(col) {
+				return "", fmt.Errorf("column '%s' not found", col)
+			}
+			switch strings.ToLower(dir) {
+			case "", "asc":
+				terms = append(terms, quoteIdentifier(col)+" ASC")
+			case "desc":
+				terms = append(terms, quoteIdentifier(col)+" DESC")
+			default:
+				return "", fmt.Errorf("order direction must be asc or desc: %s", dir)
+			}
+		}
+		ret = " ORDER BY " + strings.Join(terms, ", ")
+	}
+
+	limit, offset := db.Rest.DefaultLimit, 0
+	var err error
+	if l := c.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > db.Rest.MaxLimit {
+			return "", fmt.Errorf("limit must be between 1 and %d", db.Rest.MaxLimit)
+		}
+	}
+	if o := c.Query("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			return "", errors.New("offset must be a non-negative number")
+		}
+	}
+	return ret + " LIMIT " + params.add("", limit) + " OFFSET " + params.add("", offset), nil
+}
+
+// Parses the body of a POST or PATCH, as a row or (if allowed) an array of rows
+func restBody(c *fiber.Ctx, table *restTable, allowArray bool) ([]map[string]interface{}, bool, error) {
+	body := c.Body()
+	var rows []map[string]json.RawMessage
+	isArray := len(body) > 0 && body[0] == '['
+	if isArray {
+		if !allowArray {
+			return nil, false, errors.New("body must be an object")
+		}
+		if err := json.Unmarshal(body, &rows); err != nil {
+			return nil, false, fmt.Errorf("in parsing body: %s", err.Error())
+		}
+	} else {
+		var row map[string]json.RawMessage
+		if err := json.Unmarshal(body, &row); err != nil {
+			return nil, false, fmt.Errorf("in parsing body: %s", err.Error())
+		}
+		rows = append(rows, row)
+	}
+
+	var ret []map[string]interface{}
+	for i := range rows {
+		for col := range rows[i] {
+			if !table.columns[col] {
+				return nil, false, fmt.Errorf("column '%s' not found", col)
+			}
+		}
+		vals, err := raw2vals(rows[i])
+		if err != nil {
+			return nil, false, fmt.Errorf("in parsing body: %s", err.Error())
+		}
+		ret = append(ret, vals)
+	}
+	return ret, isArray, nil
+}
+
+// Executes a statement that returns rows, with the timeout and the limits of the
+// db, recording it for the replicas if it's a write, in the audit trail and, if
+// it's slow, in the slow query log. reqIdx is the index of the row, for the
+// inserts of more rows.
+func restExec(ctx context.Context, c *fiber.Ctx, tx *sql.Tx, db *db, audit *auditTrail, reqIdx int, sqll string, params *restParams, write bool) ([]map[string]interface{}, error) {
+	timeout := itemTimeout(db.MaxQueryTimeMs)
+	ctx, cancel := itemContext(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	respBytes := 0
+	res, err := processWithResultSet(ctx, tx, sqll, nil, params.values, db.Limits, &respBytes)
+	if err == nil && res.Truncated {
+		c.Set(headerTruncated, "true")
+	}
+	if err == nil && write && db.ChangeFeed {
+		err = logChange(ctx, tx, sqll, params.values, nil)
+	}
+	if err != nil {
+		err = checkTimeout(ctx, timeout, err)
+	} else if write {
+		rows := int64(len(res.ResultSet))
+		res.RowsUpdated = &rows
+	}
+	audit.add(reqIdx, sqll, !write, params.audited(audit), nil, res, err)
+	checkSlowQuery(db, c, reqIdx, sqll, start, res, err)
+
+	if err != nil {
+		if _, ok := err.(timeoutError); ok {
+			return nil, newWSError(-1, fiber.StatusGatewayTimeout, capitalize(err.Error()))
+		}
+		return nil, newWSError(-1, fiber.StatusInternalServerError, err.Error())
+	}
+	return res.ResultSet, nil
+}
+
+// The handler for all the methods of the resources
+func restHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		table, ok := db.RestTables[c.Params("table")]
+		if !ok {
+			return newWSError(-1, fiber.StatusNotFound, "table '%s' not found", c.Params("table"))
+		}
+		hasPk := c.Params("pk") != ""
+
+		var op string
+		switch c.Method() {
+		case fiber.MethodGet:
+			op = restOpRead
+		case fiber.MethodPost:
+			op = restOpCreate
+			if hasPk {
+				return newWSError(-1, fiber.StatusMethodNotAllowed, "cannot POST to a row")
+			}
+		case fiber.MethodPatch:
+			op = restOpUpdate
+		case fiber.MethodDelete:
+			op = restOpDelete
+		}
+		if !table.ops[op] {
+			return newWSError(-1, fiber.StatusMethodNotAllowed, "operation '%s' is not allowed on table '%s'", op, table.name)
+		}
+
+		if (op == restOpCreate || op == restOpUpdate) && db.Limits != nil && db.Limits.MaxRequestBytes > 0 && len(c.Body()) > db.Limits.MaxRequestBytes {
+			return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the request exceeds the maximum size (%d bytes)", db.Limits.MaxRequestBytes)
+		}
+
+		params := newRestParams()
+		where, err := restWhere(c, table, params)
+		if err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, err.Error())
+		}
+		if (op == restOpUpdate || op == restOpDelete) && where == "" {
+			return newWSError(-1, fiber.StatusBadRequest, "a primary key or at least a filter is needed to %s", op)
+		}
+
+		tableName := quoteIdentifier(table.name)
+
+		switch op {
+		case restOpRead:
+			sel, err := restSelect(c, table)
+			if err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+			page := ""
+			if !hasPk {
+				if page, err = restOrderAndPage(c, db, table, params); err != nil {
+					return newWSError(-1, fiber.StatusBadRequest, err.Error())
+				}
+			}
+			return withTransaction(c, db, func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (int, interface{}, error) {
+				rows, err := restExec(ctx, c, tx, db, audit, 0, "SELECT "+sel+" FROM "+tableName+where+page, params, false)
+				if err != nil {
+					return 0, nil, err
+				}
+				if !hasPk {
+					return fiber.StatusOK, rows, nil
+				}
+				if len(rows) == 0 {
+					return 0, nil, newWSError(-1, fiber.StatusNotFound, "row not found")
+				}
+				return fiber.StatusOK, rows[0], nil
+			})
+
+		case restOpCreate:
+			rows, isArray, err := restBody(c, table, true)
+			if err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+			if db.Limits != nil && db.Limits.MaxBatchLength > 0 && len(rows) > db.Limits.MaxBatchLength {
+				return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the rows exceed the maximum batch length (%d)", db.Limits.MaxBatchLength)
+			}
+			return withTransaction(c, db, func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (int, interface{}, error) {
+				ret := []map[string]interface{}{}
+				for i := range rows {
+					params := newRestParams()
+					var cols, vals []string
+					for col, val := range rows[i] {
+						cols = append(cols, quoteIdentifier(col))
+						vals = append(vals, params.add(col, val))
+					}
+					sqll := "INSERT INTO " + tableName + " DEFAULT VALUES"
+					if len(cols) > 0 {
+						sqll = "INSERT INTO " + tableName + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(vals, ", ") + ")"
+					}
+					inserted, err := restExec(ctx, c, tx, db, audit, i, sqll+" RETURNING "+table.returning(), params, true)
+					if err != nil {
+						return 0, nil, err
+					}
+					ret = append(ret, inserted...)
+				}
+				if isArray {
+					return fiber.StatusCreated, ret, nil
+				}
+				return fiber.StatusCreated, ret[0], nil
+			})
+
+		case restOpUpdate:
+			rows, _, err := restBody(c, table, false)
+			if err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+			if len(rows[0]) == 0 {
+				return newWSError(-1, fiber.StatusBadRequest, "no columns to update")
+			}
+			var sets []string
+			for col, val := range rows[0] {
+				sets = append(sets, quoteIdentifier(col)+" = "+params.add(col, val))
+			}
+			return withTransaction(c, db, func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (int, interface{}, error) {
+				updated, err := restExec(ctx, c, tx, db, audit, 0, "UPDATE "+tableName+" SET "+strings.Join(sets, ", ")+where+" RETURNING "+table.returning(), params, true)
+				if err != nil {
+					return 0, nil, err
+				}
+				if !hasPk {
+					return fiber.StatusOK, updated, nil
+				}
+				if len(updated) == 0 {
+					return 0, nil, newWSError(-1, fiber.StatusNotFound, "row not found")
+				}
+				return fiber.StatusOK, updated[0], nil
+			})
+
+		default: // restOpDelete
+			return withTransaction(c, db, func(ctx context.Context, tx *sql.Tx, audit *auditTrail) (int, interface{}, error) {
+				deleted, err := restExec(ctx, c, tx, db, audit, 0, "DELETE FROM "+tableName+where+" RETURNING "+table.returning(), params, true)
+				if err != nil {
+					return 0, nil, err
+				}
+				if !hasPk {
+					return fiber.StatusOK, deleted, nil
+				}
+				if len(deleted) == 0 {
+					return 0, nil, newWSError(-1, fiber.StatusNotFound, "row not found")
+				}
+				return fiber.StatusNoContent, nil, nil
+			})
+		}
+	}
+}
+
+// Registers the resources, if so configured
+func registerRest(db *db) {
+	if db.Rest == nil {
+		return
+	}
+
+	handlers := append(endpointHandlers(db, "GET,POST,PATCH,DELETE"), restHandler(db))
+	for _, path := range []string{"/%s/tables/:table", "/%s/tables/:table/:pk"} {
+		path = fmt.Sprintf(path, db.Id)
+		app.Get(path, handlers...)
+		app.Post(path, handlers...)
+		app.Patch(path, handlers...)
+		app.Delete(path, handlers...)
+		if db.CORSOrigin != "" {
+			app.Options(path, handlers...)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRestSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT, NUM INTEGER)",
+					"CREATE TABLE T2 (A INTEGER, B TEXT, VAL TEXT, PRIMARY KEY (A, B))",
+					"CREATE TABLE T3 (VAL TEXT)",
+					"CREATE VIEW V1 AS SELECT ID, VAL FROM T1",
+				},
+				Auth: &authr{
+					Mode: "HTTP",
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "myUser",
+							Password: "myPassword",
+						},
+					},
+				},
+				Rest: &restCfg{},
+			},
+			{
+				Id:   "limited",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+					"CREATE TABLE T2 (ID INTEGER PRIMARY KEY)",
+					"INSERT INTO T1 VALUES (1, 'ONE')",
+				},
+				Rest: &restCfg{
+					Tables: []restTableCfg{
+						{
+							Name:       "T1",
+							Operations: []string{"read"},
+						},
+					},
+				},
+			},
+			{
+				Id:   "audited",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, SECRET TEXT)",
+					"CREATE VIEW SLOW AS " + slowQuery1M,
+				},
+				Audit: &auditCfg{
+					ToTable:        "AUDIT_LOG",
+					IncludeQueries: true,
+					RedactFields:   []string{"SECRET"},
+				},
+				SlowQueryThresholdMs: 1,
+				Limits: &limitsCfg{
+					MaxBatchLength: 1,
+					MaxResultRows:  2,
+					Truncate:       true,
+				},
+				Rest: &restCfg{},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func callRest(method, path, body string, t *testing.T) (int, interface{}) {
+	client := &fiber.Client{}
+	url := "http://localhost:12321" + path
+	var agent *fiber.Agent
+	switch method {
+	case fiber.MethodPost:
+		agent = client.Post(url)
+	case fiber.MethodPatch:
+		agent = client.Patch(url)
+	case fiber.MethodDelete:
+		agent = client.Delete(url)
+	default:
+		agent = client.Get(url)
+	}
+	agent = agent.BasicAuth("myUser", "myPassword")
+	if body != "" {
+		agent = agent.ContentType("application/json").BodyString(body)
+	}
+	code, raw, errs := agent.Bytes()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+		return 0, nil
+	}
+	var ret interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &ret); err != nil {
+			t.Errorf("%s: %s", err.Error(), raw)
+		}
+	}
+	return code, ret
+}
+
+func TestRestCRUD(t *testing.T) {
+	code, res := callRest("POST", "/test/tables/T1", `{"ID": 1, "VAL": "ONE", "NUM": 10}`, t)
+	if code != 201 || res.(map[string]interface{})["VAL"] != "ONE" {
+		t.Errorf("insert failed: %d %v", code, res)
+		return
+	}
+	code, res = callRest("POST", "/test/tables/T1", `[{"VAL": "TWO", "NUM": 20}, {"VAL": "THREE", "NUM": 30}]`, t)
+	if code != 201 || len(res.([]interface{})) != 2 || res.([]interface{})[1].(map[string]interface{})["ID"] != 3.0 {
+		t.Errorf("batch insert failed: %d %v", code, res)
+		return
+	}
+
+	code, res = callRest("GET", "/test/tables/T1/2", "", t)
+	if code != 200 || res.(map[string]interface{})["VAL"] != "TWO" {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+	code, _ = callRest("GET", "/test/tables/T1/42", "", t)
+	if code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+
+	code, res = callRest("PATCH", "/test/tables/T1/2", `{"VAL": "DUE"}`, t)
+	if code != 200 || res.(map[string]interface{})["VAL"] != "DUE" || res.(map[string]interface{})["NUM"] != 20.0 {
+		t.Errorf("update failed: %d %v", code, res)
+	}
+
+	code, _ = callRest("DELETE", "/test/tables/T1/2", "", t)
+	if code != 204 {
+		t.Errorf("delete failed: %d", code)
+	}
+	code, _ = callRest("DELETE", "/test/tables/T1/2", "", t)
+	if code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+
+	// composite key
+	code, _ = callRest("POST", "/test/tables/T2", `{"A": 1, "B": "X", "VAL": "ONE-X"}`, t)
+	if code != 201 {
+		t.Errorf("insert failed: %d", code)
+	}
+	code, res = callRest("GET", "/test/tables/T2/1,X", "", t)
+	if code != 200 || res.(map[string]interface{})["VAL"] != "ONE-X" {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+
+	// no primary key, so the rowid is used
+	code, res = callRest("POST", "/test/tables/T3", `{"VAL": "R"}`, t)
+	if code != 201 || res.(map[string]interface{})["rowid"] != 1.0 {
+		t.Errorf("insert failed: %d %v", code, res)
+	}
+	code, res = callRest("GET", "/test/tables/T3/1", "", t)
+	if code != 200 || res.(map[string]interface{})["VAL"] != "R" {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+}
+
+func TestRestQuery(t *testing.T) {
+	code, res := callRest("GET", "/test/tables/T1?NUM=gte.10&order=NUM.desc&select=ID,VAL", "", t)
+	rows, _ := res.([]interface{})
+	if code != 200 || len(rows) != 2 || rows[0].(map[string]interface{})["VAL"] != "THREE" {
+		t.Errorf("query failed: %d %v", code, res)
+		return
+	}
+	if _, ok := rows[0].(map[string]interface{})["NUM"]; ok {
+		t.Errorf("column not selected was returned: %v", rows[0])
+	}
+
+	code, res = callRest("GET", "/test/tables/T1?order=ID&limit=1&offset=1", "", t)
+	rows, _ = res.([]interface{})
+	if code != 200 || len(rows) != 1 || rows[0].(map[string]interface{})["ID"] != 3.0 {
+		t.Errorf("pagination failed: %d %v", code, res)
+	}
+
+	code, res = callRest("GET", "/test/tables/V1?VAL=in.ONE,THREE&order=ID", "", t)
+	rows, _ = res.([]interface{})
+	if code != 200 || len(rows) != 2 {
+		t.Errorf("view query failed: %d %v", code, res)
+	}
+
+	code, res = callRest("PATCH", "/test/tables/T1?VAL=like.T%25", `{"NUM": 0}`, t)
+	rows, _ = res.([]interface{})
+	if code != 200 || len(rows) != 1 || rows[0].(map[string]interface{})["NUM"] != 0.0 {
+		t.Errorf("bulk update failed: %d %v", code, res)
+	}
+
+	code, res = callRest("DELETE", "/test/tables/T1?NUM=is.null", "", t)
+	if code != 200 || len(res.([]interface{})) != 0 {
+		t.Errorf("bulk delete failed: %d %v", code, res)
+	}
+
+	for _, path := range []string{
+		"/test/tables/T1?NOPE=eq.1",
+		"/test/tables/T1?ID=wrong.1",
+		"/test/tables/T1?select=NOPE",
+		"/test/tables/T1?order=ID.sideways",
+		"/test/tables/T1?limit=100000",
+	} {
+		if code, _ = callRest("GET", path, "", t); code != 400 {
+			t.Errorf("expected 400 for %s, got %d", path, code)
+		}
+	}
+	if code, _ = callRest("DELETE", "/test/tables/T1", "", t); code != 400 {
+		t.Errorf("delete without filters: expected 400, got %d", code)
+	}
+	if code, _ = callRest("POST", "/test/tables/T1", `{"NOPE": 1}`, t); code != 400 {
+		t.Errorf("unknown column: expected 400, got %d", code)
+	}
+	if code, _ = callRest("POST", "/test/tables/V1", `{"VAL": "X"}`, t); code != 405 {
+		t.Errorf("insert in view: expected 405, got %d", code)
+	}
+	if code, _ = callRest("GET", "/test/tables/NOPE", "", t); code != 404 {
+		t.Errorf("unknown table: expected 404, got %d", code)
+	}
+}
+
+func TestRestLimited(t *testing.T) {
+	code, res := callRest("GET", "/limited/tables/T1/1", "", t)
+	if code != 200 || res.(map[string]interface{})["VAL"] != "ONE" {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+	if code, _ = callRest("DELETE", "/limited/tables/T1/1", "", t); code != 405 {
+		t.Errorf("expected 405, got %d", code)
+	}
+	if code, _ = callRest("GET", "/limited/tables/T2", "", t); code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestRestAuditAndLimits(t *testing.T) {
+	if code, res := callRest("POST", "/audited/tables/T1", `{"ID": 1, "SECRET": "pwd"}`, t); code != 201 {
+		t.Errorf("insert failed: %d %v", code, res)
+		return
+	}
+	if code, _ := callRest("POST", "/audited/tables/T1", `[{"ID": 2}, {"ID": 3}]`, t); code != 413 {
+		t.Errorf("expected 413, got %d", code)
+	}
+	if code, res := callRest("GET", "/audited/tables/T1/1", "", t); code != 200 {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+
+	code, body, res := call("audited", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT SQL, VALS, COMMITTED FROM AUDIT_LOG ORDER BY rowid",
+			},
+		},
+	}, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	rs := res.Results[0].ResultSet
+	if len(rs) != 2 || !strings.HasPrefix(rs[0]["SQL"].(string), "INSERT INTO") || !strings.HasPrefix(rs[1]["SQL"].(string), "SELECT") {
+		t.Errorf("wrong audit log: %v", rs)
+		return
+	}
+	if vals := rs[0]["VALS"].(string); !strings.Contains(vals, redactedValue) || strings.Contains(vals, "pwd") || rs[0]["COMMITTED"] != 1.0 {
+		t.Errorf("wrong audit entry: %v", rs[0])
+	}
+
+	if code, res := callRest("GET", "/audited/tables/SLOW", "", t); code != 200 {
+		t.Errorf("get failed: %d %v", code, res)
+	}
+	if list := dbs["audited"].SlowQueries.list(); len(list) == 0 || list[0].Sql != `SELECT * FROM "SLOW" LIMIT :p0 OFFSET :p1` {
+		t.Errorf("not in the slow query log: %v", list)
+	}
+}
+
+func TestRestOwnTablesAndTruncation(t *testing.T) {
+	if code, _ := callRest("GET", "/audited/tables/AUDIT_LOG", "", t); code != 404 {
+		t.Errorf("expected 404 for the audit table, got %d", code)
+	}
+	if code, _ := callRest("DELETE", "/audited/tables/AUDIT_LOG?rowid=gt.0", "", t); code != 404 {
+		t.Errorf("expected 404 for the audit table, got %d", code)
+	}
+
+	for _, row := range []string{`{"ID": 2}`, `{"ID": 3}`} {
+		if code, res := callRest("POST", "/audited/tables/T1", row, t); code != 201 {
+			t.Errorf("insert failed: %d %v", code, res)
+			return
+		}
+	}
+	agent := fiber.Get("http://localhost:12321/audited/tables/T1")
+	resp := fiber.AcquireResponse()
+	defer fiber.ReleaseResponse(resp)
+	agent.SetResponse(resp)
+	code, raw, errs := agent.Bytes()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+		return
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		t.Error(err)
+		return
+	}
+	if code != 200 || len(rows) != 2 || string(resp.Header.Peek(headerTruncated)) != "true" {
+		t.Errorf("expected 2 rows, truncated, got %d: %s %s", code, raw, resp.Header.String())
+	}
+}
+
+func TestRestUnauthorized(t *testing.T) {
+	code, _ := callAdmin("GET", "/test/tables/T1", "myUser", "wrong", t)
+	if code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+}
+
+func TestRestTeardown(t *testing.T) {
+	Shutdown()
+}
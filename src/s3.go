@@ -0,0 +1,288 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// A minimal client for S3-compatible object storages, that implements only what's
+// needed to upload and rotate the backups. Requests are signed with AWS Signature
+// Version 4, and use path-style URLs (<endpoint>/<bucket>/<key>), that are supported
+// by the vast majority of the implementations (MinIO, Garage, R2, ...).
+
+const (
+	s3EnvAccessKey    = "AWS_ACCESS_KEY_ID"
+	s3EnvSecretKey    = "AWS_SECRET_ACCESS_KEY"
+	s3EnvSessionToken = "AWS_SESSION_TOKEN"
+	s3DefaultRegion   = "us-east-1"
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat   = "20060102T150405Z"
+	s3DefaultTimeout  = 10 * time.Minute
+)
+
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	httpClient   *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Validates the configuration and builds the client; credentials are taken from
+// the environment.
+func newS3Client(cfg *s3Cfg) *s3Client {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		mllog.Fatal("the endpoint and bucket of the S3 backup destination must have a value")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		mllog.Fatalf("the S3 endpoint is not a valid http(s) URL: %s", cfg.Endpoint)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	// For each request, so it must allow for uploading the largest backup
+	timeout := s3DefaultTimeout
+	if cfg.TimeoutMs < 0 {
+		mllog.Fatal("the timeout of the S3 backup destination cannot be negative")
+	} else if cfg.TimeoutMs > 0 {
+		timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	ret := &s3Client{
+		endpoint:     endpoint,
+		region:       region,
+		bucket:       cfg.Bucket,
+		accessKey:    os.Getenv(s3EnvAccessKey),
+		secretKey:    os.Getenv(s3EnvSecretKey),
+		sessionToken: os.Getenv(s3EnvSessionToken),
+		httpClient:   &http.Client{Timeout: timeout},
+	}
+	if ret.accessKey == "" || ret.secretKey == "" {
+		mllog.Fatalf("for the S3 backup destination, env vars %s and %s must be set", s3EnvAccessKey, s3EnvSecretKey)
+	}
+	return ret
+}
+
+// Encodes a string as required by SigV4: everything but the unreserved chars is
+// percent-encoded; '/' is kept if it's a path.
+func s3Escape(s string, isPath bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (isPath && b == '/') {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Signs the request, adding the needed headers. All the headers already present
+// in the request are signed, plus the host.
+func (s *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := strings.Join([]string{s3SignAlgorithm, amzDate, scope, sha256Hex([]byte(canonRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	return &u
+}
+
+// Executes the request, returning an error if the response is not a 2xx
+func (s *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now())
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return res, nil
+}
+
+// Uploads a local file. The file is read twice, the first time to compute the
+// hash of the payload.
+func (s *s3Client) put(key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key, nil).String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Lists the keys that start with the given prefix, following the pagination
+func (s *s3Client) list(prefix string) ([]string, error) {
+	var ret []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.objectURL("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req, sha256Hex(nil))
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Contents {
+			ret = append(ret, result.Contents[i].Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return ret, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Client) delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, sha256Hex(nil))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
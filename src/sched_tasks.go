@@ -21,11 +21,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/mitchellh/go-homedir"
 	mllog "github.com/proofrock/go-mylittlelogger"
 
@@ -38,10 +41,68 @@ const bkpTimeFormat = "060102-1504"
 // Used when deleting older backup files, the date/time is substituted with '?'
 var bkpTimeGlob = strings.Repeat("?", len(bkpTimeFormat))
 
-// Parses a backup plan, checks that it is well-formed and returns a function that
-// will be called by cron and executes the plan.
-func doTask(task scheduledTask) func() {
+var checkpointModes = []string{"PASSIVE", "FULL", "RESTART", "TRUNCATE"}
+
+// Runs PRAGMA integrity_check (or quick_check), returning its outcome: "ok"
+// or the problems found.
+func integrityCheck(db *db, quick bool) ([]string, error) {
+	pragma := "PRAGMA integrity_check"
+	if quick {
+		pragma = "PRAGMA quick_check"
+	}
+	rows, err := db.DbConn.QueryContext(context.Background(), pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []string
+	for rows.Next() {
+		var res string
+		if err := rows.Scan(&res); err != nil {
+			return nil, err
+		}
+		ret = append(ret, res)
+	}
+	return ret, rows.Err()
+}
+
+// Runs PRAGMA wal_checkpoint; fails if it couldn't complete because of a lock
+func checkpoint(db *db, mode string) error {
+	var busy, log, checkpointed int
+	if err := db.DbConn.QueryRowContext(context.Background(), "PRAGMA wal_checkpoint("+mode+")").
+		Scan(&busy, &log, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return errors.New("checkpoint could not complete")
+	}
+	return nil
+}
+
+var errBackupSkipped = errors.New("backup skipped, as the db is corrupt")
+
+// Parses a backup plan, checks that it is well-formed and returns the functions that
+// execute the plan (or only its backup), to be called by cron, at startup or on demand.
+func doTask(task scheduledTask, taskIdx int) runnableTask {
 	var bkpDir, bkpFile string
+	var s3 *s3Client
+	if task.SkipBackupIfCorrupt && (!task.DoIntegrityCheck || !task.DoBackup) {
+		mllog.Fatal("skipping the backup if the db is corrupt needs both the integrity check and the backup")
+	}
+	if task.QuickCheck && !task.DoIntegrityCheck {
+		mllog.Fatal("quick check is an option of the integrity check, that is not enabled")
+	}
+	if task.DoCheckpoint {
+		task.CheckpointMode = strings.ToUpper(task.CheckpointMode)
+		if task.CheckpointMode == "" {
+			task.CheckpointMode = "TRUNCATE"
+		}
+		if !contains(checkpointModes, task.CheckpointMode) {
+			mllog.Fatalf("checkpoint mode must be one of %s", strings.Join(checkpointModes, ", "))
+		}
+	} else if task.CheckpointMode != "" {
+		mllog.Fatal("checkpoint mode is an option of the checkpoint, that is not enabled")
+	}
 	if task.DoBackup {
 		var err error
 		if task.BackupTemplate == "" {
@@ -68,76 +129,333 @@ func doTask(task scheduledTask) func() {
 		if task.NumFiles < 1 {
 			mllog.Fatal("the number of backup files to keep must be at least 1")
 		}
+
+		task.BackupMode = strings.ToLower(task.BackupMode)
+		if task.BackupMode == "" {
+			task.BackupMode = bkpModeVacuum
+		}
+		if task.BackupMode != bkpModeVacuum && task.BackupMode != bkpModeOnline {
+			mllog.Fatalf("backup mode must be '%s' or '%s'", bkpModeVacuum, bkpModeOnline)
+		}
+		if task.BackupPagesPerStep < 0 {
+			mllog.Fatal("the number of pages per backup step cannot be negative")
+		}
+		if task.BackupPagesPerStep == 0 {
+			task.BackupPagesPerStep = defaultBkpPagesPerStep
+		}
+
+		task.BackupCompression = strings.ToLower(task.BackupCompression)
+		if _, ok := bkpCompressionExts[task.BackupCompression]; !ok && task.BackupCompression != "" {
+			mllog.Fatalf("backup compression must be '%s' or '%s'", bkpCompressionZstd, bkpCompressionGzip)
+		}
+
+		if task.BackupS3 != nil {
+			s3 = newS3Client(task.BackupS3)
+		}
+	}
+
+	// Writes the backup file (with VACUUM INTO or the online backup API). Must be
+	// called while holding the db mutex. Returns the file name.
+	takeBackup := func(run *taskRun) (string, error) {
+		run.Steps = append(run.Steps, "backup")
+		now := time.Now().Format(bkpTimeFormat)
+		fname := fmt.Sprintf(filepath.Join(bkpDir, bkpFile), now)
+		if task.BackupMode == bkpModeOnline {
+			// releases the mutex between the steps
+			if err := onlineBackup(task.Db, fname, task.BackupPagesPerStep); err != nil {
+				return "", fmt.Errorf("online backup: %w", err)
+			}
+		} else if err := vacuumInto(task.Db, fname); err != nil {
+			return "", fmt.Errorf("backup: %w", err)
+		}
+		return fname, nil
+	}
+
+	// Checks the integrity of the db. If it's corrupt, the problems are returned
+	// as the error, and corrupt is true.
+	checkIntegrity := func(run *taskRun) (corrupt bool, err error) {
+		run.Steps = append(run.Steps, "integrity check")
+		res, err := integrityCheck(task.Db, task.QuickCheck)
+		if err != nil {
+			return false, fmt.Errorf("integrity check: %w", err)
+		}
+		run.IntegrityCheck = res
+		if len(res) != 1 || res[0] != "ok" {
+			return true, fmt.Errorf("integrity check: %s", strings.Join(res, "; "))
+		}
+		return false, nil
 	}
 
-	// Execute a task, according to the plan. If so configured, does
-	// a VACUUM, then a backup (with VACUUM INTO). Being a lambda, inherits the
+	// Execute a task, according to the plan. If so configured, checks the integrity
+	// of the db, does a VACUUM, an ANALYZE, a PRAGMA optimize and a checkpoint, then a
+	// backup (with VACUUM INTO or the online backup API). Being a lambda, inherits the
 	// plan from the parsing (above)
 	//
-	// Just log Errors when it fails. Doesn't of course block/abort anything.
-	return func() {
-		// Execute non-concurrently
-		task.Db.Mutex.Lock()
-		defer task.Db.Mutex.Unlock()
+	// Returns the first error that aborted the task; the statements are all
+	// executed anyway, and their errors are joined. A failed integrity check
+	// doesn't abort the task, but fails it, and skips the backup if so configured.
+	//
+	// Runs while holding the db mutex, so the backup is only written here; it's
+	// then finished (see below) after releasing it. Returns the file name.
+	execute := func(run *taskRun) (string, error) {
+		var errs []error
+		var bkp string
+
+		corrupt := false
+		if task.DoIntegrityCheck {
+			var err error
+			if corrupt, err = checkIntegrity(run); err != nil && !corrupt {
+				return "", err
+			}
+			errs = append(errs, err)
+		}
 
 		if task.DoVacuum {
+			run.Steps = append(run.Steps, "vacuum")
 			if _, err := task.Db.DbConn.ExecContext(context.Background(), "VACUUM"); err != nil {
-				mllog.Error("sched. task (vacuum): ", err.Error())
-				return
+				return "", fmt.Errorf("vacuum: %w", err)
 			}
 		}
 
-		if task.DoBackup {
-			now := time.Now().Format(bkpTimeFormat)
-			fname := fmt.Sprintf(filepath.Join(bkpDir, bkpFile), now)
-			stat, err := task.Db.DbConn.PrepareContext(context.Background(), "VACUUM INTO ?")
-			if err != nil {
-				mllog.Error("sched. task (backup prep): ", err.Error())
-				return
+		if task.DoAnalyze {
+			run.Steps = append(run.Steps, "analyze")
+			if _, err := task.Db.DbConn.ExecContext(context.Background(), "ANALYZE"); err != nil {
+				return "", fmt.Errorf("analyze: %w", err)
 			}
-			defer stat.Close()
-			if _, err := stat.Exec(fname); err != nil {
-				mllog.Error("sched. task (backup): ", err.Error())
-				return
+		}
+
+		if task.DoOptimize {
+			run.Steps = append(run.Steps, "optimize")
+			if _, err := task.Db.DbConn.ExecContext(context.Background(), "PRAGMA optimize"); err != nil {
+				return "", fmt.Errorf("optimize: %w", err)
 			}
-			// delete the backup files, except for the last n
-			list, err := filepath.Glob(fmt.Sprintf(filepath.Join(bkpDir, bkpFile), bkpTimeGlob))
-			if err != nil {
-				mllog.Error("sched. task (pruning bkp files): ", err.Error())
-				return
+		}
+
+		if task.DoCheckpoint {
+			run.Steps = append(run.Steps, "checkpoint")
+			if err := checkpoint(task.Db, task.CheckpointMode); err != nil {
+				return "", fmt.Errorf("checkpoint: %w", err)
 			}
-			sort.Strings(list)
-			for i := 0; i < len(list)-task.NumFiles; i++ {
-				os.Remove(list[i])
+		}
+
+		if task.DoBackup && corrupt && task.SkipBackupIfCorrupt {
+			errs = append(errs, errBackupSkipped)
+		} else if task.DoBackup {
+			var err error
+			if bkp, err = takeBackup(run); err != nil {
+				return "", err
 			}
 		}
 
-		if len(task.Statements) > 0 {
-			for idx := range task.Statements {
-				if _, err := task.Db.DbConn.ExecContext(context.Background(), task.Statements[idx]); err != nil {
-					mllog.Errorf("sched. task (statement #%d): %s", idx, err.Error())
-				}
+		for idx := range task.Statements {
+			run.Steps = append(run.Steps, fmt.Sprintf("statement #%d", idx))
+			if _, err := task.Db.DbConn.ExecContext(context.Background(), task.Statements[idx]); err != nil {
+				errs = append(errs, fmt.Errorf("statement #%d: %w", idx, err))
+			}
+			if mayChangeSchema(task.Statements[idx]) {
+				schemaChanged(task.Db)
 			}
 		}
+		return bkp, errors.Join(errs...)
+	}
+
+	// Compresses and/or encrypts the backup, as a stream, rotates the backup files
+	// and uploads the backup, if so configured. Runs without holding the db mutex,
+	// but serialized for the task, as it rotates its files.
+	var bkpMutex sync.Mutex
+	finishBackup := func(run *taskRun, fname string) error {
+		bkpMutex.Lock()
+		defer bkpMutex.Unlock()
+
+		// compress and/or encrypt, if so configured
+		bkp, err := postProcessBackup(&task, fname)
+		if err != nil {
+			os.Remove(fname)
+			return fmt.Errorf("backup post-processing: %w", err)
+		}
+		run.BackupFile = bkp
+		// delete the backup files, except for the last n
+		list, err := filepath.Glob(fmt.Sprintf(filepath.Join(bkpDir, bkpFile), bkpTimeGlob) + bkpSuffix(&task))
+		if err != nil {
+			return fmt.Errorf("pruning bkp files: %w", err)
+		}
+		sort.Strings(list)
+		for i := 0; i < len(list)-task.NumFiles; i++ {
+			os.Remove(list[i])
+		}
+		// upload to S3, and rotate the remote files in the same way
+		if s3 != nil {
+			run.Steps = append(run.Steps, "upload")
+			if err := uploadBackup(s3, &task, bkpFile, bkp); err != nil {
+				return fmt.Errorf("S3 upload: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Each run is recorded in the history of the db
+	runWith := func(trigger string, execute func(run *taskRun) (string, error)) taskRun {
+		start := time.Now()
+		run := taskRun{
+			Timestamp: start.Format(time.RFC3339Nano),
+			TaskIdx:   taskIdx,
+			Trigger:   trigger,
+			Steps:     []string{},
+		}
+
+		// Execute non-concurrently
+		task.Db.Mutex.Lock()
+		bkp, err := execute(&run)
+		shipWAL(task.Db)
+		flushChangeEvents(task.Db)
+		task.Db.Mutex.Unlock()
+
+		if bkp != "" {
+			err = errors.Join(err, finishBackup(&run, bkp))
+		}
+		if err != nil {
+			run.Error = err.Error()
+		} else {
+			run.Success = true
+		}
+		run.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+
+		task.Db.Mutex.Lock()
+		recordTaskRun(task.Db, run)
+		task.Db.Mutex.Unlock()
+
+		fireTaskWebhooks(task.Db, run)
+		return run
+	}
+
+	ret := runnableTask{
+		Run: func(trigger string) taskRun {
+			return runWith(trigger, execute)
+		},
+	}
+	if task.DoBackup {
+		// Only the backup, but never of a corrupt db, if so configured
+		ret.Backup = func(trigger string) taskRun {
+			return runWith(trigger, func(run *taskRun) (string, error) {
+				if task.SkipBackupIfCorrupt {
+					if corrupt, err := checkIntegrity(run); corrupt {
+						return "", errors.Join(err, errBackupSkipped)
+					} else if err != nil {
+						return "", err
+					}
+				}
+				return takeBackup(run)
+			})
+		}
+	}
+	return ret
+}
+
+// Wraps a task for cron (or for the startup), that just logs the errors when
+// it fails. Doesn't of course block/abort anything.
+func logTaskErrors(db *db, idx int, trigger string, run func(string) taskRun) func() {
+	return func() {
+		if res := run(trigger); !res.Success {
+			logError(logFields{"db": db.Id, "task": idx}, "sched. task %d for db '%s': %s", idx, db.Id, res.Error)
+		}
+	}
+}
+
+// Uploads the backup file to the S3 destination, then deletes the remote backup
+// files, except for the last n. They are recognized with the same pattern used
+// for the local ones, after the prefix.
+func uploadBackup(s3 *s3Client, task *scheduledTask, bkpFile, fname string) error {
+	prefix := task.BackupS3.Prefix
+	if err := s3.put(prefix+filepath.Base(fname), fname); err != nil {
+		return err
+	}
+
+	keys, err := s3.list(prefix)
+	if err != nil {
+		return err
+	}
+	pattern := fmt.Sprintf(bkpFile, bkpTimeGlob) + bkpSuffix(task)
+	var list []string
+	for i := range keys {
+		if ok, _ := path.Match(pattern, strings.TrimPrefix(keys[i], prefix)); ok {
+			list = append(list, keys[i])
+		}
+	}
+	sort.Strings(list)
+	for i := 0; i < len(list)-task.NumFiles; i++ {
+		if err := s3.delete(list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Admin endpoint that runs a task on demand, and reports its outcome
+func runTaskHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		idx, err := c.ParamsInt("idx")
+		if err != nil || idx < 0 || idx >= len(db.Tasks) {
+			return newWSError(-1, fiber.StatusNotFound, "Task not found: %s", c.Params("idx"))
+		}
+
+		run := db.Tasks[idx].Run(taskTriggerManual)
+		if !run.Success {
+			return newWSError(-1, fiber.StatusInternalServerError, "Task %d failed: %s", idx, run.Error)
+		}
+
+		return c.JSON(run)
+	}
+}
+
+// Admin endpoint that vacuums the db on demand
+func vacuumHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		db.Mutex.Lock()
+		_, err := db.DbConn.ExecContext(context.Background(), "VACUUM")
+		if err == nil {
+			shipWAL(db)
+		}
+		db.Mutex.Unlock()
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, "Vacuum failed: %s", err.Error())
+		}
+
+		return c.JSON(taskRun{
+			Timestamp:  start.Format(time.RFC3339Nano),
+			TaskIdx:    -1,
+			Trigger:    taskTriggerManual,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Steps:      []string{"vacuum"},
+			Success:    true,
+		})
 	}
 }
 
 var scheduler = cron.New()
 var haySchedules = false
-var startupTasks = []scheduledTask{}
+var startupTasks = []func(){}
 var exprDesc, _ = cronDesc.NewDescriptor()
 
 // Calls the parsing of the scheduled tasks config, via doTask(), and adds the
-// resulting task to be executed by cron
+// resulting task to be executed by cron. The tasks are also kept in the db, so
+// that they can be triggered by the admin endpoints.
 func parseTasks(db *db) {
+	parseTaskHistory(db)
 	for idx := range db.ScheduledTasks {
 		db.ScheduledTasks[idx].Db = db // back reference
+		task := doTask(db.ScheduledTasks[idx], idx)
+		db.Tasks = append(db.Tasks, task) // to run them on demand
+		run := task.Run
 		// is there at least one btw schedule and atStartup?
 		isOk := false
 		if db.ScheduledTasks[idx].Schedule != nil {
-			if _, err := scheduler.AddFunc(*db.ScheduledTasks[idx].Schedule, doTask(db.ScheduledTasks[idx])); err != nil {
+			entryID, err := scheduler.AddFunc(*db.ScheduledTasks[idx].Schedule, logTaskErrors(db, idx, taskTriggerSchedule, run))
+			if err != nil {
 				mllog.Fatal(err.Error())
 			}
+			db.Tasks[idx].EntryID = entryID
 			haySchedules = true
 			// Also prints a log containing the human-readable translation of the cron schedule
 			if descr, err := exprDesc.ToDescription(*db.ScheduledTasks[idx].Schedule, cronDesc.Locale_en); err != nil {
@@ -149,7 +467,7 @@ func parseTasks(db *db) {
 		}
 		if db.ScheduledTasks[idx].AtStartup != nil && *db.ScheduledTasks[idx].AtStartup {
 			mllog.StdOutf("  + Task %d scheduled at startup", idx)
-			startupTasks = append(startupTasks, db.ScheduledTasks[idx])
+			startupTasks = append(startupTasks, logTaskErrors(db, idx, taskTriggerStartup, run))
 			isOk = true
 		}
 		if !isOk {
@@ -162,8 +480,9 @@ func parseTasks(db *db) {
 // Does it only if there's something to do.
 func startTasks() {
 	for idx := range startupTasks {
-		doTask(startupTasks[idx])()
+		startupTasks[idx]()
 	}
+	startupTasks = nil
 	if haySchedules {
 		scheduler.Start()
 	}
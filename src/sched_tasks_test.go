@@ -17,10 +17,17 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/proofrock/crypgo"
 	"github.com/robfig/cron/v3"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -339,3 +346,581 @@ func TestAtStartupMultiple(t *testing.T) {
 		t.Errorf("did not succeed -> %v", res.Results[0].ResultSet)
 	}
 }
+
+func testCompressedBackup(t *testing.T, compression, key, suffix string) {
+	defer os.Remove("../test/test.db")
+	defer os.Remove("../test/restored.db")
+	defer Shutdown()
+
+	t_r_u_e := true
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "test",
+				Path:           "../test/test.db",
+				DisableWALMode: true, // generate only ".db" files
+				InitStatements: []string{
+					"CREATE TABLE TMP (ID INTEGER)",
+					"INSERT INTO TMP VALUES (1), (2), (3)",
+				},
+				ScheduledTasks: []scheduledTask{
+					{
+						AtStartup:           &t_r_u_e,
+						DoBackup:            true,
+						BackupTemplate:      "../test/test_%s.db",
+						NumFiles:            1,
+						BackupCompression:   compression,
+						BackupEncryptionKey: key,
+					},
+				},
+			},
+		},
+	}
+
+	go launch(cfg, true)
+
+	time.Sleep(3 * time.Second)
+
+	list, _ := filepath.Glob("../test/test_" + bkpTimeGlob + ".db*")
+	for i := range list {
+		defer os.Remove(list[i])
+	}
+
+	if len(list) != 1 || !strings.HasSuffix(list[0], ".db"+suffix) {
+		t.Errorf("backup file not correctly created: %v", list)
+		return
+	}
+
+	if key != "" {
+		if err := restoreBackup(restoreCfg{From: list[0], Into: "../test/restored.db", Key: "wrong"}); err == nil {
+			t.Error("restore did succeed with a wrong key, but shouldn't have")
+		}
+		if fileExists("../test/restored.db") {
+			t.Error("failed restore created the db file")
+		}
+	}
+
+	if err := restoreBackup(restoreCfg{From: list[0], Into: "../test/restored.db", Key: key}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	dbObj, err := sql.Open("sqlite", "../test/restored.db")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dbObj.Close()
+
+	var cnt int
+	if err := dbObj.QueryRow("SELECT COUNT(1) FROM TMP").Scan(&cnt); err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 3 {
+		t.Errorf("restored db has %d rows instead of 3", cnt)
+	}
+}
+
+func TestAtStartupBackupZstd(t *testing.T) {
+	testCompressedBackup(t, "zstd", "", ".zst")
+}
+
+func TestAtStartupBackupGzipEncrypted(t *testing.T) {
+	testCompressedBackup(t, "GZIP", "hey", ".gz.enc")
+}
+
+func TestAtStartupBackupEncrypted(t *testing.T) {
+	testCompressedBackup(t, "", "hey", ".enc")
+}
+
+func TestBackupEncryptionStream(t *testing.T) {
+	// More than a chunk, and not a multiple of it
+	plain := bytes.Repeat([]byte("0123456789"), bkpEncChunkSize/4)
+
+	var enc bytes.Buffer
+	w, err := newEncryptingWriter(&enc, "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newDecryptingReader(bytes.NewReader(enc.Bytes()), "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(dec, plain) {
+		t.Error("the decrypted data differ from the original ones")
+	}
+
+	r, _ = newDecryptingReader(bytes.NewReader(enc.Bytes()), "ho")
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+
+	r, _ = newDecryptingReader(bytes.NewReader(enc.Bytes()[:enc.Len()-10]), "hey")
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("decrypted a truncated file")
+	}
+
+	// Backups encrypted by previous versions
+	legacy, err := crypgo.EncryptBytes("hey", plain[:100])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = newDecryptingReader(strings.NewReader(legacy), "hey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := io.ReadAll(r); err != nil || !bytes.Equal(dec, plain[:100]) {
+		t.Error("cannot decrypt a legacy backup")
+	}
+}
+
+func TestAtStartupOnlineBackup(t *testing.T) {
+	defer os.Remove("../test/test.db")
+	defer os.Remove("../test/restored.db")
+	defer Shutdown()
+
+	t_r_u_e := true
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: "../test/test.db",
+				InitStatements: []string{
+					"CREATE TABLE TMP (ID INTEGER, VAL BLOB)",
+					"WITH RECURSIVE CNT(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM CNT WHERE X < 10000) " +
+						"INSERT INTO TMP SELECT X, RANDOMBLOB(100) FROM CNT",
+				},
+				ScheduledTasks: []scheduledTask{
+					{
+						AtStartup:          &t_r_u_e,
+						DoBackup:           true,
+						BackupMode:         "ONLINE",
+						BackupPagesPerStep: 5,
+						BackupTemplate:     "../test/test_%s.db",
+						NumFiles:           1,
+						BackupCompression:  "zstd",
+					},
+				},
+			},
+		},
+	}
+
+	go launch(cfg, true)
+
+	time.Sleep(3 * time.Second)
+
+	list, _ := filepath.Glob("../test/test_" + bkpTimeGlob + ".db*")
+	for i := range list {
+		defer os.Remove(list[i])
+	}
+	if len(list) != 1 {
+		t.Errorf("backup file not correctly created: %v", list)
+		return
+	}
+
+	if err := restoreBackup(restoreCfg{From: list[0], Into: "../test/restored.db"}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	dbObj, err := sql.Open("sqlite", "../test/restored.db")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dbObj.Close()
+
+	var cnt int
+	if err := dbObj.QueryRow("SELECT COUNT(1) FROM TMP").Scan(&cnt); err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt != 10000 {
+		t.Errorf("restored db has %d rows instead of 10000", cnt)
+	}
+}
+
+func TestAdminTasksSetup(t *testing.T) {
+	sched := "0 0 1 1 *" // never, during the tests
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "test",
+				Path:           "../test/test.db",
+				DisableWALMode: true, // generate only ".db" files
+				InitStatements: []string{
+					"CREATE TABLE TMP (ID INTEGER)",
+				},
+				TaskHistoryTable: "TASK_HISTORY",
+				Admin: &authr{
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "admin",
+							Password: "secret",
+						},
+					},
+				},
+				ScheduledTasks: []scheduledTask{
+					{
+						Schedule:       &sched,
+						DoBackup:       true,
+						BackupTemplate: "../test/test_%s.db",
+						NumFiles:       1,
+						Statements:     []string{"INSERT INTO TMP VALUES (1)"},
+					}, {
+						Schedule:   &sched,
+						Statements: []string{"INSERT INTO NOPE VALUES (1)", "INSERT INTO TMP VALUES (2)"},
+					},
+				},
+			},
+		},
+	}
+
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestAdminRunTask(t *testing.T) {
+	code, body := callAdmin(fiber.MethodPost, "/test/_admin/tasks/0/run", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	list, _ := filepath.Glob("../test/test_" + bkpTimeGlob + ".db")
+	for i := range list {
+		defer os.Remove(list[i])
+	}
+	if len(list) != 1 {
+		t.Errorf("backup file not created: %v", list)
+	}
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT ID FROM TMP",
+			},
+		},
+	}
+	code, resBody, res := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed (%d): %s", code, resBody)
+		return
+	}
+	if len(res.Results[0].ResultSet) != 1 {
+		t.Errorf("statement not executed -> %v", res.Results[0].ResultSet)
+	}
+}
+
+func TestAdminRunTaskFailing(t *testing.T) {
+	code, body := callAdmin(fiber.MethodPost, "/test/_admin/tasks/1/run", "admin", "secret", t)
+	if code != 500 || !strings.Contains(string(body), "NOPE") {
+		t.Errorf("did not fail with the actual error (%d): %s", code, body)
+	}
+
+	// the second statement is executed anyway
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT ID FROM TMP WHERE ID = 2",
+			},
+		},
+	}
+	code, resBody, res := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed (%d): %s", code, resBody)
+		return
+	}
+	if len(res.Results[0].ResultSet) != 1 {
+		t.Errorf("statement not executed -> %v", res.Results[0].ResultSet)
+	}
+}
+
+func TestAdminRunTaskNotFound(t *testing.T) {
+	code, _ := callAdmin(fiber.MethodPost, "/test/_admin/tasks/2/run", "admin", "secret", t)
+	if code != 404 {
+		t.Errorf("did not fail with 404: %d", code)
+	}
+
+	code, _ = callAdmin(fiber.MethodPost, "/test/_admin/tasks/0/run", "admin", "wrong", t)
+	if code != 401 {
+		t.Errorf("did not fail with 401: %d", code)
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	code, body := callAdmin(fiber.MethodGet, "/test/_admin/backup", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	if !strings.HasPrefix(string(body), "SQLite format 3\x00") {
+		t.Error("the response is not a database")
+	}
+
+	// it's taken by the first task that takes backups
+	list, _ := filepath.Glob("../test/test_" + bkpTimeGlob + ".db")
+	for i := range list {
+		defer os.Remove(list[i])
+	}
+	if len(list) != 1 {
+		t.Errorf("backup file not created: %v", list)
+	}
+}
+
+func TestAdminSnapshotDownload(t *testing.T) {
+	code, body := callAdmin(fiber.MethodGet, "/test/_admin/snapshot", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+	if !strings.HasPrefix(string(body), "SQLite format 3\x00") {
+		t.Error("the response is not a database")
+	}
+
+	list, _ := filepath.Glob(filepath.Join(os.TempDir(), "ws4sqlite-bkp-*"))
+	if len(list) > 0 {
+		t.Errorf("temp files not deleted: %v", list)
+	}
+}
+
+func TestAdminVacuum(t *testing.T) {
+	code, body := callAdmin(fiber.MethodPost, "/test/_admin/vacuum", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+	}
+}
+
+func TestAdminTasksStatus(t *testing.T) {
+	code, body := callAdmin(fiber.MethodGet, "/test/_admin/tasks", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	var res tasksResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(res.History) != 4 || res.History[0].TaskIdx != -1 || res.History[1].TaskIdx != 0 ||
+		res.History[2].TaskIdx != 1 || res.History[3].TaskIdx != 0 {
+		t.Errorf("wrong history: %s", body)
+		return
+	}
+
+	if !res.History[3].Success || res.History[3].BackupFile == "" || res.History[3].Trigger != taskTriggerManual ||
+		len(res.History[3].Steps) != 2 {
+		t.Errorf("first run not correctly recorded: %v", res.History[3])
+	}
+
+	if res.History[2].Success || !strings.Contains(res.History[2].Error, "NOPE") {
+		t.Errorf("second run not correctly recorded: %v", res.History[2])
+	}
+
+	if !res.History[1].Success || res.History[1].BackupFile == "" || len(res.History[1].Steps) != 1 {
+		t.Errorf("backup not correctly recorded: %v", res.History[1])
+	}
+
+	if !res.History[0].Success || res.History[0].BackupFile != "" || len(res.History[0].Steps) != 1 {
+		t.Errorf("snapshot not correctly recorded: %v", res.History[0])
+	}
+
+	if len(res.Tasks) != 2 || res.Tasks[0].NextRun == "" || res.Tasks[0].LastRun == nil || !res.Tasks[0].LastRun.Success {
+		t.Errorf("wrong task status: %s", body)
+	}
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM TASK_HISTORY ORDER BY TS",
+			},
+		},
+	}
+	code, resBody, res2 := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed (%d): %s", code, resBody)
+		return
+	}
+	if len(res2.Results[0].ResultSet) != 4 || res2.Results[0].ResultSet[0]["STEPS"] != "backup,statement #0" {
+		t.Errorf("task history not persisted -> %v", res2.Results[0].ResultSet)
+	}
+}
+
+func TestAdminTasksTeardown(t *testing.T) {
+	Shutdown()
+	os.Remove("../test/test.db")
+}
+
+// An index that doesn't match its table, so that integrity_check fails
+func createCorruptDb(path string, t *testing.T) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, sqll := range []string{
+		"CREATE TABLE T (ID INTEGER, VAL TEXT)",
+		"CREATE INDEX IDX ON T(VAL)",
+		"INSERT INTO T VALUES (1, 'ONE'), (2, 'TWO')",
+		"PRAGMA writable_schema = ON",
+		"UPDATE sqlite_master SET sql = 'CREATE INDEX IDX ON T(ID)' WHERE name = 'IDX'",
+	} {
+		if _, err := db.Exec(sqll); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMaintenanceStepsSetup(t *testing.T) {
+	sched := "0 0 1 1 *" // never, during the tests
+
+	admin := &authr{
+		ByCredentials: []credentialsCfg{
+			{
+				User:     "admin",
+				Password: "secret",
+			},
+		},
+	}
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: "../test/maint.db",
+				InitStatements: []string{
+					"CREATE TABLE T (ID INTEGER, VAL TEXT)",
+					"CREATE INDEX IDX ON T(VAL)",
+				},
+				Admin: admin,
+				ScheduledTasks: []scheduledTask{
+					{
+						Schedule:            &sched,
+						DoIntegrityCheck:    true,
+						SkipBackupIfCorrupt: true,
+						DoAnalyze:           true,
+						DoOptimize:          true,
+						DoCheckpoint:        true,
+						DoBackup:            true,
+						BackupTemplate:      "../test/maint_%s.db",
+						NumFiles:            1,
+					},
+				},
+			},
+			{
+				Id:    "corrupt",
+				Path:  "../test/maint_corrupt.db",
+				Admin: admin,
+				ScheduledTasks: []scheduledTask{
+					{
+						Schedule:            &sched,
+						DoIntegrityCheck:    true,
+						SkipBackupIfCorrupt: true,
+						DoBackup:            true,
+						BackupTemplate:      "../test/maint_corrupt_%s.db",
+						NumFiles:            1,
+					},
+				},
+			},
+		},
+	}
+
+	cleanMaintenanceStepsFiles()
+	createCorruptDb("../test/maint_corrupt.db", t)
+
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func cleanMaintenanceStepsFiles() {
+	list, _ := filepath.Glob("../test/maint*.db*")
+	for i := range list {
+		os.Remove(list[i])
+	}
+}
+
+func TestMaintenanceSteps(t *testing.T) {
+	code, body := callAdmin(fiber.MethodPost, "/test/_admin/tasks/0/run", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed (%d): %s", code, body)
+		return
+	}
+	var run taskRun
+	if err := json.Unmarshal(body, &run); err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(run.Steps, ",") != "integrity check,analyze,optimize,checkpoint,backup" ||
+		len(run.IntegrityCheck) != 1 || run.IntegrityCheck[0] != "ok" || run.BackupFile == "" {
+		t.Errorf("wrong run: %s", body)
+	}
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(*) AS C FROM sqlite_master WHERE name = 'sqlite_stat1'",
+			},
+		},
+	}
+	code, resBody, res := call("test", req, t)
+	if code != 200 || res.Results[0].ResultSet[0]["C"] != 1.0 {
+		t.Errorf("not analyzed: %s", resBody)
+	}
+}
+
+func TestMaintenanceStepsCorrupt(t *testing.T) {
+	code, body := callAdmin(fiber.MethodPost, "/corrupt/_admin/tasks/0/run", "admin", "secret", t)
+	if code != 500 || !strings.Contains(string(body), "missing from index IDX") || !strings.Contains(string(body), "backup skipped") {
+		t.Errorf("did not fail with the integrity check (%d): %s", code, body)
+	}
+
+	// also on demand
+	code, body = callAdmin(fiber.MethodGet, "/corrupt/_admin/backup", "admin", "secret", t)
+	if code != 500 || !strings.Contains(string(body), "missing from index IDX") || !strings.Contains(string(body), "backup skipped") {
+		t.Errorf("did not fail with the integrity check (%d): %s", code, body)
+	}
+
+	list, _ := filepath.Glob(fmt.Sprintf("../test/maint_corrupt_%s.db", bkpTimeGlob))
+	if len(list) > 0 {
+		t.Errorf("backup taken of a corrupt db: %v", list)
+	}
+
+	code, body = callAdmin(fiber.MethodGet, "/corrupt/_admin/tasks", "admin", "secret", t)
+	var res tasksResponse
+	if err := json.Unmarshal(body, &res); code != 200 || err != nil {
+		t.Errorf("did not succeed (%d): %s", code, body)
+		return
+	}
+	if last := res.Tasks[0].LastRun; last == nil || last.Success || len(last.IntegrityCheck) != 2 {
+		t.Errorf("failure not in the status: %s", body)
+	}
+}
+
+func TestMaintenanceStepsTeardown(t *testing.T) {
+	Shutdown()
+	cleanMaintenanceStepsFiles()
+}
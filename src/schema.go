@@ -0,0 +1,274 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Introspection of the schema of the db, served on GET /<db id>/schema if a
+// "schema" node is configured. The internal tables (sqlite_* and _ws4sqlite_*)
+// are never listed.
+
+type schemaColumn struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	NotNull    bool    `json:"notNull"`
+	Default    *string `json:"default,omitempty"`
+	PrimaryKey int     `json:"primaryKey,omitempty"` // position in the PK, 1-based
+}
+
+type schemaForeignKey struct {
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"refTable"`
+	RefColumns []string `json:"refColumns"`
+	OnUpdate   string   `json:"onUpdate"`
+	OnDelete   string   `json:"onDelete"`
+}
+
+type schemaIndex struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"` // c = CREATE INDEX, u = UNIQUE constraint, pk = PRIMARY KEY
+	Columns []string `json:"columns"`
+}
+
+type schemaTable struct {
+	Name         string             `json:"name"`
+	WithoutRowId bool               `json:"withoutRowid"`
+	Strict       bool               `json:"strict"`
+	Columns      []schemaColumn     `json:"columns"`
+	ForeignKeys  []schemaForeignKey `json:"foreignKeys"`
+	Indexes      []schemaIndex      `json:"indexes"`
+}
+
+type schemaView struct {
+	Name    string         `json:"name"`
+	Columns []schemaColumn `json:"columns"`
+}
+
+type schemaResponse struct {
+	Tables []schemaTable `json:"tables"`
+	Views  []schemaView  `json:"views"`
+}
+
+// Checks the allowlist of the tables and views to show.
+func parseSchema(db *db) {
+	for i := range db.Schema.Tables {
+		if !identifierRegexp.MatchString(db.Schema.Tables[i]) {
+			mllog.Fatalf("for db '%s', schema table name is not valid: %s", db.Id, db.Schema.Tables[i])
+		}
+	}
+	if len(db.Schema.Tables) > 0 {
+		mllog.StdOutf("  + Serving the schema of %d tables/views at /%s/schema", len(db.Schema.Tables), db.Id)
+	} else {
+		mllog.StdOutf("  + Serving the schema at /%s/schema", db.Id)
+	}
+}
+
+func (cfg *schemaCfg) allows(name string) bool {
+	if len(cfg.Tables) == 0 {
+		return true
+	}
+	for i := range cfg.Tables {
+		if cfg.Tables[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func readColumns(ctx context.Context, conn *sql.Conn, table string) ([]schemaColumn, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []schemaColumn{}
+	for rows.Next() {
+		var col schemaColumn
+		var dflt sql.NullString
+		if err := rows.Scan(&col.Name, &col.Type, &col.NotNull, &dflt, &col.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if dflt.Valid {
+			col.Default = &dflt.String
+		}
+		ret = append(ret, col)
+	}
+	return ret, rows.Err()
+}
+
+func readForeignKeys(ctx context.Context, conn *sql.Conn, table string) ([]schemaForeignKey, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT id, "table", "from", "to", on_update, on_delete FROM pragma_foreign_key_list(?) ORDER BY id, seq`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []schemaForeignKey{}
+	lastId := -1
+	for rows.Next() {
+		var id int
+		var refTable, from, onUpdate, onDelete string
+		var to sql.NullString // NULL if it references the PK implicitly
+		if err := rows.Scan(&id, &refTable, &from, &to, &onUpdate, &onDelete); err != nil {
+			return nil, err
+		}
+		if id != lastId {
+			ret = append(ret, schemaForeignKey{RefTable: refTable, OnUpdate: onUpdate, OnDelete: onDelete, Columns: []string{}, RefColumns: []string{}})
+			lastId = id
+		}
+		fk := &ret[len(ret)-1]
+		fk.Columns = append(fk.Columns, from)
+		if to.Valid {
+			fk.RefColumns = append(fk.RefColumns, to.String)
+		}
+	}
+	return ret, rows.Err()
+}
+
+func readIndexes(ctx context.Context, conn *sql.Conn, table string) ([]schemaIndex, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT name, "unique", origin FROM pragma_index_list(?) ORDER BY seq`, table)
+	if err != nil {
+		return nil, err
+	}
+	ret := []schemaIndex{}
+	for rows.Next() {
+		var idx schemaIndex
+		if err := rows.Scan(&idx.Name, &idx.Unique, &idx.Origin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ret = append(ret, idx)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range ret {
+		cols, err := conn.QueryContext(ctx, "SELECT name FROM pragma_index_info(?) ORDER BY seqno", ret[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		ret[i].Columns = []string{}
+		for cols.Next() {
+			var name sql.NullString // NULL for expressions
+			if err := cols.Scan(&name); err != nil {
+				cols.Close()
+				return nil, err
+			}
+			if name.Valid {
+				ret[i].Columns = append(ret[i].Columns, name.String)
+			} else {
+				ret[i].Columns = append(ret[i].Columns, "<expression>")
+			}
+		}
+		cols.Close()
+		if err := cols.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Reads the schema of the db, for the tables and views that are allowed. Must be
+// called while holding the db mutex.
+func readSchema(ctx context.Context, conn *sql.Conn, allows func(string) bool) (*schemaResponse, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name, type, wr, strict FROM pragma_table_list WHERE schema = 'main' "+
+		"AND type IN ('table', 'view') AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name NOT LIKE '\\_ws4sqlite\\_%' ESCAPE '\\' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		name, typ    string
+		wr, isStrict bool
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.name, &e.typ, &e.wr, &e.isStrict); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if allows(e.name) {
+			entries = append(entries, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := &schemaResponse{Tables: []schemaTable{}, Views: []schemaView{}}
+	for _, e := range entries {
+		cols, err := readColumns(ctx, conn, e.name)
+		if err != nil {
+			return nil, fmt.Errorf("in reading columns of %s: %s", e.name, err.Error())
+		}
+		if e.typ == "view" {
+			ret.Views = append(ret.Views, schemaView{Name: e.name, Columns: cols})
+			continue
+		}
+		fks, err := readForeignKeys(ctx, conn, e.name)
+		if err != nil {
+			return nil, fmt.Errorf("in reading foreign keys of %s: %s", e.name, err.Error())
+		}
+		idxs, err := readIndexes(ctx, conn, e.name)
+		if err != nil {
+			return nil, fmt.Errorf("in reading indexes of %s: %s", e.name, err.Error())
+		}
+		ret.Tables = append(ret.Tables, schemaTable{
+			Name:         e.name,
+			WithoutRowId: e.wr,
+			Strict:       e.isStrict,
+			Columns:      cols,
+			ForeignKeys:  fks,
+			Indexes:      idxs,
+		})
+	}
+	return ret, nil
+}
+
+// Endpoint that returns the schema of the db
+func schemaHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db.Mutex.Lock()
+		defer db.Mutex.Unlock()
+
+		schema, err := readSchema(c.Context(), db.DbConn, db.Schema.allows)
+		if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(schema)
+	}
+}
+
+// Registers the schema endpoint, if so configured
+func registerSchema(db *db) {
+	if db.Schema == nil {
+		return
+	}
+
+	handlers := append(endpointHandlers(db, "GET"), schemaHandler(db))
+	app.Get(fmt.Sprintf("/%s/schema", db.Id), handlers...)
+}
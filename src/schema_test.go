@@ -0,0 +1,156 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSchemaSetup(t *testing.T) {
+	initStatements := []string{
+		"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT NOT NULL DEFAULT 'X', UNIQUE (VAL))",
+		"CREATE TABLE T2 (A INTEGER, B TEXT, T1_ID INTEGER REFERENCES T1 ON DELETE CASCADE, PRIMARY KEY (A, B)) WITHOUT ROWID",
+		"CREATE INDEX IDX_T2 ON T2 (T1_ID, B)",
+		"CREATE VIEW V1 AS SELECT ID, VAL FROM T1",
+		"CREATE TABLE _ws4sqlite_internal (ID INTEGER)",
+	}
+	auth := &authr{
+		Mode: "HTTP",
+		ByCredentials: []credentialsCfg{
+			{
+				User:     "myUser",
+				Password: "myPassword",
+			},
+		},
+	}
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:                      "test",
+				Path:                    ":memory:",
+				InitStatements:          initStatements,
+				Auth:                    auth,
+				UseOnlyStoredStatements: true,
+				StoredStatement: []storedStatement{
+					{
+						Id:  "Q",
+						Sql: "SELECT 1",
+					},
+				},
+				Schema: &schemaCfg{},
+			},
+			{
+				Id:             "filtered",
+				Path:           ":memory:",
+				InitStatements: initStatements,
+				Schema: &schemaCfg{
+					Tables: []string{"T1", "V1"},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func getSchema(t *testing.T, dbId string) *schemaResponse {
+	code, raw := callAdmin("GET", "/"+dbId+"/schema", "myUser", "myPassword", t)
+	if code != 200 {
+		t.Errorf("schema endpoint failed: %s", raw)
+		return nil
+	}
+	var ret schemaResponse
+	if err := json.Unmarshal(raw, &ret); err != nil {
+		t.Error(err)
+		return nil
+	}
+	return &ret
+}
+
+func TestSchema(t *testing.T) {
+	schema := getSchema(t, "test")
+	if schema == nil {
+		return
+	}
+	if len(schema.Tables) != 2 || len(schema.Views) != 1 {
+		t.Errorf("wrong number of tables or views: %v", schema)
+		return
+	}
+
+	t1 := schema.Tables[0]
+	if t1.Name != "T1" || t1.WithoutRowId || len(t1.Columns) != 2 {
+		t.Errorf("wrong table: %v", t1)
+		return
+	}
+	if t1.Columns[0].Name != "ID" || t1.Columns[0].Type != "INTEGER" || t1.Columns[0].PrimaryKey != 1 {
+		t.Errorf("wrong column: %v", t1.Columns[0])
+	}
+	if !t1.Columns[1].NotNull || t1.Columns[1].Default == nil || *t1.Columns[1].Default != "'X'" {
+		t.Errorf("wrong column: %v", t1.Columns[1])
+	}
+	if len(t1.Indexes) != 1 || !t1.Indexes[0].Unique || t1.Indexes[0].Origin != "u" || t1.Indexes[0].Columns[0] != "VAL" {
+		t.Errorf("wrong indexes: %v", t1.Indexes)
+	}
+
+	t2 := schema.Tables[1]
+	if t2.Name != "T2" || !t2.WithoutRowId || t2.Columns[1].PrimaryKey != 2 {
+		t.Errorf("wrong table: %v", t2)
+	}
+	if len(t2.ForeignKeys) != 1 || t2.ForeignKeys[0].RefTable != "T1" || t2.ForeignKeys[0].Columns[0] != "T1_ID" ||
+		t2.ForeignKeys[0].OnDelete != "CASCADE" {
+		t.Errorf("wrong foreign keys: %v", t2.ForeignKeys)
+	}
+	found := false
+	for _, idx := range t2.Indexes {
+		if idx.Name == "IDX_T2" && len(idx.Columns) == 2 && idx.Columns[1] == "B" && !idx.Unique {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("index not found: %v", t2.Indexes)
+	}
+
+	if v1 := schema.Views[0]; v1.Name != "V1" || len(v1.Columns) != 2 {
+		t.Errorf("wrong view: %v", v1)
+	}
+}
+
+func TestSchemaFiltered(t *testing.T) {
+	schema := getSchema(t, "filtered")
+	if schema == nil {
+		return
+	}
+	if len(schema.Tables) != 1 || schema.Tables[0].Name != "T1" || len(schema.Views) != 1 {
+		t.Errorf("wrong filtering: %v", schema)
+	}
+}
+
+func TestSchemaUnauthorized(t *testing.T) {
+	code, _ := callAdmin("GET", "/test/schema", "myUser", "wrong", t)
+	if code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+}
+
+func TestSchemaTeardown(t *testing.T) {
+	Shutdown()
+}
@@ -0,0 +1,127 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const defaultSlowQueryLogSize = 100
+
+type slowQuery struct {
+	Timestamp   string  `json:"timestamp"`
+	RequestId   string  `json:"requestId,omitempty"`
+	ReqIdx      int     `json:"reqIdx"`
+	StatementId string  `json:"statementId,omitempty"`
+	Sql         string  `json:"sql,omitempty"`
+	DurationMs  float64 `json:"durationMs"`
+	Rows        int64   `json:"rows"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type slowQueriesResponse struct {
+	ThresholdMs int         `json:"thresholdMs"`
+	SlowQueries []slowQuery `json:"slowQueries"`
+}
+
+// Parses the slow query log configuration
+func parseSlowQueries(db *db) {
+	if db.SlowQueryThresholdMs < 0 || db.SlowQueryLogSize < 0 {
+		mllog.Fatalf("for db '%s', slow query threshold and log size cannot be negative", db.Id)
+	}
+	if db.SlowQueryThresholdMs == 0 {
+		mllog.Fatalf("for db '%s', the slow query log needs a threshold", db.Id)
+	}
+	if db.SlowQueryLogSize == 0 {
+		db.SlowQueryLogSize = defaultSlowQueryLogSize
+	}
+	db.SlowQueries = newRingBuffer[slowQuery](db.SlowQueryLogSize)
+	mllog.StdOutf("  + Logging queries slower than %dms", db.SlowQueryThresholdMs)
+}
+
+// Checks if the execution of an item of a request exceeded the threshold, and
+// if so logs it and keeps it for the admin endpoint. sql is the one sent by
+// the client, so for stored statements it's their ID prefixed by '#'.
+func checkSlowQuery(db *db, c *fiber.Ctx, reqIdx int, sql string, start time.Time, res *responseItem, err error) {
+	if db.SlowQueries == nil {
+		return
+	}
+
+	duration := time.Since(start)
+	if duration < time.Duration(db.SlowQueryThresholdMs)*time.Millisecond {
+		return
+	}
+
+	sq := slowQuery{
+		Timestamp:  start.Format(time.RFC3339Nano),
+		ReqIdx:     reqIdx,
+		DurationMs: float64(duration.Microseconds()) / 1000,
+	}
+	if reqId, ok := c.Locals("requestId").(string); ok {
+		sq.RequestId = reqId
+	}
+	if strings.HasPrefix(sql, "#") {
+		sq.StatementId = sql[1:]
+	} else {
+		sq.Sql = sql
+	}
+	if err != nil {
+		sq.Error = err.Error()
+	} else if res.ResultSet != nil {
+		sq.Rows = int64(len(res.ResultSet))
+	} else if res.RowsUpdated != nil {
+		sq.Rows = *res.RowsUpdated
+	} else {
+		for i := range res.RowsUpdatedBatch {
+			sq.Rows += res.RowsUpdatedBatch[i]
+		}
+	}
+
+	db.SlowQueries.add(sq)
+
+	fields := reqLogFields(c, db.Id)
+	fields["reqIdx"] = reqIdx
+	fields["durationMs"] = sq.DurationMs
+	fields["rows"] = sq.Rows
+	if sq.StatementId != "" {
+		fields["statementId"] = sq.StatementId
+	} else {
+		fields["sql"] = sq.Sql
+	}
+	logWarn(fields, "slow query in db '%s' (%s, %d rows): %s", db.Id, duration, sq.Rows, sql)
+}
+
+// Handler for the admin endpoint that returns the last slow queries, newest first
+func slowQueriesHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ret := slowQueriesResponse{
+			ThresholdMs: db.SlowQueryThresholdMs,
+			SlowQueries: []slowQuery{},
+		}
+		if db.SlowQueries != nil {
+			list := db.SlowQueries.list()
+			for i := len(list) - 1; i >= 0; i-- {
+				ret.SlowQueries = append(ret.SlowQueries, list[i])
+			}
+		}
+		return c.JSON(ret)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const slowQuery1M = "WITH RECURSIVE C(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM C WHERE X < 1000000) SELECT COUNT(*) AS N FROM C"
+
+// GET call to an admin endpoint, with basic auth support
+func callAdmin(method string, path string, user, password string, t *testing.T) (int, []byte) {
+	client := &fiber.Client{}
+	agent := client.Get("http://localhost:12321" + path)
+	if method == fiber.MethodPost {
+		agent = client.Post("http://localhost:12321" + path)
+	}
+	if user != "" {
+		agent = agent.BasicAuth(user, password)
+	}
+	code, body, errs := agent.Bytes()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	return code, body
+}
+
+func TestRingBuffer(t *testing.T) {
+	rb := newRingBuffer[int](3)
+	if len(rb.list()) != 0 {
+		t.Error("buffer should be empty")
+	}
+	rb.add(1)
+	rb.add(2)
+	if l := rb.list(); len(l) != 2 || l[0] != 1 || l[1] != 2 {
+		t.Errorf("wrong content: %v", l)
+	}
+	rb.add(3)
+	rb.add(4)
+	if l := rb.list(); len(l) != 3 || l[0] != 2 || l[2] != 4 {
+		t.Errorf("wrong content after wrapping: %v", l)
+	}
+}
+
+func TestSlowQueriesSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:                   "test",
+				Path:                 ":memory:",
+				SlowQueryThresholdMs: 10,
+				SlowQueryLogSize:     2,
+				StoredStatement: []storedStatement{
+					{
+						Id:  "SLOW",
+						Sql: slowQuery1M,
+					},
+				},
+				Admin: &authr{
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "admin",
+							Password: "secret",
+						},
+					},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestSlowQueriesAdminAuth(t *testing.T) {
+	code, _ := callAdmin(fiber.MethodGet, "/test/_admin/slowQueries", "", "", t)
+	if code != 401 {
+		t.Errorf("did not fail with 401: %d", code)
+	}
+
+	code, _ = callAdmin(fiber.MethodGet, "/test/_admin/slowQueries", "admin", "wrong", t)
+	if code != 401 {
+		t.Errorf("did not fail with 401: %d", code)
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT 1",
+			},
+			{
+				Query: "#SLOW",
+			},
+			{
+				Query: slowQuery1M,
+			},
+		},
+	}
+
+	code, body, _ := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	code, bodyBytes := callAdmin(fiber.MethodGet, "/test/_admin/slowQueries", "admin", "secret", t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", string(bodyBytes))
+		return
+	}
+
+	var res slowQueriesResponse
+	if err := json.Unmarshal(bodyBytes, &res); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res.ThresholdMs != 10 || len(res.SlowQueries) != 2 {
+		t.Errorf("wrong slow queries: %s", string(bodyBytes))
+		return
+	}
+
+	// Newest first
+	if res.SlowQueries[0].ReqIdx != 2 || res.SlowQueries[0].Sql != slowQuery1M {
+		t.Errorf("wrong first slow query: %v", res.SlowQueries[0])
+	}
+
+	if res.SlowQueries[1].StatementId != "SLOW" || res.SlowQueries[1].Rows != 1 || res.SlowQueries[1].RequestId == "" {
+		t.Errorf("wrong second slow query: %v", res.SlowQueries[1])
+	}
+}
+
+func TestSlowQueriesTeardown(t *testing.T) {
+	Shutdown()
+}
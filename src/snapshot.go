@@ -0,0 +1,147 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"modernc.org/sqlite"
+)
+
+// Admin endpoints to download a consistent snapshot of the db (GET, same as
+// /backup) and to replace its content with an uploaded one (PUT). The uploaded
+// file is checked with PRAGMA integrity_check, and then copied over the db
+// with SQLite's backup API, in a single step and holding the db mutex: the
+// connection that serves the requests stays the same, and sees the new content
+// atomically. The configuration derived from the schema (e.g. the REST
+// resources) is not reloaded, so the new db should have the same schema.
+
+// Writes the uploaded body to a temp file, returning its name, so that it's
+// received before holding the db. If the body is too large, the error is a wsError.
+func uploadToTemp(c *fiber.Ctx, db *db) (string, error) {
+	body, err := newUploadReader(c, db)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp("", "ws4sqlite-upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), tmp.Close()
+}
+
+// Copies the content of the db file over the db. Must be called while holding
+// the db mutex.
+func restoreInto(db *db, fname string) error {
+	var bkp *sqlite.Backup
+	if err := db.DbConn.Raw(func(driverConn interface{}) error {
+		conn, ok := driverConn.(interface {
+			NewRestore(srcUri string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("the driver doesn't support restores")
+		}
+		var err error
+		bkp, err = conn.NewRestore(fname)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := db.DbConn.Raw(func(interface{}) error {
+		_, err := bkp.Step(-1)
+		return err
+	}); err != nil {
+		bkp.Finish()
+		return err
+	}
+	return bkp.Finish()
+}
+
+// Updates what depends on the content of the db, after restoreInto(). Must be
+// called while holding the db mutex.
+func restored(db *db) {
+	schemaChanged(db)
+	// The WAL shipped so far is of the old db
+	if ws := db.WALShipper; ws != nil {
+		if err := ws.newGeneration(db); err != nil {
+			logError(logFields{"db": db.Id}, "in starting a new WAL generation for db '%s': %s", db.Id, err.Error())
+			ws.broken = true
+		}
+	}
+}
+
+func snapshotUploadHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if db.ReplicaOf != nil {
+			return newWSError(-1, fiber.StatusConflict, replicaWriteError(db).Error())
+		}
+		if db.ReadOnly {
+			return newWSError(-1, fiber.StatusConflict, "the db is read only")
+		}
+		if db.ChangeFeed {
+			return newWSError(-1, fiber.StatusConflict, "the db serves a change feed, the replicas couldn't follow a new snapshot")
+		}
+
+		start := time.Now()
+
+		fname, err := uploadToTemp(c, db)
+		if wsErr, ok := err.(wsError); ok {
+			return wsErr
+		} else if err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, "In receiving the snapshot: %s", err.Error())
+		}
+		defer os.Remove(fname)
+
+		if stat, err := os.Stat(fname); err != nil {
+			return err
+		} else if stat.Size() == 0 {
+			return newWSError(-1, fiber.StatusBadRequest, "The snapshot is empty")
+		}
+		if err := checkDbFile(fname, "integrity_check"); err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, "The snapshot is not a valid database: %s", err.Error())
+		}
+
+		db.Mutex.Lock()
+		defer db.Mutex.Unlock()
+
+		if err := restoreInto(db, fname); err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, "In restoring the snapshot: %s", err.Error())
+		}
+		restored(db)
+
+		return c.JSON(taskRun{
+			Timestamp:  start.Format(time.RFC3339Nano),
+			TaskIdx:    -1,
+			Trigger:    taskTriggerManual,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Steps:      []string{"restore"},
+			Success:    true,
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSnapshotSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: "../test/snapshot.db",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY)",
+					"INSERT INTO T1 VALUES (1)",
+				},
+				Admin: &authr{
+					ByCredentials: []credentialsCfg{
+						{
+							User:     "admin",
+							Password: "secret",
+						},
+					},
+				},
+				Limits: &limitsCfg{
+					MaxUploadBytes: 1 << 20,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func putSnapshot(t *testing.T, password string, data []byte) (int, string) {
+	agent := fiber.Put("http://localhost:12321/test/_admin/snapshot").
+		BasicAuth("admin", password).
+		Body(data)
+	code, body, errs := agent.String()
+	if len(errs) > 0 {
+		t.Error(errs[0])
+	}
+	return code, body
+}
+
+func countSnapshotRows(t *testing.T) int {
+	code, body, res := call("test", request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(*) AS C FROM T1",
+			},
+		},
+	}, t)
+	if code != 200 {
+		t.Errorf("cannot count: %s", body)
+		return -1
+	}
+	return int(res.Results[0].ResultSet[0]["C"].(float64))
+}
+
+func TestSnapshot(t *testing.T) {
+	code, snapshot := callAdmin(fiber.MethodGet, "/test/_admin/snapshot", "admin", "secret", t)
+	if code != 200 || !strings.HasPrefix(string(snapshot), "SQLite format 3\x00") {
+		t.Errorf("did not download a snapshot (%d)", code)
+		return
+	}
+
+	code, body, _ := call("test", request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (2)",
+			},
+		},
+	}, t)
+	if code != 200 || countSnapshotRows(t) != 2 {
+		t.Errorf("did not insert: %s", body)
+		return
+	}
+
+	if code, body := putSnapshot(t, "secret", snapshot); code != 200 {
+		t.Errorf("did not upload the snapshot (%d): %s", code, body)
+		return
+	}
+	if n := countSnapshotRows(t); n != 1 {
+		t.Errorf("snapshot not restored, %d rows", n)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	if code, body := putSnapshot(t, "secret", []byte("not a database, not a database, not a database")); code != 400 {
+		t.Errorf("expected 400 for an invalid file (%d): %s", code, body)
+	}
+	if code, body := putSnapshot(t, "secret", nil); code != 400 {
+		t.Errorf("expected 400 for an empty file (%d): %s", code, body)
+	}
+	if code, body := putSnapshot(t, "secret", make([]byte, 2<<20)); code != 413 {
+		t.Errorf("expected 413 for a too large file (%d): %s", code, body)
+	}
+	if code, _ := putSnapshot(t, "wrong", nil); code != 401 {
+		t.Errorf("expected 401, got %d", code)
+	}
+	if n := countSnapshotRows(t); n != 1 {
+		t.Errorf("the db was modified, %d rows", n)
+	}
+}
+
+func TestSnapshotTeardown(t *testing.T) {
+	Shutdown()
+	os.Remove("../test/snapshot.db")
+	os.Remove("../test/snapshot.db-wal")
+	os.Remove("../test/snapshot.db-shm")
+}
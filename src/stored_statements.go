@@ -0,0 +1,270 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// The parameters of a stored statement can be declared, with a type and some
+// constraints (required, min/max - the length, for strings -, a regex, a list
+// of allowed values) and a default. If so, the values passed to the stored
+// statement are validated before executing it, and the ones that are not
+// declared are rejected.
+
+var paramTypes = []string{"string", "integer", "number", "boolean"}
+
+// Finds the named parameters (:name, @name or $name) in the SQL, in order of
+// appearance and without duplicates, skipping literals and comments.
+func sqlParams(sqll string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(sqll); i++ {
+		switch ch := sqll[i]; {
+		case ch == '\'' || ch == '"' || ch == '`' || ch == '[':
+			end := ch
+			if ch == '[' {
+				end = ']'
+			}
+			for i++; i < len(sqll) && sqll[i] != end; i++ {
+			}
+		case ch == '-' && strings.HasPrefix(sqll[i:], "--"):
+			for ; i < len(sqll) && sqll[i] != '\n'; i++ {
+			}
+		case ch == '/' && strings.HasPrefix(sqll[i:], "/*"):
+			if end := strings.Index(sqll[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(sqll)
+			}
+		case ch == ':' || ch == '@' || ch == '$':
+			j := i + 1
+			for ; j < len(sqll) && (sqll[j] == '_' || isAlphaNum(sqll[j])); j++ {
+			}
+			if name := sqll[i+1 : j]; name != "" && !seen[name] {
+				seen[name] = true
+				ret = append(ret, name)
+			}
+			i = j - 1
+		}
+	}
+	return ret
+}
+
+func isAlphaNum(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// The YAML parser returns map[interface{}]interface{} for the nested maps, that
+// can't be serialized to JSON.
+func normalizeYAML(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		ret := make(jsonObject)
+		for k, vv := range v {
+			ret[fmt.Sprint(k)] = normalizeYAML(vv)
+		}
+		return ret
+	case jsonObject:
+		ret := make(jsonObject)
+		for k, vv := range v {
+			ret[k] = normalizeYAML(vv)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			ret[i] = normalizeYAML(v[i])
+		}
+		return ret
+	}
+	return val
+}
+
+// Converts a value from the config to what it would be if it came from a
+// request, so that they can be compared (e.g. numbers are float64).
+func yaml2json(val interface{}) (interface{}, error) {
+	bytes, err := json.Marshal(normalizeYAML(val))
+	if err != nil {
+		return nil, err
+	}
+	var ret interface{}
+	err = json.Unmarshal(bytes, &ret)
+	return ret, err
+}
+
+// Checks the declared parameters and the example of a stored statement. If
+// some parameters are declared, all of them must be, as the values of the
+// undeclared ones are rejected.
+func parseStoredStatementAnnotations(db *db, ss *storedStatement) {
+	params := sqlParams(ss.Sql)
+	if len(ss.Params) > 0 {
+		for _, name := range params {
+			if ss.param(name) == nil {
+				mllog.Fatalf("for db '%s', parameter '%s' of stored statement '%s' is not declared, while others are", db.Id, name, ss.Id)
+			}
+		}
+	}
+	for i := range ss.Params {
+		p := &ss.Params[i]
+		if !contains(params, p.Name) {
+			mllog.Fatalf("for db '%s', parameter '%s' of stored statement '%s' is not in its SQL", db.Id, p.Name, ss.Id)
+		}
+		if p.Type != "" && !contains(paramTypes, p.Type) {
+			mllog.Fatalf("for db '%s', parameter type must be one of %s", db.Id, strings.Join(paramTypes, ", "))
+		}
+		if p.Pattern != "" {
+			if p.Type != "string" {
+				mllog.Fatalf("for db '%s', parameter '%s' of stored statement '%s' has a pattern but is not a string", db.Id, p.Name, ss.Id)
+			}
+			var err error
+			if p.regexp, err = regexp.Compile(p.Pattern); err != nil {
+				mllog.Fatalf("for db '%s', pattern of parameter '%s' of stored statement '%s' is not valid: %s", db.Id, p.Name, ss.Id, err.Error())
+			}
+		}
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			mllog.Fatalf("for db '%s', parameter '%s' of stored statement '%s' has min greater than max", db.Id, p.Name, ss.Id)
+		}
+		for j := range p.Enum {
+			val, err := yaml2json(p.Enum[j])
+			if err == nil {
+				switch val.(type) {
+				case jsonObject, []interface{}:
+					err = fmt.Errorf("must be a scalar")
+				default:
+					err = p.validate(val)
+				}
+			}
+			if err != nil {
+				mllog.Fatalf("for db '%s', enum value of parameter '%s' of stored statement '%s' is not valid: %s", db.Id, p.Name, ss.Id, err.Error())
+			}
+			p.Enum[j] = val
+		}
+		if p.Default != nil {
+			val, err := yaml2json(p.Default)
+			if err == nil {
+				err = p.validate(val)
+			}
+			if err != nil {
+				mllog.Fatalf("for db '%s', default of parameter '%s' of stored statement '%s' is not valid: %s", db.Id, p.Name, ss.Id, err.Error())
+			}
+			p.Default = val
+		}
+	}
+	for name := range ss.Example {
+		if !contains(params, name) {
+			mllog.Fatalf("for db '%s', example parameter '%s' of stored statement '%s' is not in its SQL", db.Id, name, ss.Id)
+		}
+	}
+	if ss.Example != nil {
+		ss.Example = normalizeYAML(ss.Example).(jsonObject)
+	}
+}
+
+func (ss *storedStatement) param(name string) *storedStatementParam {
+	for i := range ss.Params {
+		if ss.Params[i].Name == name {
+			return &ss.Params[i]
+		}
+	}
+	return nil
+}
+
+// Validates a (non-null) value against the declaration of the parameter
+func (p *storedStatementParam) validate(val interface{}) error {
+	switch p.Type {
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("parameter '%s' must be a string", p.Name)
+		}
+		if p.Min != nil && float64(len([]rune(str))) < *p.Min {
+			return fmt.Errorf("parameter '%s' must be at least %v characters long", p.Name, *p.Min)
+		}
+		if p.Max != nil && float64(len([]rune(str))) > *p.Max {
+			return fmt.Errorf("parameter '%s' must be at most %v characters long", p.Name, *p.Max)
+		}
+		if p.regexp != nil && !p.regexp.MatchString(str) {
+			return fmt.Errorf("parameter '%s' must match %s", p.Name, p.Pattern)
+		}
+	case "integer", "number":
+		num, ok := val.(float64)
+		if p.Type == "integer" && (!ok || num != math.Trunc(num)) {
+			return fmt.Errorf("parameter '%s' must be an integer", p.Name)
+		}
+		if !ok {
+			return fmt.Errorf("parameter '%s' must be a number", p.Name)
+		}
+		if p.Min != nil && num < *p.Min {
+			return fmt.Errorf("parameter '%s' must be at least %v", p.Name, *p.Min)
+		}
+		if p.Max != nil && num > *p.Max {
+			return fmt.Errorf("parameter '%s' must be at most %v", p.Name, *p.Max)
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("parameter '%s' must be a boolean", p.Name)
+		}
+	}
+	return nil
+}
+
+// Validates the values passed to a stored statement with declared parameters,
+// filling in the defaults. Returns an error suitable for the response.
+func validateParams(ss *storedStatement, values map[string]interface{}) error {
+	for name := range values {
+		if ss.param(name) == nil {
+			return fmt.Errorf("parameter '%s' is not accepted by stored statement '%s'", name, ss.Id)
+		}
+	}
+	for i := range ss.Params {
+		p := &ss.Params[i]
+		val, ok := values[p.Name]
+		if !ok && p.Default != nil {
+			values[p.Name] = p.Default
+			continue
+		}
+		if !ok || val == nil {
+			if p.Required {
+				return fmt.Errorf("parameter '%s' is required", p.Name)
+			}
+			continue
+		}
+		if err := p.validate(val); err != nil {
+			return err
+		}
+		if len(p.Enum) > 0 {
+			found := false
+			for j := range p.Enum {
+				if p.Enum[j] == val {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("parameter '%s' must be one of %v", p.Name, p.Enum)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+func TestStoredStatementParamsSetup(t *testing.T) {
+	one, ten := 1.0, 10.0
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, CODE TEXT, QTY INTEGER, KIND TEXT)",
+				},
+				UseOnlyStoredStatements: true,
+				StoredStatement: []storedStatement{
+					{
+						Id:  "INS",
+						Sql: "INSERT INTO T1 (ID, CODE, QTY, KIND) VALUES (:id, :code, :qty, :kind)",
+						Params: []storedStatementParam{
+							{
+								Name:     "id",
+								Type:     "integer",
+								Required: true,
+							}, {
+								Name:    "code",
+								Type:    "string",
+								Pattern: "^[A-Z]{3}$",
+							}, {
+								Name: "qty",
+								Type: "number",
+								Min:  &one,
+								Max:  &ten,
+							}, {
+								Name:    "kind",
+								Type:    "string",
+								Enum:    []interface{}{"A", "B"},
+								Default: "A",
+							},
+						},
+					}, {
+						Id:  "SEL",
+						Sql: "SELECT * FROM T1 WHERE ID = :id",
+					},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func insertWithParams(t *testing.T, values map[string]interface{}) (int, string) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "#INS",
+				Values:    mkRaw(values),
+			},
+		},
+	}
+	code, body, _ := call("test", req, t)
+	return code, body
+}
+
+func TestStoredStatementParams(t *testing.T) {
+	code, body := insertWithParams(t, map[string]interface{}{"id": 1, "code": "ABC", "qty": 2.5})
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	// the default is applied
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query:  "#SEL",
+				Values: mkRaw(map[string]interface{}{"id": 1}),
+			},
+		},
+	}
+	code, body, res := call("test", req, t)
+	if code != 200 || res.Results[0].ResultSet[0]["KIND"] != "A" {
+		t.Errorf("default not applied: %s", body)
+	}
+
+	for _, tc := range []struct {
+		values map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"code": "ABC"}, "parameter 'id' is required"},
+		{map[string]interface{}{"id": nil}, "parameter 'id' is required"},
+		{map[string]interface{}{"id": 1.5}, "parameter 'id' must be an integer"},
+		{map[string]interface{}{"id": "2"}, "parameter 'id' must be an integer"},
+		{map[string]interface{}{"id": 2, "code": "abc"}, "parameter 'code' must match"},
+		{map[string]interface{}{"id": 2, "qty": 11}, "parameter 'qty' must be at most 10"},
+		{map[string]interface{}{"id": 2, "qty": 0}, "parameter 'qty' must be at least 1"},
+		{map[string]interface{}{"id": 2, "kind": "C"}, "parameter 'kind' must be one of"},
+		{map[string]interface{}{"id": 2, "other": 1}, "parameter 'other' is not accepted"},
+	} {
+		code, body := insertWithParams(t, tc.values)
+		if code != 400 || !strings.Contains(body, tc.err) {
+			t.Errorf("expected 400 with '%s', got %d: %s", tc.err, code, body)
+		}
+	}
+
+	// in a batch, with noFail the whole item fails
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "#INS",
+				NoFail:    true,
+				ValuesBatch: []map[string]json.RawMessage{
+					mkRaw(map[string]interface{}{"id": 3}),
+					mkRaw(map[string]interface{}{"id": 4, "kind": "Z"}),
+				},
+			}, {
+				Query:  "#SEL",
+				Values: mkRaw(map[string]interface{}{"id": 3}),
+			},
+		},
+	}
+	code, body, res = call("test", req, t)
+	if code != 200 || res.Results[0].Success || !strings.Contains(res.Results[0].Error, "n valuesBatch #1") {
+		t.Errorf("batch should have failed: %s", body)
+		return
+	}
+	if len(res.Results[1].ResultSet) != 0 {
+		t.Errorf("batch should not have been executed: %s", body)
+	}
+}
+
+func TestStoredStatementParamsTeardown(t *testing.T) {
+	Shutdown()
+}
+
+func TestStoredStatementParamsPartial(t *testing.T) {
+	orig := mllog.WhenFatal
+	defer func() { mllog.WhenFatal = orig }()
+	mllog.WhenFatal = func(msg string) { panic(msg) }
+
+	ss := storedStatement{
+		Id:  "PARTIAL",
+		Sql: "INSERT INTO T1 (ID, CODE) VALUES (:id, :code)",
+		Params: []storedStatementParam{
+			{
+				Name: "id",
+				Type: "integer",
+			},
+		},
+	}
+	ret := ""
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ret = r.(string)
+			}
+		}()
+		parseStoredStatementAnnotations(&db{Id: "test"}, &ss)
+	}()
+	if !strings.Contains(ret, "parameter 'code' of stored statement 'PARTIAL' is not declared") {
+		t.Errorf("a partial declaration was accepted: %s", ret)
+	}
+}
@@ -20,7 +20,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
+	"regexp"
 	"sync"
+	"text/template"
+	"time"
 )
 
 // This is the ws4sqlite error type
@@ -43,14 +47,26 @@ func newWSError(reqIdx int, code int, msg string, elements ...interface{}) wsErr
 // and storing additional context
 
 type scheduledTask struct {
-	Schedule       *string  `yaml:"schedule"`
-	AtStartup      *bool    `yaml:"atStartup"`
-	DoVacuum       bool     `yaml:"doVacuum"`
-	DoBackup       bool     `yaml:"doBackup"`
-	BackupTemplate string   `yaml:"backupTemplate"`
-	NumFiles       int      `yaml:"numFiles"`
-	Statements     []string `yaml:"statements"`
-	Db             *db
+	Schedule            *string  `yaml:"schedule"`
+	AtStartup           *bool    `yaml:"atStartup"`
+	DoIntegrityCheck    bool     `yaml:"doIntegrityCheck"`
+	QuickCheck          bool     `yaml:"quickCheck"` // quick_check instead of integrity_check
+	SkipBackupIfCorrupt bool     `yaml:"skipBackupIfCorrupt"`
+	DoVacuum            bool     `yaml:"doVacuum"`
+	DoAnalyze           bool     `yaml:"doAnalyze"`
+	DoOptimize          bool     `yaml:"doOptimize"`
+	DoCheckpoint        bool     `yaml:"doCheckpoint"`
+	CheckpointMode      string   `yaml:"checkpointMode"` // PASSIVE, FULL, RESTART or TRUNCATE (the default)
+	DoBackup            bool     `yaml:"doBackup"`
+	BackupTemplate      string   `yaml:"backupTemplate"`
+	NumFiles            int      `yaml:"numFiles"`
+	BackupMode          string   `yaml:"backupMode"`
+	BackupPagesPerStep  int      `yaml:"backupPagesPerStep"`
+	BackupCompression   string   `yaml:"backupCompression"`
+	BackupEncryptionKey string   `yaml:"backupEncryptionKey"`
+	BackupS3            *s3Cfg   `yaml:"backupS3"`
+	Statements          []string `yaml:"statements"`
+	Db                  *db
 }
 
 type credentialsCfg struct {
@@ -60,16 +76,57 @@ type credentialsCfg struct {
 }
 
 type authr struct {
-	Mode            string           `yaml:"mode"` // 'INLINE' or 'HTTP'
+	Mode            string           `yaml:"mode"` // 'INLINE', 'HTTP' or 'CERT'
 	CustomErrorCode *int             `yaml:"customErrorCode"`
 	ByQuery         string           `yaml:"byQuery"`
 	ByCredentials   []credentialsCfg `yaml:"byCredentials"`
+	ByClientCert    []string         `yaml:"byClientCert"`
 	HashedCreds     map[string][]byte
+	AllowedCNs      map[string]bool
+}
+
+type auditCfg struct {
+	ToFile         string   `yaml:"toFile"`
+	ToTable        string   `yaml:"toTable"`
+	IncludeQueries bool     `yaml:"includeQueries"`
+	RedactFields   []string `yaml:"redactFields"`
+	Redacted       map[string]bool
+	File           *os.File
+}
+
+type limitsCfg struct {
+	MaxRequestBytes     int   `yaml:"maxRequestBytes"`
+	MaxTransactionItems int   `yaml:"maxTransactionItems"`
+	MaxBatchLength      int   `yaml:"maxBatchLength"`
+	MaxResultRows       int   `yaml:"maxResultRows"`
+	MaxResponseBytes    int   `yaml:"maxResponseBytes"`
+	MaxUploadBytes      int64 `yaml:"maxUploadBytes"` // for imports and snapshots, that are streamed
+	Truncate            bool  `yaml:"truncate"`
 }
 
 type storedStatement struct {
-	Id  string `yaml:"id"`
-	Sql string `yaml:"sql"`
+	Id             string                 `yaml:"id"`
+	Sql            string                 `yaml:"sql"`
+	Description    string                 `yaml:"description"`
+	Params         []storedStatementParam `yaml:"params"`
+	Example        map[string]interface{} `yaml:"example"`
+	ExposeAsGet    bool                   `yaml:"exposeAsGet"`
+	CacheMaxAgeSec int                    `yaml:"cacheMaxAgeSec"`
+}
+
+// Declaration of a named parameter of a stored statement, used to validate the
+// values and for the OpenAPI document
+type storedStatementParam struct {
+	Name        string        `yaml:"name"`
+	Type        string        `yaml:"type"` // string, integer, number or boolean
+	Description string        `yaml:"description"`
+	Required    bool          `yaml:"required"`
+	Min         *float64      `yaml:"min"` // for strings, the length
+	Max         *float64      `yaml:"max"`
+	Pattern     string        `yaml:"pattern"`
+	Enum        []interface{} `yaml:"enum"`
+	Default     interface{}   `yaml:"default"`
+	regexp      *regexp.Regexp
 }
 
 type db struct {
@@ -85,17 +142,163 @@ type db struct {
 	ScheduledTasks          []scheduledTask   `yaml:"scheduledTasks"`
 	StoredStatement         []storedStatement `yaml:"storedStatements"`
 	InitStatements          []string          `yaml:"initStatements"`
+	Audit                   *auditCfg         `yaml:"audit"`
+	Admin                   *authr            `yaml:"admin"`
+	SlowQueryThresholdMs    int               `yaml:"slowQueryThresholdMs"`
+	SlowQueryLogSize        int               `yaml:"slowQueryLogSize"`
+	SlowQueries             *ringBuffer[slowQuery]
+	MaxQueryTimeMs          int        `yaml:"maxQueryTimeMs"`
+	Limits                  *limitsCfg `yaml:"limits"`
+	TaskHistorySize         int        `yaml:"taskHistorySize"`
+	TaskHistoryTable        string     `yaml:"taskHistoryTable"`
+	TaskHistory             *ringBuffer[taskRun]
+	WALShipping             *walShippingCfg  `yaml:"walShipping"`
+	ChangeFeed              bool             `yaml:"changeFeed"`
+	ChangeFeedRetention     *retentionCfg    `yaml:"changeFeedRetention"`
+	ReplicaOf               *replicaCfg      `yaml:"replicaOf"`
+	ChangeEvents            *changeEventsCfg `yaml:"changeEvents"`
+	Webhooks                []webhookCfg     `yaml:"webhooks"`
+	Migrations              []migration      `yaml:"migrations"`
+	MigrationsDir           string           `yaml:"migrationsDir"`
+	Schema                  *schemaCfg       `yaml:"schema"`
+	Rest                    *restCfg         `yaml:"rest"`
+	OpenAPI                 *openAPICfg      `yaml:"openApi"`
+	Csv                     *csvCfg          `yaml:"csv"`
+	Import                  *importCfg       `yaml:"import"`
+	WALShipper              *walShipper
+	ChangeBroker            *changeBroker
+	RestTables              map[string]*restTable
 	Db                      *sql.DB
 	DbConn                  *sql.Conn
 	StoredStatsMap          map[string]string
+	StoredStatsParams       map[string]*storedStatement // the ones with declared parameters
 	Mutex                   *sync.Mutex
+	Tasks                   []runnableTask
+}
+
+// S3-compatible destination for the backups. Credentials are taken from the
+// environment (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN).
+type s3Cfg struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	TimeoutMs int    `yaml:"timeoutMs"`
+}
+
+// Parameters of the --restore command
+type restoreCfg struct {
+	From   string
+	Into   string
+	Key    string
+	ToTime *time.Time
+}
+
+// How many changes of a change feed are kept, and for how long; 0 is no limit
+type retentionCfg struct {
+	MaxChanges int `yaml:"maxChanges"`
+	MaxAgeSec  int `yaml:"maxAgeSec"`
+}
+
+// Primary to replicate from; the credentials are for its admin endpoints
+type replicaCfg struct {
+	Url            string `yaml:"url"`
+	User           string `yaml:"user"`
+	Password       string `yaml:"password"`
+	PollIntervalMs int    `yaml:"pollIntervalMs"`
+	Stop           chan struct{}
+}
+
+type changeEventsCfg struct {
+	BufferSize int      `yaml:"bufferSize"`
+	Tables     []string `yaml:"tables"`
+}
+
+// A webhook, called for the changes to some tables (optionally only for some
+// operations) and/or for the outcome of the scheduled tasks
+type webhookCfg struct {
+	Url            string   `yaml:"url"`
+	Tables         []string `yaml:"tables"`
+	Operations     []string `yaml:"operations"`
+	Tasks          []string `yaml:"tasks"`
+	Template       string   `yaml:"template"`
+	ContentType    string   `yaml:"contentType"`
+	Secret         string   `yaml:"secret"`
+	MaxRetries     *int     `yaml:"maxRetries"` // nil for the default, 0 for no retries
+	RetryBackoffMs int      `yaml:"retryBackoffMs"`
+	TimeoutMs      int      `yaml:"timeoutMs"`
+	template       *template.Template
+	queue          chan webhookCall
+}
+
+// Enables the schema endpoint; if Tables is given, only those tables and views are shown
+type schemaCfg struct {
+	Tables []string `yaml:"tables"`
+}
+
+// Enables the CRUD resources for the tables; if Tables is given, only for those
+// tables and views (and, for each, only for the given operations)
+type restCfg struct {
+	Tables       []restTableCfg `yaml:"tables"`
+	DefaultLimit int            `yaml:"defaultLimit"`
+	MaxLimit     int            `yaml:"maxLimit"`
+}
+
+type restTableCfg struct {
+	Name       string   `yaml:"name"`
+	Operations []string `yaml:"operations"`
+}
+
+// Enables the OpenAPI document; StoredStatements also describes each stored statement,
+// and IncludeSql adds its SQL (as "x-sql"), that is otherwise not disclosed
+type openAPICfg struct {
+	Title            string `yaml:"title"`
+	Version          string `yaml:"version"`
+	StoredStatements bool   `yaml:"storedStatements"`
+	IncludeSql       bool   `yaml:"includeSql"`
+	document         []byte
+}
+
+// Defaults for the CSV/TSV export of the result sets
+type csvCfg struct {
+	Delimiter string `yaml:"delimiter"` // only for CSV, TSV always uses tabs
+	NoHeader  bool   `yaml:"noHeader"`
+	Null      string `yaml:"null"`
+}
+
+// Enables the bulk import; if Tables is empty, all the tables can be imported
+type importCfg struct {
+	Tables []string `yaml:"tables"`
+}
+
+type migration struct {
+	Version     int      `yaml:"version"`
+	Description string   `yaml:"description"`
+	Statements  []string `yaml:"statements"`
+}
+
+type walShippingCfg struct {
+	Dir                 string `yaml:"dir"`
+	CheckpointBytes     int    `yaml:"checkpointBytes"`
+	EpochsPerGeneration int    `yaml:"epochsPerGeneration"`
+	KeepGenerations     int    `yaml:"keepGenerations"`
+}
+
+type tlsCfg struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
 }
 
 type config struct {
-	Bindhost  string
-	Port      int
-	Databases []db
-	ServeDir  *string
+	Bindhost    string
+	Port        int
+	Databases   []db
+	ServeDir    *string
+	TLS         *tlsCfg
+	LogFormat   string
+	Restore     *restoreCfg
+	MigrateOnly bool
 }
 
 // These are for parsing the request (from JSON)
@@ -123,6 +326,7 @@ type requestItem struct {
 
 type request struct {
 	Credentials *credentials  `json:"credentials"`
+	TimeoutMs   int           `json:"timeoutMs"`
 	Transaction []requestItem `json:"transaction"`
 }
 
@@ -134,6 +338,8 @@ type responseItem struct {
 	RowsUpdatedBatch []int64                  `json:"rowsUpdatedBatch,omitempty"`
 	ResultSet        []map[string]interface{} `json:"resultSet,omitnil"` // omitnil is used by jettison
 	Error            string                   `json:"error,omitempty"`
+	Truncated        bool                     `json:"truncated,omitempty"`
+	columns          []string                 // for the export, in order
 }
 
 type response struct {
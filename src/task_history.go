@@ -0,0 +1,160 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	mllog "github.com/proofrock/go-mylittlelogger"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	defaultTaskHistorySize = 100
+
+	taskTriggerSchedule = "schedule"
+	taskTriggerStartup  = "startup"
+	taskTriggerManual   = "manual"
+)
+
+// The outcome of a run of a scheduled task
+type taskRun struct {
+	Timestamp  string   `json:"timestamp"`
+	TaskIdx    int      `json:"taskIdx"`
+	Trigger    string   `json:"trigger"`
+	DurationMs float64  `json:"durationMs"`
+	Steps      []string `json:"steps"`
+	Success    bool     `json:"success"`
+	Error      string   `json:"error,omitempty"`
+	BackupFile string   `json:"backupFile,omitempty"`
+	// The outcome of the integrity check, if any: "ok" or the problems found
+	IntegrityCheck []string `json:"integrityCheck,omitempty"`
+}
+
+// A parsed scheduled task, kept in the db to run it on demand and to know
+// its status. Backup runs only the backup of the task, and is nil if it doesn't
+// take one. EntryID is 0 if it's not scheduled with cron.
+type runnableTask struct {
+	Run     func(trigger string) taskRun
+	Backup  func(trigger string) taskRun
+	EntryID cron.EntryID
+}
+
+type taskStatus struct {
+	Idx       int      `json:"idx"`
+	Schedule  *string  `json:"schedule,omitempty"`
+	AtStartup bool     `json:"atStartup"`
+	NextRun   string   `json:"nextRun,omitempty"`
+	LastRun   *taskRun `json:"lastRun,omitempty"`
+}
+
+type tasksResponse struct {
+	Tasks   []taskStatus `json:"tasks"`
+	History []taskRun    `json:"history"`
+}
+
+// Prepares the history of the task runs, and the table to persist it to, if so
+// configured.
+func parseTaskHistory(db *db) {
+	if db.TaskHistorySize < 0 {
+		mllog.Fatalf("for db '%s', task history size cannot be negative", db.Id)
+	}
+	if db.TaskHistorySize == 0 {
+		db.TaskHistorySize = defaultTaskHistorySize
+	}
+	db.TaskHistory = newRingBuffer[taskRun](db.TaskHistorySize)
+
+	if db.TaskHistoryTable == "" {
+		return
+	}
+	if !identifierRegexp.MatchString(db.TaskHistoryTable) {
+		mllog.Fatalf("for db '%s', task history table name is not valid: %s", db.Id, db.TaskHistoryTable)
+	}
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', cannot write the task history to a table of a read only db", db.Id)
+	}
+	if _, err := db.DbConn.ExecContext(context.Background(), fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (TS TEXT, TASK_IDX INTEGER, TRIGGERED_BY TEXT, DURATION_MS REAL, "+
+			"STEPS TEXT, SUCCESS INTEGER, ERROR TEXT, BACKUP_FILE TEXT)",
+		db.TaskHistoryTable)); err != nil {
+		mllog.Fatalf("for db '%s', in creating task history table: %s", db.Id, err.Error())
+	}
+	mllog.StdOutf("  + Task history persisted to table %s", db.TaskHistoryTable)
+}
+
+// Records a task run. Must be called while holding the db mutex. The history
+// is only kept for the dbs that have scheduled tasks.
+func recordTaskRun(db *db, run taskRun) {
+	if db.TaskHistory == nil {
+		return
+	}
+	db.TaskHistory.add(run)
+
+	if db.TaskHistoryTable == "" {
+		return
+	}
+	if _, err := db.DbConn.ExecContext(context.Background(),
+		fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?, ?, ?)", db.TaskHistoryTable),
+		run.Timestamp, run.TaskIdx, run.Trigger, run.DurationMs, strings.Join(run.Steps, ","),
+		run.Success, run.Error, run.BackupFile); err != nil {
+		logError(logFields{"db": db.Id}, "in writing task history for db '%s': %s", db.Id, err.Error())
+	}
+}
+
+// Admin endpoint that returns the status of the tasks (with the next scheduled
+// run) and the history of their runs, newest first.
+func tasksHandler(db *db) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ret := tasksResponse{
+			Tasks:   []taskStatus{},
+			History: []taskRun{},
+		}
+
+		if db.TaskHistory != nil {
+			list := db.TaskHistory.list()
+			for i := len(list) - 1; i >= 0; i-- {
+				ret.History = append(ret.History, list[i])
+			}
+		}
+
+		for idx := range db.Tasks {
+			status := taskStatus{
+				Idx:       idx,
+				Schedule:  db.ScheduledTasks[idx].Schedule,
+				AtStartup: db.ScheduledTasks[idx].AtStartup != nil && *db.ScheduledTasks[idx].AtStartup,
+			}
+			if db.Tasks[idx].EntryID != 0 {
+				if next := scheduler.Entry(db.Tasks[idx].EntryID).Next; !next.IsZero() {
+					status.NextRun = next.Format(time.RFC3339)
+				}
+			}
+			for i := range ret.History {
+				if ret.History[i].TaskIdx == idx {
+					status.LastRun = &ret.History[i]
+					break
+				}
+			}
+			ret.Tasks = append(ret.Tasks, status)
+		}
+
+		return c.JSON(ret)
+	}
+}
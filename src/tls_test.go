@@ -0,0 +1,213 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const (
+	tlsCAFile     = "../test/tls_ca.pem"
+	tlsCertFile   = "../test/tls_cert.pem"
+	tlsKeyFile    = "../test/tls_key.pem"
+	tlsClientUser = "myClient"
+)
+
+var tlsCAPool *x509.CertPool
+var tlsCA *x509.Certificate
+var tlsCAKey *ecdsa.PrivateKey
+
+// Generates a certificate, signed by the test CA (or self-signed, if it's the CA itself)
+func genCert(t *testing.T, cn string, isCA bool, isServer bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else if isServer {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	parent, parentKey := tmpl, key
+	if !isCA {
+		parent, parentKey = tlsCA, tlsCAKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func genClientCert(t *testing.T, cn string) tls.Certificate {
+	_, _, certPem, keyPem := genCert(t, cn, false, false)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func callTLS(t *testing.T, clientCert *tls.Certificate) (int, error) {
+	tlsConfig := &tls.Config{RootCAs: tlsCAPool}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+
+	req := request{Transaction: []requestItem{{Query: "SELECT 1"}}}
+	jsonData, _ := json.Marshal(req)
+	res, err := client.Post("https://localhost:12321/test", "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestTLSSetup(t *testing.T) {
+	var caPem []byte
+	tlsCA, tlsCAKey, caPem, _ = genCert(t, "ws4sqlite test CA", true, false)
+	tlsCAPool = x509.NewCertPool()
+	tlsCAPool.AddCert(tlsCA)
+	_, _, certPem, keyPem := genCert(t, "localhost", false, true)
+
+	os.WriteFile(tlsCAFile, caPem, 0600)
+	os.WriteFile(tlsCertFile, certPem, 0600)
+	os.WriteFile(tlsKeyFile, keyPem, 0600)
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		TLS: &tlsCfg{
+			CertFile:     tlsCertFile,
+			KeyFile:      tlsKeyFile,
+			ClientCAFile: tlsCAFile,
+		},
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:         "cert", // check if case insensitive
+					ByClientCert: []string{tlsClientUser},
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestTLSNoClientCert(t *testing.T) {
+	if _, err := callTLS(t, nil); err == nil {
+		t.Error("did succeed, but shouldn't have")
+	}
+}
+
+func TestTLSClientCertOK(t *testing.T) {
+	cert := genClientCert(t, tlsClientUser)
+	code, err := callTLS(t, &cert)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if code != 200 {
+		t.Errorf("did not succeed, but should have: %d", code)
+	}
+}
+
+func TestTLSClientCertWrongUser(t *testing.T) {
+	cert := genClientCert(t, "someoneElse")
+	code, err := callTLS(t, &cert)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if code != 401 {
+		t.Errorf("did not fail with 401: %d", code)
+	}
+}
+
+func TestTLSTeardown(t *testing.T) {
+	Shutdown()
+	os.Remove(tlsCAFile)
+	os.Remove(tlsCertFile)
+	os.Remove(tlsKeyFile)
+}
+
+func TestTLSCertAuthWithoutClientCA(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				Auth: &authr{
+					Mode:         "CERT",
+					ByClientCert: []string{tlsClientUser},
+				},
+			},
+		},
+	}
+
+	success := true
+	mllog.WhenFatal = func(msg string) { success = false }
+	defer func() { mllog.WhenFatal = func(msg string) { os.Exit(1) } }()
+	go launch(cfg, true)
+	time.Sleep(time.Second)
+	Shutdown()
+	if success {
+		t.Error("did succeed, but shouldn't have")
+	}
+}
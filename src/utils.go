@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Uppercases (?) the first letter of a string
@@ -121,3 +122,36 @@ func splitOnColon(toSplit string) (string, string) {
 	}
 	return toSplit, ""
 }
+
+// A fixed-size buffer that keeps the last elements added to it, safe for
+// concurrent use
+type ringBuffer[T any] struct {
+	mutex sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+func newRingBuffer[T any](size int) *ringBuffer[T] {
+	return &ringBuffer[T]{items: make([]T, size)}
+}
+
+func (r *ringBuffer[T]) add(item T) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns the elements in the buffer, from the oldest to the newest
+func (r *ringBuffer[T]) list() []T {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.full {
+		return append([]T{}, r.items[:r.next]...)
+	}
+	return append(append([]T{}, r.items[r.next:]...), r.items[:r.next]...)
+}
@@ -0,0 +1,448 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Continuous shipping of the WAL, for point-in-time recovery. As ws4sqlite owns
+// the only connection that writes to the db, it can disable the automatic
+// checkpoints and copy the WAL frames after each transaction, before they're
+// checkpointed into the db file.
+//
+// The files in the directory are organized as:
+//
+//	<dir>/<generation>/snapshot.db
+//	<dir>/<generation>/<epoch>/<offset>_<timestamp>.seg
+//
+// A generation starts with a snapshot of the db file, taken after a checkpoint
+// that truncates the WAL (at startup, or when something goes wrong). An epoch is
+// the life of the WAL between two checkpoints, and the segments are the bytes
+// appended to it by the committed transactions, with the time they were shipped.
+// To restore, the segments of each epoch are concatenated and checkpointed into
+// the snapshot, in order, up to the desired time.
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+
+	defaultWalCheckpointBytes     = 16 * 1024 * 1024
+	defaultWalEpochsPerGeneration = 100
+
+	walGenTimeFormat = "20060102-150405.000000000"
+	walSnapshotFile  = "snapshot.db"
+	walSegmentExt    = ".seg"
+)
+
+type walShipper struct {
+	dir                 string
+	walPath             string
+	checkpointBytes     int64
+	epochsPerGeneration int
+	keepGenerations     int
+
+	gen    string
+	epoch  int
+	offset int64  // the WAL is shipped up to here
+	salt   []byte // of the current epoch, to detect restarts of the WAL not done by us
+	broken bool   // if true, a new generation must be started
+}
+
+// Validates the configuration, disables the automatic checkpoints and starts
+// the first generation.
+func parseWALShipping(db *db) {
+	cfg := db.WALShipping
+	if cfg.Dir == "" {
+		mllog.Fatalf("for db '%s', WAL shipping must have a directory", db.Id)
+	}
+	if isMemoryPath(db.Path) || db.DisableWALMode {
+		mllog.Fatalf("for db '%s', WAL shipping needs a file-based db in WAL mode", db.Id)
+	}
+	if db.ReadOnly {
+		mllog.Fatalf("for db '%s', WAL shipping is meaningless for a read only db", db.Id)
+	}
+	if cfg.CheckpointBytes < 0 || cfg.EpochsPerGeneration < 0 || cfg.KeepGenerations < 0 {
+		mllog.Fatalf("for db '%s', WAL shipping parameters cannot be negative", db.Id)
+	}
+
+	dir := expandHomeDir(cfg.Dir, "WAL shipping directory")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		mllog.Fatalf("for db '%s', in creating WAL shipping directory: %s", db.Id, err.Error())
+	}
+
+	ws := &walShipper{
+		dir:                 dir,
+		walPath:             db.Path + "-wal",
+		checkpointBytes:     int64(cfg.CheckpointBytes),
+		epochsPerGeneration: cfg.EpochsPerGeneration,
+		keepGenerations:     cfg.KeepGenerations,
+	}
+	if ws.checkpointBytes == 0 {
+		ws.checkpointBytes = defaultWalCheckpointBytes
+	}
+	if ws.epochsPerGeneration == 0 {
+		ws.epochsPerGeneration = defaultWalEpochsPerGeneration
+	}
+
+	if _, err := db.DbConn.ExecContext(context.Background(), "PRAGMA wal_autocheckpoint = 0"); err != nil {
+		mllog.Fatalf("for db '%s', in disabling automatic checkpoints: %s", db.Id, err.Error())
+	}
+	if err := ws.newGeneration(db); err != nil {
+		mllog.Fatalf("for db '%s', in starting WAL shipping: %s", db.Id, err.Error())
+	}
+
+	db.WALShipper = ws
+	mllog.StdOutf("  + Shipping WAL to %s", dir)
+}
+
+func (ws *walShipper) checkpoint(db *db) error {
+	return checkpoint(db, "TRUNCATE")
+}
+
+// Checkpoints the WAL and takes a snapshot of the db file, that is then consistent.
+// Also deletes the older generations, if so configured.
+func (ws *walShipper) newGeneration(db *db) error {
+	if err := ws.checkpoint(db); err != nil {
+		return err
+	}
+
+	gen := time.Now().UTC().Format(walGenTimeFormat)
+	genDir := filepath.Join(ws.dir, gen)
+	if err := os.MkdirAll(genDir, 0700); err != nil {
+		return err
+	}
+	snapshot := filepath.Join(genDir, walSnapshotFile)
+	if err := copyFile(db.Path, snapshot+".tmp"); err != nil {
+		return err
+	}
+	if err := os.Rename(snapshot+".tmp", snapshot); err != nil {
+		return err
+	}
+
+	ws.gen, ws.epoch, ws.offset, ws.salt, ws.broken = gen, 0, 0, nil, false
+
+	if ws.keepGenerations > 0 {
+		gens, err := listWALGenerations(ws.dir)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(gens)-ws.keepGenerations; i++ {
+			os.RemoveAll(filepath.Join(ws.dir, gens[i]))
+		}
+	}
+	return nil
+}
+
+// Copies the committed frames appended to the WAL since the last time, then
+// checkpoints it if it's too big. Must be called while holding the db mutex,
+// and with no open transaction.
+func (ws *walShipper) ship(db *db) error {
+	if ws.broken {
+		return errors.New("a previous shipping failed")
+	}
+
+	f, err := os.Open(ws.walPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if size < ws.offset {
+		return errors.New("the WAL was truncated by someone else")
+	}
+	if size < walHeaderSize {
+		return nil
+	}
+
+	header := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	salt := header[16:24]
+	if ws.salt != nil && !bytes.Equal(salt, ws.salt) {
+		return errors.New("the WAL was restarted by someone else")
+	}
+
+	// Only the frames up to the last commit are shipped. Frames after that are
+	// left over by transactions that were rolled back, and will be overwritten.
+	frameSize := int64(walFrameHeaderSize + binary.BigEndian.Uint32(header[8:12]))
+	start := ws.offset
+	committed := ws.offset
+	frameHeader := make([]byte, walFrameHeaderSize)
+	off := start
+	if off == 0 {
+		off = walHeaderSize
+	}
+	for ; off+frameSize <= size; off += frameSize {
+		if _, err := f.ReadAt(frameHeader, off); err != nil {
+			return err
+		}
+		if !bytes.Equal(frameHeader[8:16], salt) {
+			break
+		}
+		if binary.BigEndian.Uint32(frameHeader[4:8]) != 0 { // commit frame
+			committed = off + frameSize
+		}
+	}
+	if committed == start {
+		return nil
+	}
+
+	epochDir := filepath.Join(ws.dir, ws.gen, fmt.Sprintf("%08d", ws.epoch))
+	if err := os.MkdirAll(epochDir, 0700); err != nil {
+		return err
+	}
+	segment := filepath.Join(epochDir, fmt.Sprintf("%016x_%019d%s", start, time.Now().UnixNano(), walSegmentExt))
+	if err := writeSegment(f, start, committed-start, segment); err != nil {
+		return err
+	}
+	ws.offset = committed
+	ws.salt = append([]byte{}, salt...)
+
+	if ws.offset >= ws.checkpointBytes {
+		if err := ws.checkpoint(db); err != nil {
+			return err
+		}
+		ws.epoch, ws.offset, ws.salt = ws.epoch+1, 0, nil
+		if ws.epoch >= ws.epochsPerGeneration {
+			return ws.newGeneration(db)
+		}
+	}
+	return nil
+}
+
+// The segment is written to a temp file and then renamed, so that a partial one
+// is never seen by a restore
+func writeSegment(f *os.File, offset, length int64, segment string) error {
+	out, err := os.OpenFile(segment+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(f, offset, length)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(segment+".tmp", segment)
+}
+
+// Ships the WAL of the db, if so configured. If it fails, it starts a new
+// generation, so that the shipped files are always consistent.
+func shipWAL(db *db) {
+	ws := db.WALShipper
+	if ws == nil {
+		return
+	}
+	if err := ws.ship(db); err != nil {
+		logError(logFields{"db": db.Id}, "in shipping WAL for db '%s', starting a new generation: %s", db.Id, err.Error())
+		if err := ws.newGeneration(db); err != nil {
+			logError(logFields{"db": db.Id}, "in starting a new WAL generation for db '%s': %s", db.Id, err.Error())
+			ws.broken = true
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Lists the generations in the directory, oldest first
+func listWALGenerations(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for i := range entries {
+		if !entries[i].IsDir() {
+			continue
+		}
+		if _, err := time.Parse(walGenTimeFormat, entries[i].Name()); err == nil {
+			ret = append(ret, entries[i].Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Lists the files in a dir with the given extension, sorted by name
+func listFiles(dir, ext string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for i := range entries {
+		if !entries[i].IsDir() && strings.HasSuffix(entries[i].Name(), ext) {
+			ret = append(ret, entries[i].Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Rebuilds the db as it was at the given time (or the latest possible, if nil)
+// from a WAL shipping directory. Uses the last generation that started before
+// that time, and applies its epochs in order.
+func restoreWAL(cfg restoreCfg) error {
+	gens, err := listWALGenerations(cfg.From)
+	if err != nil {
+		return err
+	}
+	gen := ""
+	for i := range gens {
+		genTime, _ := time.Parse(walGenTimeFormat, gens[i])
+		if cfg.ToTime == nil || !genTime.After(*cfg.ToTime) {
+			gen = gens[i]
+		}
+	}
+	if gen == "" {
+		return errors.New("no generation found before the given time")
+	}
+	genDir := filepath.Join(cfg.From, gen)
+
+	tmp := cfg.Into + ".restoring"
+	os.Remove(tmp)
+	os.Remove(tmp + "-wal")
+	os.Remove(tmp + "-shm")
+	if err := copyFile(filepath.Join(genDir, walSnapshotFile), tmp); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(genDir)
+	if err != nil {
+		return err
+	}
+	var epochs []string
+	for i := range entries {
+		if entries[i].IsDir() {
+			epochs = append(epochs, entries[i].Name())
+		}
+	}
+	sort.Strings(epochs)
+
+	for i := range epochs {
+		complete, err := applyWALEpoch(filepath.Join(genDir, epochs[i]), tmp, cfg.ToTime)
+		if err != nil {
+			os.Remove(tmp)
+			os.Remove(tmp + "-wal")
+			return fmt.Errorf("in applying epoch %s of generation %s: %s", epochs[i], gen, err.Error())
+		}
+		if !complete {
+			break
+		}
+	}
+
+	return finalizeRestore(tmp, cfg.Into)
+}
+
+// Concatenates the segments of an epoch (up to the given time) into a WAL file
+// for the db and checkpoints it. Returns false if some segments were after the
+// given time, so the following epochs must not be applied.
+func applyWALEpoch(epochDir, dbFile string, toTime *time.Time) (bool, error) {
+	segments, err := listFiles(epochDir, walSegmentExt)
+	if err != nil {
+		return false, err
+	}
+
+	wal, err := os.OpenFile(dbFile+"-wal", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	complete := true
+	var size int64
+	for i := range segments {
+		offsetStr, tsStr, _ := strings.Cut(strings.TrimSuffix(segments[i], walSegmentExt), "_")
+		offset, err1 := strconv.ParseInt(offsetStr, 16, 64)
+		ts, err2 := strconv.ParseInt(tsStr, 10, 64)
+		if err1 != nil || err2 != nil {
+			wal.Close()
+			return false, fmt.Errorf("invalid segment name: %s", segments[i])
+		}
+		if toTime != nil && time.Unix(0, ts).After(*toTime) {
+			complete = false
+			break
+		}
+		if offset != size {
+			wal.Close()
+			return false, fmt.Errorf("missing data before segment %s", segments[i])
+		}
+		data, err := os.ReadFile(filepath.Join(epochDir, segments[i]))
+		if err != nil {
+			wal.Close()
+			return false, err
+		}
+		if _, err := wal.Write(data); err != nil {
+			wal.Close()
+			return false, err
+		}
+		size += int64(len(data))
+	}
+	if err := wal.Close(); err != nil {
+		return false, err
+	}
+
+	// Opening the db recovers the WAL, the checkpoint moves it into the db file
+	dbObj, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return false, err
+	}
+	defer dbObj.Close()
+	if _, err := dbObj.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return false, err
+	}
+	return complete, nil
+}
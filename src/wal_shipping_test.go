@@ -0,0 +1,180 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+const (
+	walShipDb       = "../test/walship.db"
+	walShipDir      = "../test/walship"
+	walShipRestored = "../test/walship_restored.db"
+)
+
+var walShipTimes []time.Time
+
+func countRows(t *testing.T, dbFile string) int {
+	dbObj, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbObj.Close()
+
+	var cnt int
+	if err := dbObj.QueryRow("SELECT COUNT(1) FROM T1").Scan(&cnt); err != nil {
+		t.Fatal(err)
+	}
+	return cnt
+}
+
+func cleanWALShipFiles() {
+	os.Remove(walShipDb)
+	os.Remove(walShipDb + "-wal")
+	os.Remove(walShipDb + "-shm")
+	os.Remove(walShipRestored)
+	os.RemoveAll(walShipDir)
+}
+
+func TestWALShipSetup(t *testing.T) {
+	cleanWALShipFiles()
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: walShipDb,
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL BLOB)",
+				},
+				WALShipping: &walShippingCfg{
+					Dir:             walShipDir,
+					CheckpointBytes: 64 * 1024,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestWALShipWrites(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		req := request{
+			Transaction: []requestItem{
+				{
+					// ~40KB per transaction, so that there are several epochs
+					Statement: "WITH RECURSIVE CNT(X) AS (SELECT 1 UNION ALL SELECT X + 1 FROM CNT WHERE X < 10) " +
+						"INSERT INTO T1 (VAL) SELECT RANDOMBLOB(4000) FROM CNT",
+				},
+			},
+		}
+		code, body, _ := call("test", req, t)
+		if code != 200 {
+			t.Errorf("did not succeed: %s", body)
+			return
+		}
+		walShipTimes = append(walShipTimes, time.Now())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a failed transaction is not shipped
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 (VAL) VALUES ('X')",
+			},
+			{
+				Statement: "INSERT INTO NOPE VALUES (1)",
+			},
+		},
+	}
+	code, _, _ := call("test", req, t)
+	if code != 500 {
+		t.Error("did succeed, but shouldn't have")
+	}
+}
+
+func TestWALShipTeardown(t *testing.T) {
+	Shutdown()
+}
+
+func TestWALShipRestore(t *testing.T) {
+	defer cleanWALShipFiles()
+
+	gens, _ := listWALGenerations(walShipDir)
+	if len(gens) != 1 {
+		t.Errorf("expected 1 generation, found %d", len(gens))
+		return
+	}
+	epochs, _ := filepath.Glob(filepath.Join(walShipDir, gens[0], "0*"))
+	if len(epochs) < 2 {
+		t.Errorf("expected several epochs, found %d", len(epochs))
+	}
+
+	if err := restoreBackup(restoreCfg{From: walShipDir, Into: walShipRestored}); err != nil {
+		t.Error(err)
+		return
+	}
+	if cnt := countRows(t, walShipRestored); cnt != 50 {
+		t.Errorf("restored latest db has %d rows instead of 50", cnt)
+	}
+
+	for i := range walShipTimes {
+		if err := restoreBackup(restoreCfg{From: walShipDir, Into: walShipRestored, ToTime: &walShipTimes[i]}); err != nil {
+			t.Error(err)
+			return
+		}
+		if cnt := countRows(t, walShipRestored); cnt != (i+1)*10 {
+			t.Errorf("restored db at time #%d has %d rows instead of %d", i, cnt, (i+1)*10)
+		}
+	}
+
+	before := walShipTimes[0].Add(-time.Hour)
+	if err := restoreBackup(restoreCfg{From: walShipDir, Into: walShipRestored, ToTime: &before}); err == nil {
+		t.Error("did restore before the first generation, but shouldn't have")
+	}
+}
+
+func TestWALShipInMemory(t *testing.T) {
+	orig := mllog.WhenFatal
+	defer func() { mllog.WhenFatal = orig }()
+	mllog.WhenFatal = func(msg string) { panic(msg) }
+
+	ret := ""
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ret = r.(string)
+			}
+		}()
+		parseWALShipping(&db{Id: "test", Path: "file::memory:?cache=shared", WALShipping: &walShippingCfg{Dir: walShipDir}})
+	}()
+	if !strings.Contains(ret, "needs a file-based db") {
+		t.Errorf("WAL shipping accepted for an in-memory db: %s", ret)
+	}
+}
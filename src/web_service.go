@@ -20,11 +20,15 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/proofrock/crypgo"
+	"github.com/wI2L/jettison"
 )
 
 // Catches the panics and converts the argument in a struct that Fiber uses to
@@ -92,23 +96,85 @@ func decrypt(decoder requestItemCrypto, results map[string]interface{}) error {
 	return nil
 }
 
+// Returned when the execution of an item exceeds its timeout
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("execution timed out after %s", e.timeout)
+}
+
+// Computes the timeout for the execution of the items of a request, as the lowest
+// among the configured ones (in ms); 0 means no timeout.
+func itemTimeout(timeoutsMs ...int) time.Duration {
+	ret := 0
+	for _, t := range timeoutsMs {
+		if t > 0 && (ret == 0 || t < ret) {
+			ret = t
+		}
+	}
+	return time.Duration(ret) * time.Millisecond
+}
+
+// Derives the context for the execution of an item from the one of the request,
+// applying the timeout if any.
+func itemContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// If the error was caused by the timeout of the context, converts it to a timeoutError
+func checkTimeout(ctx context.Context, timeout time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return timeoutError{timeout}
+	}
+	return err
+}
+
+// When interrupting a write, SQLite rolls back the whole transaction, and the next items
+// would run in autocommit mode. Checks if that happened after a timeout: BEGIN only
+// succeeds outside of a transaction (and the one it opens is then rolled back by the
+// caller, that fails the request).
+func timeoutRolledBack(err error, tx *sql.Tx) bool {
+	if _, ok := err.(timeoutError); !ok {
+		return false
+	}
+	_, err = tx.ExecContext(context.Background(), "BEGIN")
+	return err == nil
+}
+
 // For a single query item, deals with a failure, determining if it must invalidate all of the transaction
 // or just report an error in the single query. In the former case, fails fast (panics), else it appends
 // the error to the response items, so the caller needs to return7continue
+//
+// A timeout is reported with its own code; if SQLite rolled back the transaction when interrupting
+// the statement, the caller must not pass noFail (see timeoutRolledBack()).
 func reportError(err error, code int, reqIdx int, noFail bool, results []responseItem) {
+	if _, ok := err.(timeoutError); ok {
+		code = fiber.StatusGatewayTimeout
+		err = errors.New(capitalize(err.Error()))
+	}
 	if !noFail {
 		panic(newWSError(reqIdx, code, err.Error()))
 	}
-	results[reqIdx] = responseItem{false, nil, nil, nil, capitalize(err.Error())}
+	results[reqIdx] = responseItem{false, nil, nil, nil, capitalize(err.Error()), false, nil}
 }
 
 // Processes a query, and returns a suitable responseItem
 //
 // This method is needed to execute properly the defers.
-func processWithResultSet(tx *sql.Tx, query string, decoder *requestItemCrypto, values map[string]interface{}) (*responseItem, error) {
+//
+// If limits are configured, the number of rows and the (approximate) size of the
+// response are checked; respBytes is the size of the response so far, and is shared
+// among the items of the request.
+func processWithResultSet(ctx context.Context, tx *sql.Tx, query string, decoder *requestItemCrypto, values map[string]interface{}, limits *limitsCfg, respBytes *int) (*responseItem, error) {
 	resultSet := make([]map[string]interface{}, 0)
+	truncated := false
 
-	rows, err := tx.Query(query, vals2nameds(values)...)
+	rows, err := tx.QueryContext(ctx, query, vals2nameds(values)...)
 	if err != nil {
 		return nil, err
 	}
@@ -116,6 +182,14 @@ func processWithResultSet(tx *sql.Tx, query string, decoder *requestItemCrypto,
 
 	fields, _ := rows.Columns() // I can ignore the error, rows aren't closed
 	for rows.Next() {
+		if limits != nil && limits.MaxResultRows > 0 && len(resultSet) == limits.MaxResultRows {
+			if !limits.Truncate {
+				return nil, fmt.Errorf("the result set exceeds the maximum number of rows (%d)", limits.MaxResultRows)
+			}
+			truncated = true
+			break
+		}
+
 		values := make([]interface{}, len(fields)) // values of the various fields
 		scans := make([]interface{}, len(fields))  // pointers to the values, to pass to Scan()
 		for i := range values {
@@ -135,6 +209,22 @@ func processWithResultSet(tx *sql.Tx, query string, decoder *requestItemCrypto,
 				return nil, err
 			}
 		}
+
+		if limits != nil && limits.MaxResponseBytes > 0 {
+			row, err := jettison.Marshal(toAdd)
+			if err != nil {
+				return nil, err
+			}
+			*respBytes += len(row)
+			if *respBytes > limits.MaxResponseBytes {
+				if !limits.Truncate {
+					return nil, fmt.Errorf("the response exceeds the maximum size (%d bytes)", limits.MaxResponseBytes)
+				}
+				truncated = true
+				break
+			}
+		}
+
 		resultSet = append(resultSet, toAdd)
 	}
 
@@ -142,12 +232,12 @@ func processWithResultSet(tx *sql.Tx, query string, decoder *requestItemCrypto,
 		return nil, err
 	}
 
-	return &responseItem{true, nil, nil, resultSet, ""}, nil
+	return &responseItem{true, nil, nil, resultSet, "", truncated, fields}, nil
 }
 
 // Process a single statement, and returns a suitable responseItem
-func processForExec(tx *sql.Tx, statement string, values map[string]interface{}) (*responseItem, error) {
-	res, err := tx.Exec(statement, vals2nameds(values)...)
+func processForExec(ctx context.Context, tx *sql.Tx, statement string, values map[string]interface{}) (*responseItem, error) {
+	res, err := tx.ExecContext(ctx, statement, vals2nameds(values)...)
 	if err != nil {
 		return nil, err
 	}
@@ -157,13 +247,13 @@ func processForExec(tx *sql.Tx, statement string, values map[string]interface{})
 		return nil, err
 	}
 
-	return &responseItem{true, &rowsUpdated, nil, nil, ""}, nil
+	return &responseItem{true, &rowsUpdated, nil, nil, "", false, nil}, nil
 }
 
 // Process a batch statement, and returns a suitable responseItem.
 // It prepares the statement, then executes it for each of the values' sets.
-func processForExecBatch(tx *sql.Tx, q string, valuesBatch []map[string]interface{}) (*responseItem, error) {
-	ps, err := tx.Prepare(q)
+func processForExecBatch(ctx context.Context, tx *sql.Tx, q string, valuesBatch []map[string]interface{}) (*responseItem, error) {
+	ps, err := tx.PrepareContext(ctx, q)
 	if err != nil {
 		return nil, err
 	}
@@ -171,7 +261,7 @@ func processForExecBatch(tx *sql.Tx, q string, valuesBatch []map[string]interfac
 
 	var rowsUpdatedBatch []int64
 	for i := range valuesBatch {
-		res, err := ps.Exec(vals2nameds(valuesBatch[i])...)
+		res, err := ps.ExecContext(ctx, vals2nameds(valuesBatch[i])...)
 		if err != nil {
 			return nil, err
 		}
@@ -184,7 +274,7 @@ func processForExecBatch(tx *sql.Tx, q string, valuesBatch []map[string]interfac
 		rowsUpdatedBatch = append(rowsUpdatedBatch, rowsUpdated)
 	}
 
-	return &responseItem{true, nil, rowsUpdatedBatch, nil, ""}, nil
+	return &responseItem{true, nil, rowsUpdatedBatch, nil, "", false, nil}, nil
 }
 
 func ckSQL(sql string) string {
@@ -205,16 +295,20 @@ func ckSQL(sql string) string {
 // Constructs and sends the response.
 func handler(databaseId string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		var body request
-		if err := c.BodyParser(&body); err != nil {
-			return newWSError(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
-		}
-
 		db, found := dbs[databaseId]
 		if !found {
 			return newWSError(-1, fiber.StatusNotFound, "database with ID '%s' not found", databaseId)
 		}
 
+		if db.Limits != nil && db.Limits.MaxRequestBytes > 0 && len(c.Body()) > db.Limits.MaxRequestBytes {
+			return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the request exceeds the maximum size (%d bytes)", db.Limits.MaxRequestBytes)
+		}
+
+		var body request
+		if err := c.BodyParser(&body); err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, "in parsing body: %s", err.Error())
+		}
+
 		// Execute non-concurrently
 		db.Mutex.Lock()
 		defer db.Mutex.Unlock()
@@ -234,24 +328,76 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 			return newWSError(-1, fiber.StatusBadRequest, "missing statements list ('transaction' node)")
 		}
 
+		if db.Limits != nil && db.Limits.MaxTransactionItems > 0 && len(body.Transaction) > db.Limits.MaxTransactionItems {
+			return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the transaction exceeds the maximum number of items (%d)", db.Limits.MaxTransactionItems)
+		}
+
+		if body.TimeoutMs < 0 {
+			return newWSError(-1, fiber.StatusBadRequest, "timeoutMs cannot be negative")
+		}
+
+		// The result set of a single query can be exported as CSV or TSV, if asked
+		format := c.Accepts(fiber.MIMEApplicationJSON, mimeCSV, mimeTSV)
+		if format == "" {
+			if err := columnarNotAcceptable(c); err != nil {
+				return err
+			}
+		}
+		var csvOpts csvOptions
+		if format == mimeCSV || format == mimeTSV {
+			if len(body.Transaction) != 1 || body.Transaction[0].Query == "" {
+				return newWSError(-1, fiber.StatusBadRequest, "only the result set of a single query can be exported as %s", format)
+			}
+			var err error
+			if csvOpts, err = csvOptionsFor(c, &db, format, true); err != nil {
+				return newWSError(-1, fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		timeout := itemTimeout(db.MaxQueryTimeMs, body.TimeoutMs)
+
+		// The context of the request is canceled when the server shuts down, and the one
+		// of the statements also when the client disconnects, if it can be detected (see
+		// watchConn()). The transaction is not bound to the latter, as database/sql would
+		// roll it back concurrently; it fails, and is rolled back here.
+		ctx, stopWatching := watchConn(c.Context(), c.Context().Conn())
+		defer stopWatching()
+
 		// Opens a transaction. One more occasion to specify: read only ;-)
-		tx, err := db.DbConn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: db.ReadOnly})
+		tx, err := db.DbConn.BeginTx(c.Context(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: db.ReadOnly})
 		if err != nil {
 			return newWSError(-1, fiber.StatusInternalServerError, err.Error())
 		}
 
+		audit := newAuditTrail(&db, c, &body)
+
+		var events []changeEvent // published only after the commit
+		ddl := false             // if the schema may have changed
+
 		tainted := true // If I reach the end of the method, I switch this to false to signal success
 		defer func() {
 			if tainted {
 				tx.Rollback()
+				audit.flush(&db, false)
 			} else {
-				tx.Commit()
+				committed := tx.Commit() == nil
+				audit.flush(&db, committed)
+				if committed {
+					publishChanges(&db, events)
+					if ddl {
+						schemaChanged(&db)
+					}
+				}
 			}
+			shipWAL(&db)
 		}()
 
 		var ret response
 		ret.Results = make([]responseItem, len(body.Transaction))
 
+		respBytes := 0 // approximate size of the result sets, for the limits
+
+	items:
 		for i := range body.Transaction {
 			txItem := body.Transaction[i]
 
@@ -282,6 +428,11 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 				continue
 			}
 
+			if db.Limits != nil && db.Limits.MaxBatchLength > 0 && len(txItem.ValuesBatch) > db.Limits.MaxBatchLength {
+				reportError(fmt.Errorf("valuesBatch exceeds the maximum length (%d)", db.Limits.MaxBatchLength), fiber.StatusRequestEntityTooLarge, i, txItem.NoFail, ret.Results)
+				continue
+			}
+
 			var sqll string
 
 			if hasResultSet {
@@ -297,8 +448,10 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 			}
 
 			// Processes a stored statement
+			var ssParams *storedStatement // if it declares its parameters
 			if strings.HasPrefix(sqll, "#") {
 				var ok bool
+				ssParams = db.StoredStatsParams[sqll[1:]]
 				sqll, ok = db.StoredStatsMap[sqll[1:]]
 				if !ok {
 					reportError(errors.New("a stored statement is required, but did not find it"), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
@@ -311,6 +464,15 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 				}
 			}
 
+			if mayChangeSchema(sqll) {
+				ddl = true
+			}
+
+			if !hasResultSet && db.ReplicaOf != nil {
+				reportError(replicaWriteError(&db), fiber.StatusForbidden, i, txItem.NoFail, ret.Results)
+				continue
+			}
+
 			if len(txItem.ValuesBatch) > 0 {
 				// Process a batch statement (multiple values)
 				var valuesBatch []map[string]interface{}
@@ -321,6 +483,13 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 						continue
 					}
 
+					if ssParams != nil {
+						if err := validateParams(ssParams, values); err != nil {
+							reportError(fmt.Errorf("in valuesBatch #%d, %s", i2, err.Error()), fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
+							continue items
+						}
+					}
+
 					if txItem.Encoder != nil {
 						if err := encrypt(*txItem.Encoder, values); err != nil {
 							reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
@@ -331,12 +500,24 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 					valuesBatch = append(valuesBatch, values)
 				}
 
-				retE, err := processForExecBatch(tx, sqll, valuesBatch)
+				start := time.Now()
+				itemCtx, cancel := itemContext(ctx, timeout)
+				retE, err := processForExecBatch(itemCtx, tx, sqll, valuesBatch)
+				err = checkTimeout(itemCtx, timeout, err)
+				cancel()
+				checkSlowQuery(&db, c, i, txItem.Statement, start, retE, err)
+				audit.add(i, txItem.Statement, false, nil, valuesBatch, retE, err)
 				if err != nil {
-					reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
+					reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail && !timeoutRolledBack(err, tx), ret.Results)
 					continue
 				}
 
+				if db.ChangeFeed {
+					if err := logChange(ctx, tx, sqll, nil, valuesBatch); err != nil {
+						reportError(err, fiber.StatusInternalServerError, i, false, ret.Results)
+					}
+				}
+
 				ret.Results[i] = *retE
 			} else {
 				// At most one values set (be it query or statement)
@@ -346,6 +527,13 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 					continue
 				}
 
+				if ssParams != nil {
+					if err := validateParams(ssParams, values); err != nil {
+						reportError(err, fiber.StatusBadRequest, i, txItem.NoFail, ret.Results)
+						continue
+					}
+				}
+
 				if txItem.Encoder != nil {
 					if err := encrypt(*txItem.Encoder, values); err != nil {
 						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
@@ -356,28 +544,89 @@ func handler(databaseId string) func(c *fiber.Ctx) error {
 				if hasResultSet {
 					// Query
 					// Externalized in a func so that defer rows.Close() actually runs
-					retWR, err := processWithResultSet(tx, sqll, txItem.Decoder, values)
+					changesBefore, err := changesBeforeQuery(&db, ctx, tx)
 					if err != nil {
 						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
 						continue
 					}
+					start := time.Now()
+					itemCtx, cancel := itemContext(ctx, timeout)
+					retWR, err := processWithResultSet(itemCtx, tx, sqll, txItem.Decoder, values, db.Limits, &respBytes)
+					err = checkTimeout(itemCtx, timeout, err)
+					cancel()
+					checkSlowQuery(&db, c, i, txItem.Query, start, retWR, err)
+					audit.add(i, txItem.Query, true, values, nil, retWR, err)
+					if err != nil {
+						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail && !timeoutRolledBack(err, tx), ret.Results)
+						continue
+					}
+
+					if err := afterQuery(&db, ctx, tx, changesBefore, sqll, values); err != nil {
+						reportError(err, fiber.StatusForbidden, i, false, ret.Results)
+					}
 
 					ret.Results[i] = *retWR
 				} else {
 					// Statement
-					retE, err := processForExec(tx, sqll, values)
+					start := time.Now()
+					itemCtx, cancel := itemContext(ctx, timeout)
+					retE, err := processForExec(itemCtx, tx, sqll, values)
+					err = checkTimeout(itemCtx, timeout, err)
+					cancel()
+					checkSlowQuery(&db, c, i, txItem.Statement, start, retE, err)
+					audit.add(i, txItem.Statement, false, values, nil, retE, err)
 					if err != nil {
-						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail, ret.Results)
+						reportError(err, fiber.StatusInternalServerError, i, txItem.NoFail && !timeoutRolledBack(err, tx), ret.Results)
 						continue
 					}
 
+					if db.ChangeFeed {
+						if err := logChange(ctx, tx, sqll, values, nil); err != nil {
+							reportError(err, fiber.StatusInternalServerError, i, false, ret.Results)
+						}
+					}
+
 					ret.Results[i] = *retE
 				}
 			}
 		}
 
+		if events, err = collectChangeEvents(ctx, tx, &db); err != nil {
+			return newWSError(-1, fiber.StatusInternalServerError, "in collecting change events: %s", err.Error())
+		}
+
 		tainted = false
 
+		if format == mimeCSV || format == mimeTSV {
+			return sendCSV(c, &ret.Results[0], format, csvOpts)
+		}
+
 		return c.Status(200).JSON(ret)
 	}
 }
+
+// Builds the middlewares for the endpoints of a db other than the main one,
+// with the same logging, CORS and authentication. As these may have no body,
+// for INLINE mode the credentials are given with HTTP Basic Authentication.
+func endpointHandlers(db *db, corsMethods string) []fiber.Handler {
+	handlers := []fiber.Handler{accessLog(db.Id), recover.New()}
+
+	if db.CORSOrigin != "" {
+		handlers = append(handlers, cors.New(cors.Config{
+			AllowMethods: corsMethods + ",OPTIONS",
+			AllowOrigins: db.CORSOrigin,
+		}))
+	}
+
+	if db.Auth != nil {
+		auth := db.Auth
+		if strings.ToUpper(auth.Mode) == authModeInline {
+			httpAuth := *auth
+			httpAuth.Mode = authModeHttp
+			auth = &httpAuth
+		}
+		handlers = append(handlers, authMiddleware(db, auth))
+	}
+
+	return handlers
+}
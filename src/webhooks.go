@@ -0,0 +1,280 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	mllog "github.com/proofrock/go-mylittlelogger"
+)
+
+// Webhooks are called when the data in some tables change (a call per committed
+// transaction, with all the matching changes) and/or when a scheduled task
+// succeeds or fails. Each webhook has a queue and a goroutine that delivers the
+// calls in order, retrying them with an exponential backoff; if the queue is
+// full, the call is dropped and an error is logged.
+
+const (
+	webhookEventChange = "change"
+	webhookEventTask   = "task"
+
+	webhookTaskSuccess = "success"
+	webhookTaskFailure = "failure"
+
+	defaultWebhookMaxRetries     = 3
+	defaultWebhookRetryBackoffMs = 1000
+	defaultWebhookTimeoutMs      = 10000
+	webhookQueueSize             = 100
+
+	webhookSignatureHeader = "X-Ws4sqlite-Signature"
+	webhookEventHeader     = "X-Ws4sqlite-Event"
+)
+
+// The data passed to the template, and the default (JSON) payload
+type webhookPayload struct {
+	Db        string        `json:"db"`
+	Event     string        `json:"event"`
+	Timestamp string        `json:"timestamp"`
+	Changes   []changeEvent `json:"changes,omitempty"`
+	Task      *taskRun      `json:"task,omitempty"`
+}
+
+type webhookCall struct {
+	event string
+	body  []byte
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	},
+}
+
+// Checks the configuration of the webhooks, and starts their delivery goroutines.
+func parseWebhooks(db *db) {
+	for i := range db.Webhooks {
+		wh := &db.Webhooks[i]
+
+		u, err := url.Parse(wh.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			mllog.Fatalf("for db '%s', webhook %d: URL is not valid: %s", db.Id, i, wh.Url)
+		}
+		if len(wh.Tables) == 0 && len(wh.Tasks) == 0 {
+			mllog.Fatalf("for db '%s', webhook %d: at least one of tables and tasks must be specified", db.Id, i)
+		}
+		if len(wh.Tables) > 0 && db.ChangeEvents == nil {
+			mllog.Fatalf("for db '%s', webhook %d: webhooks on tables need changeEvents to be configured", db.Id, i)
+		}
+		if len(wh.Operations) > 0 && len(wh.Tables) == 0 {
+			mllog.Fatalf("for db '%s', webhook %d: operations can only be specified along with tables", db.Id, i)
+		}
+		for j := range wh.Tables {
+			if wh.Tables[j] != "*" && !identifierRegexp.MatchString(wh.Tables[j]) {
+				mllog.Fatalf("for db '%s', webhook %d: table name is not valid: %s", db.Id, i, wh.Tables[j])
+			}
+		}
+		for j := range wh.Operations {
+			wh.Operations[j] = strings.ToUpper(wh.Operations[j])
+			if !contains(changeEventsOps, wh.Operations[j]) {
+				mllog.Fatalf("for db '%s', webhook %d: operation must be one of %s", db.Id, i, strings.Join(changeEventsOps, ", "))
+			}
+		}
+		for j := range wh.Tasks {
+			if wh.Tasks[j] != webhookTaskSuccess && wh.Tasks[j] != webhookTaskFailure {
+				mllog.Fatalf("for db '%s', webhook %d: tasks must be '%s' and/or '%s'", db.Id, i, webhookTaskSuccess, webhookTaskFailure)
+			}
+		}
+
+		if wh.Template != "" {
+			if wh.template, err = template.New(fmt.Sprint("webhook", i)).Funcs(webhookTemplateFuncs).Parse(wh.Template); err != nil {
+				mllog.Fatalf("for db '%s', webhook %d: in parsing template: %s", db.Id, i, err.Error())
+			}
+		}
+		if wh.ContentType == "" {
+			if wh.Template == "" {
+				wh.ContentType = "application/json"
+			} else {
+				wh.ContentType = "text/plain"
+			}
+		}
+
+		if wh.MaxRetries == nil {
+			maxRetries := defaultWebhookMaxRetries
+			wh.MaxRetries = &maxRetries
+		}
+		if *wh.MaxRetries < 0 || wh.RetryBackoffMs < 0 || wh.TimeoutMs < 0 {
+			mllog.Fatalf("for db '%s', webhook %d: retries, backoff and timeout cannot be negative", db.Id, i)
+		}
+		if wh.RetryBackoffMs == 0 {
+			wh.RetryBackoffMs = defaultWebhookRetryBackoffMs
+		}
+		if wh.TimeoutMs == 0 {
+			wh.TimeoutMs = defaultWebhookTimeoutMs
+		}
+
+		wh.queue = make(chan webhookCall, webhookQueueSize)
+		go deliverWebhooks(db.Id, i, wh)
+
+		mllog.StdOutf("  + Webhook to %s", wh.Url)
+	}
+}
+
+func contains(list []string, item string) bool {
+	for i := range list {
+		if list[i] == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the changes that the webhook is interested in
+func (wh *webhookCfg) filterChanges(events []changeEvent) []changeEvent {
+	if len(wh.Tables) == 0 {
+		return nil
+	}
+	var ret []changeEvent
+	for i := range events {
+		if !contains(wh.Tables, "*") && !contains(wh.Tables, events[i].Table) {
+			continue
+		}
+		if len(wh.Operations) > 0 && !contains(wh.Operations, events[i].Op) {
+			continue
+		}
+		ret = append(ret, events[i])
+	}
+	return ret
+}
+
+// Renders the payload and queues the call
+func (wh *webhookCfg) fire(dbId string, idx int, payload webhookPayload) {
+	var body []byte
+	if wh.template == nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			logError(logFields{"db": dbId, "webhook": idx}, "webhook %d for db '%s': %s", idx, dbId, err.Error())
+			return
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := wh.template.Execute(&buf, payload); err != nil {
+			logError(logFields{"db": dbId, "webhook": idx}, "webhook %d for db '%s', in rendering the template: %s", idx, dbId, err.Error())
+			return
+		}
+		body = buf.Bytes()
+	}
+
+	select {
+	case wh.queue <- webhookCall{event: payload.Event, body: body}:
+	default:
+		logError(logFields{"db": dbId, "webhook": idx}, "webhook %d for db '%s': queue is full, call dropped", idx, dbId)
+	}
+}
+
+// Calls the webhooks interested in the committed changes
+func fireChangeWebhooks(db *db, events []changeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	for i := range db.Webhooks {
+		if changes := db.Webhooks[i].filterChanges(events); len(changes) > 0 {
+			db.Webhooks[i].fire(db.Id, i, webhookPayload{
+				Db:        db.Id,
+				Event:     webhookEventChange,
+				Timestamp: time.Now().Format(time.RFC3339Nano),
+				Changes:   changes,
+			})
+		}
+	}
+}
+
+// Calls the webhooks interested in the outcome of a task
+func fireTaskWebhooks(db *db, run taskRun) {
+	outcome := webhookTaskFailure
+	if run.Success {
+		outcome = webhookTaskSuccess
+	}
+	for i := range db.Webhooks {
+		if contains(db.Webhooks[i].Tasks, outcome) {
+			db.Webhooks[i].fire(db.Id, i, webhookPayload{
+				Db:        db.Id,
+				Event:     webhookEventTask,
+				Timestamp: time.Now().Format(time.RFC3339Nano),
+				Task:      &run,
+			})
+		}
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *webhookCfg) call(client *http.Client, call webhookCall) error {
+	req, err := http.NewRequest(http.MethodPost, wh.Url, bytes.NewReader(call.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", wh.ContentType)
+	req.Header.Set(webhookEventHeader, call.event)
+	if wh.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(wh.Secret, call.body))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("received status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Delivers the queued calls, in order, retrying them with exponential backoff
+func deliverWebhooks(dbId string, idx int, wh *webhookCfg) {
+	client := &http.Client{Timeout: time.Duration(wh.TimeoutMs) * time.Millisecond}
+	for call := range wh.queue {
+		backoff := time.Duration(wh.RetryBackoffMs) * time.Millisecond
+		for attempt := 0; ; attempt++ {
+			err := wh.call(client, call)
+			if err == nil {
+				break
+			}
+			if attempt == *wh.MaxRetries {
+				logError(logFields{"db": dbId, "webhook": idx}, "webhook %d for db '%s' to %s failed, giving up: %s", idx, dbId, wh.Url, err.Error())
+				break
+			}
+			logWarn(logFields{"db": dbId, "webhook": idx}, "webhook %d for db '%s' to %s failed, retrying in %s: %s", idx, dbId, wh.Url, backoff, err.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedCall struct {
+	Path      string
+	Event     string
+	Signature string
+	Body      string
+}
+
+// A local receiver for the webhooks, that fails the first call to /tasks and
+// to /noretry
+type webhookReceiver struct {
+	mutex  sync.Mutex
+	calls  []receivedCall
+	failed map[string]bool
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	body, _ := io.ReadAll(req.Body)
+	r.calls = append(r.calls, receivedCall{
+		Path:      req.URL.Path,
+		Event:     req.Header.Get(webhookEventHeader),
+		Signature: req.Header.Get(webhookSignatureHeader),
+		Body:      string(body),
+	})
+	if (req.URL.Path == "/tasks" || req.URL.Path == "/noretry") && !r.failed[req.URL.Path] {
+		r.failed[req.URL.Path] = true
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (r *webhookReceiver) received(path string) []receivedCall {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ret []receivedCall
+	for i := range r.calls {
+		if r.calls[i].Path == path {
+			ret = append(ret, r.calls[i])
+		}
+	}
+	return ret
+}
+
+func TestWebhooks(t *testing.T) {
+	defer Shutdown()
+
+	receiver := &webhookReceiver{failed: map[string]bool{}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	t_r_u_e := true
+	zero := 0
+
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:   "test",
+				Path: ":memory:",
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+					"CREATE TABLE T2 (ID INTEGER PRIMARY KEY, VAL TEXT)",
+				},
+				ScheduledTasks: []scheduledTask{
+					{
+						AtStartup:  &t_r_u_e,
+						Statements: []string{"INSERT INTO T1 VALUES (100, 'FROM TASK')"},
+					}, {
+						AtStartup:  &t_r_u_e,
+						Statements: []string{"INSERT INTO NOPE VALUES (1)"},
+					},
+				},
+				ChangeEvents: &changeEventsCfg{},
+				Webhooks: []webhookCfg{
+					{
+						Url:        server.URL + "/changes",
+						Tables:     []string{"T1"},
+						Operations: []string{"insert"},
+						Secret:     "s3cr3t",
+					}, {
+						Url:            server.URL + "/tasks",
+						Tasks:          []string{webhookTaskFailure},
+						Template:       "{{.Db}}: task {{.Task.TaskIdx}} failed",
+						RetryBackoffMs: 50,
+					}, {
+						Url:            server.URL + "/noretry",
+						Tasks:          []string{webhookTaskFailure},
+						MaxRetries:     &zero,
+						RetryBackoffMs: 50,
+					},
+				},
+			},
+		},
+	}
+
+	go launch(cfg, true)
+
+	time.Sleep(3 * time.Second)
+
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (1, 'ONE')",
+			},
+			{
+				Statement: "UPDATE T1 SET VAL = 'UNO'",
+			},
+			{
+				Statement: "INSERT INTO T2 VALUES (1, 'ONE')",
+			},
+		},
+	}
+	code, body, _ := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %s", body)
+		return
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	changes := receiver.received("/changes")
+	if len(changes) != 2 {
+		t.Errorf("expected 2 calls for changes, got %d", len(changes))
+		return
+	}
+	for i, rowid := range []int64{100, 1} {
+		if changes[i].Event != webhookEventChange || changes[i].Signature != signWebhook("s3cr3t", []byte(changes[i].Body)) {
+			t.Errorf("wrong event or signature: %v", changes[i])
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal([]byte(changes[i].Body), &payload); err != nil {
+			t.Error(err)
+			continue
+		}
+		if payload.Db != "test" || len(payload.Changes) != 1 || payload.Changes[0].Table != "T1" ||
+			payload.Changes[0].Op != "INSERT" || payload.Changes[0].RowId != rowid {
+			t.Errorf("wrong payload: %s", changes[i].Body)
+		}
+	}
+
+	tasks := receiver.received("/tasks")
+	if len(tasks) != 2 {
+		t.Errorf("expected 2 calls (with a retry) for tasks, got %d", len(tasks))
+		return
+	}
+	if tasks[1].Body != "test: task 1 failed" || tasks[1].Signature != "" || tasks[1].Event != webhookEventTask {
+		t.Errorf("wrong call: %v", tasks[1])
+	}
+
+	if noRetry := receiver.received("/noretry"); len(noRetry) != 1 {
+		t.Errorf("expected 1 call (without retries), got %d", len(noRetry))
+	}
+}
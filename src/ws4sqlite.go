@@ -17,19 +17,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/basicauth"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/mitchellh/go-homedir"
 	mllog "github.com/proofrock/go-mylittlelogger"
 	"github.com/wI2L/jettison"
+	"io"
 	"os"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	_ "modernc.org/sqlite"
@@ -37,6 +37,9 @@ import (
 
 const version = "0.15.0"
 
+// Default maximum size of the bodies of the imports and snapshots
+const defaultMaxUploadBytes = 1 << 30
+
 func getSQLiteVersion() (string, error) {
 	dbObj, err := sql.Open("sqlite", ":memory:")
 	defer dbObj.Close()
@@ -67,6 +70,14 @@ func main() {
 
 	cfg := parseCLI()
 
+	if cfg.Restore != nil {
+		if err := restoreBackup(*cfg.Restore); err != nil {
+			mllog.Fatalf("in restoring backup: %s", err.Error())
+		}
+		mllog.StdOutf("- Restored backup %s into %s", cfg.Restore.From, cfg.Restore.Into)
+		return
+	}
+
 	launch(cfg, false)
 }
 
@@ -86,6 +97,8 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		mllog.Fatal("no database nor dir to serve specified")
 	}
 
+	logJSON = cfg.LogFormat == logFormatJSON
+
 	// Let's create the web server
 	app = fiber.New(fiber.Config{
 		DisableStartupMessage: true,
@@ -99,10 +112,16 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		// operations it's of course desirable.
 		DisableKeepalive: disableKeepAlive4Tests,
 		Network:          fiber.NetworkTCP,
+		// Imports and snapshots can be big, so their bodies are streamed; it's not
+		// enabled otherwise, because the other endpoints must read the whole body.
+		StreamRequestBody: streamRequestBodies(cfg),
 	})
 	// This intercepts the panics, and delegates them to the ErrorHandler.
 	// See the comments to errHandler() to see why.
 	app.Use(recover.New())
+	if streamRequestBodies(cfg) {
+		app.Use(limitRequestBodies)
+	}
 
 	// Later on, for each file created there will be a defer to remove it, unless this
 	// guard is turned off
@@ -114,6 +133,8 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		}
 		origWhenFatal(msg)
 	}
+	// Also restored below, before serving; this covers the early returns
+	defer func() { mllog.WhenFatal = origWhenFatal }()
 
 	dbs = make(map[string]db)
 	for i := range cfg.Databases {
@@ -128,8 +149,7 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			mllog.Fatalf("id '%s' already specified.", database.Id)
 		}
 
-		// FIXME check if this is enough to consider it in-memory
-		isMemory := strings.Contains(database.Path, ":memory:")
+		isMemory := isMemoryPath(database.Path)
 
 		if database.Path == "" {
 			mllog.Fatalf("no path specified for db '%s'.", database.Id)
@@ -191,17 +211,23 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		database.Mutex = &mutex
 
 		database.StoredStatsMap = make(map[string]string)
+		database.StoredStatsParams = make(map[string]*storedStatement)
 
 		for j := range database.StoredStatement {
 			ss := database.StoredStatement[j]
 			if ss.Id == "" || ss.Sql == "" {
 				mllog.Fatalf("no ID or SQL specified for stored statement #%d in database '%s'", j, database.Id)
 			}
+			parseStoredStatementAnnotations(&database, &database.StoredStatement[j])
 			database.StoredStatsMap[ss.Id] = ss.Sql
+			if len(ss.Params) > 0 {
+				database.StoredStatsParams[ss.Id] = &database.StoredStatement[j]
+			}
 		}
 
 		if len(database.StoredStatsMap) > 0 {
 			mllog.StdOutf("  + With %d stored statements", len(database.StoredStatsMap))
+			parseExposeAsGet(&database)
 		} else if database.UseOnlyStoredStatements {
 			mllog.Fatalf("for db '%s', specified to use only stored statements but no one is provided", database.Id)
 		}
@@ -236,9 +262,21 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			mllog.Fatalf("in opening connection to %s: %s", database.Id, err.Error())
 		}
 
+		// Before anything else, as the rest may depend on the migrated schema
+		if len(database.Migrations) > 0 || database.MigrationsDir != "" {
+			parseMigrations(&database)
+			performMigrations(&database)
+		}
+
+		if cfg.MigrateOnly {
+			dbs[database.Id] = database
+			continue
+		}
+
 		// Parsing of the authentication
 		if database.Auth != nil {
-			parseAuth(&database)
+			parseAuth(&database, database.Auth, "Authentication")
+			checkClientCA(cfg, &database, database.Auth)
 		}
 
 		// Parsing of the scheduled tasks
@@ -252,13 +290,91 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			parseTasks(&database)
 		}
 
+		// Parsing of the audit log
+		if database.Audit != nil {
+			parseAudit(&database)
+		}
+
+		// Parsing of the admin endpoints
+		if database.Admin != nil {
+			parseAdmin(&database)
+			checkClientCA(cfg, &database, database.Admin)
+		}
+
+		if database.SlowQueryThresholdMs != 0 || database.SlowQueryLogSize != 0 {
+			parseSlowQueries(&database)
+		}
+
+		if database.Limits != nil {
+			parseLimits(&database)
+		}
+
+		if database.MaxQueryTimeMs < 0 {
+			mllog.Fatalf("for db '%s', maxQueryTimeMs cannot be negative", database.Id)
+		} else if database.MaxQueryTimeMs > 0 {
+			mllog.StdOutf("  + Queries and statements time out after %dms", database.MaxQueryTimeMs)
+		}
+
 		if database.CORSOrigin != "" {
 			mllog.StdOutf("  + CORS Origin set to %s", database.CORSOrigin)
 		}
 
+		if database.ChangeFeed {
+			parseChangeFeed(&database)
+		} else if database.ChangeFeedRetention != nil {
+			mllog.Fatalf("for db '%s', changeFeedRetention is meaningless without changeFeed", database.Id)
+		}
+
+		if database.ReplicaOf != nil {
+			parseReplica(&database)
+		}
+
+		if database.ChangeEvents != nil {
+			parseChangeEvents(&database)
+		}
+
+		if len(database.Webhooks) > 0 {
+			parseWebhooks(&database)
+		}
+
+		if database.Schema != nil {
+			parseSchema(&database)
+		}
+
+		if database.Rest != nil {
+			parseRest(&database)
+		}
+
+		if database.OpenAPI != nil {
+			parseOpenAPI(&database)
+		}
+
+		if database.Csv != nil {
+			parseCsv(&database)
+		}
+
+		if database.Import != nil {
+			parseImport(&database)
+		}
+
+		// Last, so that the first snapshot includes the tables created while parsing
+		if database.WALShipping != nil {
+			parseWALShipping(&database)
+		}
+
+		// After everything is set up, as the changes are applied concurrently
+		if database.ReplicaOf != nil {
+			go replicate(&database)
+		}
+
 		dbs[database.Id] = database
 	}
 
+	if cfg.MigrateOnly {
+		mllog.StdOut("- Migrations performed, exiting")
+		return
+	}
+
 	if cfg.ServeDir != nil {
 		app.Static("", *cfg.ServeDir, fiber.Static{
 			ByteRange: true,
@@ -275,7 +391,9 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 	for id := range dbs {
 		db := dbs[id]
 
-		var handlers []fiber.Handler
+		// The access log goes first, and it needs its own recover to be able to
+		// log the panics of the following handlers
+		handlers := []fiber.Handler{accessLog(db.Id), recover.New()}
 
 		if db.CORSOrigin != "" {
 			handlers = append(handlers, cors.New(cors.Config{
@@ -284,26 +402,10 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 			}))
 		}
 
-		if db.Auth != nil && strings.ToUpper(db.Auth.Mode) == authModeHttp {
-			handlers = append(handlers, basicauth.New(basicauth.Config{
-				Authorizer: func(user, password string) bool {
-					if err := applyAuthCreds(&db, user, password); err != nil {
-						// When unauthenticated waits for 1s, and doesn't parallelize, to hinder brute force attacks
-						db.Mutex.Lock()
-						time.Sleep(time.Second)
-						db.Mutex.Unlock()
-						mllog.Errorf("credentials not valid for user '%s'", user)
-						return false
-					}
-					return true
-				},
-				Unauthorized: func(c *fiber.Ctx) error {
-					if db.Auth.CustomErrorCode != nil {
-						return c.Status(*db.Auth.CustomErrorCode).SendString("Unauthorized")
-					}
-					return c.SendStatus(fiber.StatusUnauthorized)
-				},
-			}))
+		if db.Auth != nil {
+			if authHandler := authMiddleware(&db, db.Auth); authHandler != nil {
+				handlers = append(handlers, authHandler)
+			}
 		}
 
 		handlers = append(handlers, handler(db.Id))
@@ -313,16 +415,154 @@ func launch(cfg config, disableKeepAlive4Tests bool) {
 		if db.CORSOrigin != "" {
 			app.Options(fmt.Sprintf("/%s", db.Id), handlers...)
 		}
+
+		registerChangeEvents(&db)
+		registerSchema(&db)
+		registerRest(&db)
+		registerOpenAPI(&db)
+		registerNamedQueries(&db)
+		registerImport(&db)
+
+		registerAdminEndpoints(&db)
 	}
 
 	// Actually start the web server, finally
 	conn := fmt.Sprint(cfg.Bindhost, ":", cfg.Port)
-	mllog.StdOut("- Web Service listening on ", conn)
-	if err := app.Listen(conn); err != nil {
+	if cfg.TLS == nil {
+		mllog.StdOut("- Web Service listening on ", conn)
+		err = app.Listen(conn)
+	} else if cfg.TLS.ClientCAFile == "" {
+		mllog.StdOut("- Web Service listening on ", conn, " (HTTPS)")
+		err = app.ListenTLS(conn, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	} else {
+		mllog.StdOut("- Web Service listening on ", conn, " (HTTPS, with client certificates)")
+		err = app.ListenMutualTLS(conn, cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+	}
+	if err != nil {
 		mllog.Fatal(err.Error())
 	}
 }
 
+// Whether some db has endpoints that stream the request body
+func streamRequestBodies(cfg config) bool {
+	for i := range cfg.Databases {
+		if cfg.Databases[i].Import != nil || cfg.Databases[i].Admin != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the request is for an endpoint that streams the body
+func streamsRequestBody(c *fiber.Ctx) bool {
+	id, path, _ := strings.Cut(strings.TrimPrefix(c.Path(), "/"), "/")
+	db, ok := dbs[id]
+	if !ok {
+		return false
+	}
+	switch {
+	case c.Method() == fiber.MethodPost && strings.HasPrefix(path, "import/"):
+		return db.Import != nil
+	case c.Method() == fiber.MethodPut && path == "_admin/snapshot":
+		return db.Admin != nil
+	}
+	return false
+}
+
+// When the bodies are streamed, fasthttp doesn't enforce the body limit, and
+// reading a body would load it in memory whatever its size. So the (default)
+// limit is enforced here for all the endpoints but the ones that stream the
+// body; they cap it by themselves, see newUploadReader().
+func limitRequestBodies(c *fiber.Ctx) error {
+	if streamsRequestBody(c) {
+		return c.Next()
+	}
+	if c.Request().Header.ContentLength() > fiber.DefaultBodyLimit {
+		return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the request body exceeds the maximum size (%d bytes)", fiber.DefaultBodyLimit)
+	}
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		// chunked, or not yet read
+		body, err := io.ReadAll(io.LimitReader(stream, fiber.DefaultBodyLimit+1))
+		if err != nil {
+			return newWSError(-1, fiber.StatusBadRequest, "in reading the body: %s", err.Error())
+		}
+		if len(body) > fiber.DefaultBodyLimit {
+			return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the request body exceeds the maximum size (%d bytes)", fiber.DefaultBodyLimit)
+		}
+		c.Request().SetBody(body)
+	}
+	return c.Next()
+}
+
+// The body of a request to an endpoint that streams it (imports and snapshots),
+// that fails when it exceeds the maximum size of the uploads
+type uploadReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func newUploadReader(c *fiber.Ctx, db *db) (*uploadReader, error) {
+	max := int64(defaultMaxUploadBytes)
+	if db.Limits != nil && db.Limits.MaxUploadBytes > 0 {
+		max = db.Limits.MaxUploadBytes
+	}
+	ret := &uploadReader{max: max}
+	if int64(c.Request().Header.ContentLength()) > max {
+		return nil, ret.tooLarge()
+	}
+
+	// Big bodies are streamed, the others are already read
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	ret.r = io.LimitReader(body, max+1)
+	return ret, nil
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.exceeded() {
+		return n, r.tooLarge()
+	}
+	return n, err
+}
+
+func (r *uploadReader) exceeded() bool {
+	return r.read > r.max
+}
+
+func (r *uploadReader) tooLarge() error {
+	return newWSError(-1, fiber.StatusRequestEntityTooLarge, "the request body exceeds the maximum size of the uploads (%d bytes)", r.max)
+}
+
+// Checks the limits configuration; zero means that a limit is not enforced
+func parseLimits(database *db) {
+	l := database.Limits
+	if l.MaxRequestBytes < 0 || l.MaxTransactionItems < 0 || l.MaxBatchLength < 0 || l.MaxResultRows < 0 || l.MaxResponseBytes < 0 || l.MaxUploadBytes < 0 {
+		mllog.Fatalf("for db '%s', limits cannot be negative", database.Id)
+	}
+	if l.Truncate {
+		mllog.StdOut("  + Limits enforced, result sets are truncated when exceeding them")
+	} else {
+		mllog.StdOut("  + Limits enforced")
+	}
+}
+
+// Authentication by client certificate is only possible with mutual TLS
+func checkClientCA(cfg config, database *db, auth *authr) {
+	if strings.ToUpper(auth.Mode) == authModeCert && (cfg.TLS == nil || cfg.TLS.ClientCAFile == "") {
+		mllog.Fatalf("for db '%s', authentication by client certificate requires a client CA (mutual TLS)", database.Id)
+	}
+}
+
+// FIXME check if this is enough to consider it in-memory
+func isMemoryPath(path string) bool {
+	return strings.Contains(path, ":memory:")
+}
+
 func performInitStatements(database db, dbObj *sql.DB, isMemory bool) {
 	// This is implemented in its own method to allow the defer to run ASAP
 
@@ -18,8 +18,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -44,6 +47,12 @@ func Shutdown() {
 	if len(dbs) > 0 {
 		mllog.StdOut("Closing databases...")
 		for i := range dbs {
+			if dbs[i].ReplicaOf != nil {
+				close(dbs[i].ReplicaOf.Stop)
+			}
+			if dbs[i].ChangeBroker != nil {
+				close(dbs[i].ChangeBroker.stop)
+			}
 			if dbs[i].DbConn != nil {
 				dbs[i].DbConn.Close()
 			}
@@ -1406,3 +1415,320 @@ func TestFileServerWithOverlap(t *testing.T) {
 
 	Shutdown()
 }
+
+func TestTimeoutsSetup(t *testing.T) {
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "test",
+				Path:           ":memory:",
+				MaxQueryTimeMs: 50,
+				InitStatements: []string{
+					"CREATE TABLE T1 (ID INT)",
+				},
+			}, {
+				Id:   "test2",
+				Path: ":memory:",
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestTimeoutServerSide(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (1)",
+			},
+			{
+				Statement: "INSERT INTO T1 " + slowQuery1M,
+				NoFail:    true, // SQLite rolls back the transaction, that fails anyway
+			},
+		},
+	}
+
+	code, body, _ := call("test", req, t)
+	if code != 504 {
+		t.Errorf("did not fail with 504: %d %s", code, body)
+		return
+	}
+
+	var wse wsError
+	json.Unmarshal([]byte(body), &wse)
+	if wse.RequestIdx != 1 {
+		t.Errorf("wrong reqIdx: %s", body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(1) AS CNT FROM T1",
+			},
+		},
+	}
+
+	code, body, res := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed after the timeout: %s", body)
+		return
+	}
+
+	if res.Results[0].ResultSet[0]["CNT"] != float64(0) {
+		t.Error("transaction was not rolled back")
+	}
+}
+
+func TestTimeoutNoFail(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (2)",
+			},
+			{
+				Query:  slowQuery1M,
+				NoFail: true, // a query doesn't roll back the transaction
+			},
+		},
+	}
+
+	code, body, res := call("test", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed: %d %s", code, body)
+		return
+	}
+	if res.Results[1].Success || !strings.Contains(res.Results[1].Error, "timed out") {
+		t.Errorf("the timeout was not reported: %s", body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT COUNT(1) AS CNT FROM T1",
+			},
+		},
+	}
+	if code, body, res = call("test", req, t); code != 200 || res.Results[0].ResultSet[0]["CNT"] != float64(1) {
+		t.Errorf("transaction was not committed: %s", body)
+	}
+}
+
+func TestTimeoutClientSide(t *testing.T) {
+	req := request{
+		TimeoutMs: 20,
+		Transaction: []requestItem{
+			{
+				Query: slowQuery1M,
+			},
+		},
+	}
+
+	code, body, _ := call("test2", req, t)
+	if code != 504 {
+		t.Errorf("did not fail with 504: %d %s", code, body)
+	}
+
+	req.TimeoutMs = 0
+	code, body, _ = call("test2", req, t)
+	if code != 200 {
+		t.Errorf("did not succeed without timeout: %d %s", code, body)
+	}
+
+	req.TimeoutMs = -1
+	code, body, _ = call("test2", req, t)
+	if code != 400 {
+		t.Errorf("did not fail with 400: %d %s", code, body)
+	}
+}
+
+func TestTimeoutClientDisconnected(t *testing.T) {
+	if !detectsDisconnections {
+		t.Skip("the disconnections are not detected on this OS")
+	}
+
+	body, _ := json.Marshal(request{
+		Transaction: []requestItem{
+			{
+				Query: strings.Replace(slowQuery1M, "1000000", "100000000", 1),
+			},
+		},
+	})
+	conn, err := net.Dial("tcp", "localhost:12321")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Fprintf(conn, "POST /test2 HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	// the query is canceled, and the db is free again
+	start := time.Now()
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT 1",
+			},
+		},
+	}
+	if code, body, _ := call("test2", req, t); code != 200 {
+		t.Errorf("did not succeed: %d %s", code, body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the query was not canceled, the db was held for %s", elapsed)
+	}
+}
+
+func TestTimeoutsTeardown(t *testing.T) {
+	Shutdown()
+}
+
+func TestLimitsSetup(t *testing.T) {
+	initStatements := []string{
+		"CREATE TABLE T1 (ID INT, VAL TEXT)",
+		"INSERT INTO T1 VALUES (1, 'ONE'), (2, 'TWO'), (3, 'THREE'), (4, 'FOUR'), (5, 'FIVE')",
+	}
+	cfg := config{
+		Bindhost: "0.0.0.0",
+		Port:     12321,
+		Databases: []db{
+			{
+				Id:             "test",
+				Path:           ":memory:",
+				InitStatements: initStatements,
+				Limits: &limitsCfg{
+					MaxRequestBytes:     1000,
+					MaxTransactionItems: 2,
+					MaxBatchLength:      2,
+					MaxResultRows:       3,
+				},
+			}, {
+				Id:             "test2",
+				Path:           ":memory:",
+				InitStatements: initStatements,
+				Limits: &limitsCfg{
+					MaxResultRows:    4,
+					MaxResponseBytes: 70,
+					Truncate:         true,
+				},
+			},
+		},
+	}
+	go launch(cfg, true)
+
+	time.Sleep(time.Second)
+}
+
+func TestLimitsRequest(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT 1",
+			},
+			{
+				Query: "SELECT 2",
+			},
+			{
+				Query: "SELECT 3",
+			},
+		},
+	}
+
+	code, body, _ := call("test", req, t)
+	if code != 413 {
+		t.Errorf("too many items, did not fail with 413: %d %s", code, body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT 1 WHERE '" + strings.Repeat("x", 1000) + "' = ''",
+			},
+		},
+	}
+
+	code, body, _ = call("test", req, t)
+	if code != 413 {
+		t.Errorf("request too big, did not fail with 413: %d %s", code, body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Statement: "INSERT INTO T1 VALUES (:ID, 'X')",
+				ValuesBatch: []map[string]json.RawMessage{
+					mkRaw(map[string]interface{}{"ID": 6}),
+					mkRaw(map[string]interface{}{"ID": 7}),
+					mkRaw(map[string]interface{}{"ID": 8}),
+				},
+			},
+		},
+	}
+
+	code, body, _ = call("test", req, t)
+	if code != 413 {
+		t.Errorf("batch too long, did not fail with 413: %d %s", code, body)
+	}
+}
+
+func TestLimitsResult(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT * FROM T1 WHERE ID <= 3",
+			},
+		},
+	}
+
+	code, body, res := call("test", req, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 3 || res.Results[0].Truncated {
+		t.Errorf("did not succeed with 3 rows: %d %s", code, body)
+	}
+
+	req.Transaction[0].Query = "SELECT * FROM T1"
+
+	code, body, _ = call("test", req, t)
+	if code != 500 || !strings.Contains(body, "maximum number of rows") {
+		t.Errorf("too many rows, did not fail: %d %s", code, body)
+	}
+}
+
+func TestLimitsTruncate(t *testing.T) {
+	req := request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT ID FROM T1",
+			},
+		},
+	}
+
+	code, body, res := call("test2", req, t)
+	if code != 200 || len(res.Results[0].ResultSet) != 4 || !res.Results[0].Truncated {
+		t.Errorf("did not truncate to 4 rows: %d %s", code, body)
+	}
+
+	req = request{
+		Transaction: []requestItem{
+			{
+				Query: "SELECT ID, VAL FROM T1 WHERE ID = 1",
+			},
+			{
+				Query: "SELECT ID, VAL FROM T1",
+			},
+		},
+	}
+
+	// each row is ~20 bytes, so 2 rows fit in the second result set
+	code, body, res = call("test2", req, t)
+	if code != 200 || len(res.Results[1].ResultSet) != 2 || !res.Results[1].Truncated || res.Results[0].Truncated {
+		t.Errorf("did not truncate by size: %d %s", code, body)
+	}
+}
+
+func TestLimitsTeardown(t *testing.T) {
+	Shutdown()
+}